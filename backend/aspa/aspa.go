@@ -0,0 +1,184 @@
+package aspa
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hamptonmoore/bgp.exposed/backend/common"
+)
+
+// export is the part of an rpki-client JSON export holding the validated ASPA
+// objects
+type export struct {
+	ASPAs []struct {
+		Customer  uint32            `json:"customer_asid"`
+		Providers []json.RawMessage `json:"providers"`
+		// Older rpki-client versions wrote provider_set, with a per provider
+		// AFI limit that later drafts dropped
+		ProviderSet []struct {
+			ASN uint32 `json:"asid"`
+		} `json:"provider_set"`
+	} `json:"aspas"`
+}
+
+// Set is the ASPA objects of an rpki-client JSON export, mapping each
+// customer AS to the set of its providers
+type Set struct {
+	path string
+
+	lock      sync.RWMutex
+	modTime   time.Time
+	providers map[uint32]map[uint32]bool
+}
+
+// Load reads the ASPA objects from an rpki-client JSON export
+func Load(path string) (*Set, error) {
+	s := &Set{path: path}
+	if _, err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads the export again if it changed since it was last read,
+// reporting whether it did. The previous objects are kept on errors, and a
+// broken export isn't read again until it changes.
+func (s *Set) Reload() (bool, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return false, err
+	}
+	s.lock.RLock()
+	unchanged := info.ModTime().Equal(s.modTime)
+	s.lock.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	providers, err := readExport(s.path)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.modTime = info.ModTime()
+	if err != nil {
+		return false, err
+	}
+	s.providers = providers
+	return true, nil
+}
+
+// readExport maps the customer ASes in an rpki-client JSON export to their
+// providers
+func readExport(path string) (map[uint32]map[uint32]bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	e := export{}
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+	providers := map[uint32]map[uint32]bool{}
+	for _, aspa := range e.ASPAs {
+		set := providers[aspa.Customer]
+		if set == nil {
+			set = map[uint32]bool{}
+			providers[aspa.Customer] = set
+		}
+		for _, raw := range aspa.Providers {
+			var asn uint32
+			if err := json.Unmarshal(raw, &asn); err != nil {
+				return nil, fmt.Errorf("invalid provider %s in the ASPA of AS%d", raw, aspa.Customer)
+			}
+			set[asn] = true
+		}
+		for _, provider := range aspa.ProviderSet {
+			set[provider.ASN] = true
+		}
+	}
+	return providers, nil
+}
+
+// Len returns the number of customer ASes with an ASPA
+func (s *Set) Len() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.providers)
+}
+
+// Results of the provider authorization function
+const (
+	noAttestation = iota
+	providerPlus
+	notProviderPlus
+)
+
+// authorized checks whether the customer AS attests the provider AS as one of
+// its providers
+func (s *Set) authorized(customer uint32, provider uint32) int {
+	set, ok := s.providers[customer]
+	if !ok {
+		return noAttestation
+	}
+	if set[provider] {
+		return providerPlus
+	}
+	return notProviderPlus
+}
+
+// VerifyUpstream runs the upstream path verification of
+// draft-ietf-sidrops-aspa-verification on an AS_PATH received from a
+// customer, lateral peer, route server client or route server with the
+// neighbor ASN. The path of a transparent route server starts with its client
+// rather than the neighbor, so transparent skips that check. The hop reported
+// is the one closest to the origin that decided the outcome. Confederation
+// segments are skipped as they never leave the confederation.
+func (s *Set) VerifyUpstream(path common.AsPath, neighbor uint32, transparent bool) common.ASPAResult {
+	asns := []uint32{}
+	for _, segment := range path {
+		switch segment.Type {
+		case common.SegmentSequence:
+			for _, asn := range segment.ASNs {
+				// Prepends count once
+				if len(asns) == 0 || asns[len(asns)-1] != asn {
+					asns = append(asns, asn)
+				}
+			}
+		case common.SegmentSet:
+			return common.ASPAResult{State: common.ASPAInvalid, Reason: "the AS_PATH has an AS_SET"}
+		}
+	}
+	if len(asns) == 0 || (asns[0] != neighbor && !transparent) {
+		return common.ASPAResult{State: common.ASPAInvalid, Reason: fmt.Sprintf("the AS_PATH doesn't start with the peer's ASN %d", neighbor)}
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var unknown *common.ASPAHop
+	// Walk up from the origin, every AS must have sent the route to a provider
+	for i := len(asns) - 1; i > 0; i-- {
+		hop := &common.ASPAHop{Customer: asns[i], Provider: asns[i-1]}
+		switch s.authorized(hop.Customer, hop.Provider) {
+		case notProviderPlus:
+			return common.ASPAResult{
+				State:  common.ASPAInvalid,
+				Hop:    hop,
+				Reason: fmt.Sprintf("AS%d doesn't list AS%d as a provider", hop.Customer, hop.Provider),
+			}
+		case noAttestation:
+			if unknown == nil {
+				unknown = hop
+			}
+		}
+	}
+	if unknown != nil {
+		return common.ASPAResult{
+			State:  common.ASPAUnknown,
+			Hop:    unknown,
+			Reason: fmt.Sprintf("AS%d has no ASPA", unknown.Customer),
+		}
+	}
+	return common.ASPAResult{State: common.ASPAValid}
+}
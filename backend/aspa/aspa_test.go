@@ -0,0 +1,152 @@
+package aspa
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/hamptonmoore/bgp.exposed/backend/common"
+)
+
+// testExport has AS65001 and AS65002 as providers of AS65003, which is a
+// provider of AS65004. AS65005 uses the older provider_set form.
+const testExport = `{"aspas": [
+	{"customer_asid": 65003, "providers": [65001, 65002]},
+	{"customer_asid": 65004, "providers": [65003]},
+	{"customer_asid": 65005, "provider_set": [{"asid": 65003}]}
+]}`
+
+func loadSet(t *testing.T) *Set {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "export.json")
+	if err := os.WriteFile(path, []byte(testExport), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 3 {
+		t.Fatalf("loaded %d ASPAs, want 3", s.Len())
+	}
+	return s
+}
+
+func sequence(asns ...uint32) common.AsPathSegment {
+	return common.AsPathSegment{Type: common.SegmentSequence, ASNs: asns}
+}
+
+func TestVerifyUpstream(t *testing.T) {
+	s := loadSet(t)
+	for _, test := range []struct {
+		name        string
+		path        common.AsPath
+		neighbor    uint32
+		transparent bool
+		state       string
+		hop         *common.ASPAHop
+	}{
+		{
+			name:     "valid",
+			path:     common.AsPath{sequence(65001, 65003, 65004)},
+			neighbor: 65001,
+			state:    common.ASPAValid,
+		},
+		{
+			name:     "provider_set",
+			path:     common.AsPath{sequence(65003, 65005)},
+			neighbor: 65003,
+			state:    common.ASPAValid,
+		},
+		{
+			name:     "origin only",
+			path:     common.AsPath{sequence(65004)},
+			neighbor: 65004,
+			state:    common.ASPAValid,
+		},
+		{
+			name:     "not a provider",
+			path:     common.AsPath{sequence(65002, 65004)},
+			neighbor: 65002,
+			state:    common.ASPAInvalid,
+			hop:      &common.ASPAHop{Customer: 65004, Provider: 65002},
+		},
+		{
+			name:     "invalid hop wins over an unknown one",
+			path:     common.AsPath{sequence(65002, 65004, 64999)},
+			neighbor: 65002,
+			state:    common.ASPAInvalid,
+			hop:      &common.ASPAHop{Customer: 65004, Provider: 65002},
+		},
+		{
+			name:     "unknown",
+			path:     common.AsPath{sequence(64999, 65001, 65003)},
+			neighbor: 64999,
+			state:    common.ASPAUnknown,
+			hop:      &common.ASPAHop{Customer: 65001, Provider: 64999},
+		},
+		{
+			name:     "unknown hop closest to the origin",
+			path:     common.AsPath{sequence(64998, 64999, 65000)},
+			neighbor: 64998,
+			state:    common.ASPAUnknown,
+			hop:      &common.ASPAHop{Customer: 65000, Provider: 64999},
+		},
+		{
+			name:     "AS_SET",
+			path:     common.AsPath{sequence(65003), {Type: common.SegmentSet, ASNs: []uint32{65004, 65005}}},
+			neighbor: 65003,
+			state:    common.ASPAInvalid,
+		},
+		{
+			name:     "prepends",
+			path:     common.AsPath{sequence(65001, 65001, 65003, 65003, 65003), sequence(65004, 65004)},
+			neighbor: 65001,
+			state:    common.ASPAValid,
+		},
+		{
+			name:     "confederation segments are skipped",
+			path:     common.AsPath{{Type: common.SegmentConfedSequence, ASNs: []uint32{64512}}, sequence(65003, 65004)},
+			neighbor: 65003,
+			state:    common.ASPAValid,
+		},
+		{
+			name:     "neighbor not first",
+			path:     common.AsPath{sequence(65003, 65004)},
+			neighbor: 65001,
+			state:    common.ASPAInvalid,
+		},
+		{
+			name:     "empty path",
+			path:     common.AsPath{},
+			neighbor: 65001,
+			state:    common.ASPAInvalid,
+		},
+		{
+			name:        "transparent route server",
+			path:        common.AsPath{sequence(65003, 65004)},
+			neighbor:    65010,
+			transparent: true,
+			state:       common.ASPAValid,
+		},
+		{
+			name:        "transparent route server with an invalid path",
+			path:        common.AsPath{sequence(65002, 65004)},
+			neighbor:    65010,
+			transparent: true,
+			state:       common.ASPAInvalid,
+			hop:         &common.ASPAHop{Customer: 65004, Provider: 65002},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			result := s.VerifyUpstream(test.path, test.neighbor, test.transparent)
+			if result.State != test.state {
+				t.Errorf("got %s (%s), want %s", result.State, result.Reason, test.state)
+			}
+			if !reflect.DeepEqual(result.Hop, test.hop) {
+				t.Errorf("got hop %+v, want %+v", result.Hop, test.hop)
+			}
+		})
+	}
+}
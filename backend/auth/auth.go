@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+)
+
+// NewToken returns a random token for a client to prove it owns a session
+func NewToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Equal compares two secrets in constant time
+func Equal(a string, b string) bool {
+	return a != "" && subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// RemoteRule lets clients connecting from the From ranges claim peer IPs in
+// the Peers ranges
+type RemoteRule struct {
+	From  []string `json:"from"`
+	Peers []string `json:"peers"`
+
+	from  []*net.IPNet
+	peers []*net.IPNet
+}
+
+// Policy decides which peer IPs a client may create sessions for. Without a
+// policy anyone can claim any peer IP.
+type Policy struct {
+	AllowSameAddress bool                `json:"allowSameAddress"` // Clients may claim the address they connect from
+	Remotes          []RemoteRule        `json:"remotes"`
+	APIKeys          map[string][]string `json:"apiKeys"` // Peer IP ranges each API key may claim and access over REST
+
+	apiKeys map[string][]*net.IPNet
+}
+
+func parseRanges(ranges []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, r := range ranges {
+		_, n, err := net.ParseCIDR(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range %q: %w", r, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func contains(ranges []*net.IPNet, ip net.IP) bool {
+	for _, r := range ranges {
+		if r.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Load reads a policy from a JSON file
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &Policy{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+
+	for i := range p.Remotes {
+		rule := &p.Remotes[i]
+		if rule.from, err = parseRanges(rule.From); err != nil {
+			return nil, err
+		}
+		if rule.peers, err = parseRanges(rule.Peers); err != nil {
+			return nil, err
+		}
+	}
+	p.apiKeys = make(map[string][]*net.IPNet)
+	for key, ranges := range p.APIKeys {
+		if key == "" {
+			return nil, fmt.Errorf("empty API key")
+		}
+		if p.apiKeys[key], err = parseRanges(ranges); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// KeyAllows reports whether the API key grants access to sessions with the
+// peer IP
+func (p *Policy) KeyAllows(apiKey string, peerIP net.IP) bool {
+	if p == nil || apiKey == "" || peerIP == nil {
+		return false
+	}
+	for key, ranges := range p.apiKeys {
+		if Equal(apiKey, key) && contains(ranges, peerIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowClaim reports whether a client connecting from remote, optionally
+// presenting an API key, may create a session for the peer IP
+func (p *Policy) AllowClaim(remote net.IP, apiKey string, peerIP net.IP) bool {
+	if p == nil {
+		return true
+	}
+	if peerIP == nil {
+		return false
+	}
+	if p.AllowSameAddress && remote.Equal(peerIP) {
+		return true
+	}
+	for _, rule := range p.Remotes {
+		if contains(rule.from, remote) && contains(rule.peers, peerIP) {
+			return true
+		}
+	}
+	return p.KeyAllows(apiKey, peerIP)
+}
@@ -0,0 +1,175 @@
+package bgp
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	fgbgp "github.com/bgptools/fgbgp/server"
+	"github.com/hamptonmoore/bgp.exposed/backend/common"
+)
+
+const (
+	defaultActivePort = 179
+	// defaultConnectRetry is the ConnectRetryTime suggested by RFC 4271
+	defaultConnectRetry = 120
+	// minConnectRetry keeps sessions from hammering their peer
+	minConnectRetry = 5
+	// openWait is how long to wait for the peer's OPEN once connected, the
+	// large hold time RFC 4271 suggests for OpenSent
+	openWait = 4 * time.Minute
+)
+
+// outboundConn is a connection the server made to the peer that hasn't
+// received its OPEN yet
+type outboundConn struct {
+	addr   string // Local address of the connection
+	opened chan struct{}
+}
+
+// effectiveActiveMode fills in the defaults of a session's active mode
+func effectiveActiveMode(requested *common.ActiveMode) *common.ActiveMode {
+	if requested == nil {
+		return nil
+	}
+	config := *requested
+	if config.Port == 0 {
+		config.Port = defaultActivePort
+	}
+	if config.ConnectRetry == 0 {
+		config.ConnectRetry = defaultConnectRetry
+	}
+	if config.ConnectRetry < minConnectRetry {
+		config.ConnectRetry = minConnectRetry
+	}
+	return &config
+}
+
+// connectLoop connects to the peer whenever the session is down, waiting the
+// ConnectRetry time between attempts, until the session is closed. Failed
+// attempts and sessions going down leave the FSM in Idle, which it leaves
+// again on an automatic start.
+func (p *Peer) connectLoop() {
+	retry := time.Duration(p.active.ConnectRetry) * time.Second
+	event := eventManualStart
+	for {
+		if !p.connected() && !p.rejectConnection() {
+			p.connect(retry, event)
+		}
+		event = eventAutomaticStart
+		select {
+		case <-time.After(retry):
+		case <-p.Context.Done():
+			return
+		}
+	}
+}
+
+// connected reports whether the peer's current neighbor has a connection up
+func (p *Peer) connected() bool {
+	n := p.neighbor()
+	return n != nil && n.Connected
+}
+
+// neighbor returns the fgbgp neighbor of the peer's current connection, nil
+// if it has none
+func (p *Peer) neighbor() *fgbgp.Neighbor {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	return p.Neighbor
+}
+
+// setNeighbor records the fgbgp neighbor of the peer's current connection
+func (p *Peer) setNeighbor(n *fgbgp.Neighbor) {
+	p.stateLock.Lock()
+	p.Neighbor = n
+	p.stateLock.Unlock()
+}
+
+// connect dials the peer and sends our OPEN, then hands the connection to
+// fgbgp as if the peer had connected to us. It returns once the peer's OPEN
+// arrives or the attempt failed.
+func (p *Peer) connect(timeout time.Duration, event string) {
+	addr := net.JoinHostPort(p.PeerIP, strconv.Itoa(int(p.active.Port)))
+	log.Debugf("[connect %s] Connecting to %s", p.ToKey(), addr)
+	p.SetState(common.FSMUpdate{
+		State: "Connect",
+		Event: event,
+	})
+	p.Log("Connecting to " + addr)
+
+	server := p.Server.Fgbgp.Servers[0]
+	dialer := net.Dialer{Timeout: timeout}
+	if !server.Addr.IsUnspecified() {
+		dialer.LocalAddr = &net.TCPAddr{IP: server.Addr}
+	}
+	conn, err := dialer.DialContext(p.Context, "tcp", addr)
+	if err != nil {
+		// Without a DelayOpen timer running, RFC 4271 section 8.2.2 moves
+		// Connect to Idle when the connection fails
+		p.connectFailed("Idle", eventTcpConnectionFails, err.Error())
+		return
+	}
+	tcpconn := conn.(*net.TCPConn)
+
+	// fgbgp waits for the peer's OPEN on connections it accepts, but the side
+	// that connects shouldn't
+	m := p.Server.Fgbgp
+	open := messageBytes(sentOpen(fgbgp.NewNeighbor(net.ParseIP(p.PeerIP), int(p.active.Port), m.Identifier, p.LocalASN, m.AddPath, m.HoldTime, m.RouteRefresh), p.role))
+	if _, err := tcpconn.Write(open); err != nil {
+		tcpconn.Close()
+		p.connectFailed("Idle", eventTcpConnectionFails, err.Error())
+		return
+	}
+
+	opened := make(chan struct{})
+	p.stateLock.Lock()
+	p.outbound = outboundConn{addr: tcpconn.LocalAddr().String(), opened: opened}
+	p.openSent = open
+	p.stateLock.Unlock()
+	p.logMessage("sent", open, false)
+	p.SetState(common.FSMUpdate{
+		State: "OpenSent",
+		Event: eventTcpCRAcked,
+	})
+	server.ProcessIncomingRequest(tcpconn)
+
+	select {
+	case <-opened:
+	case <-time.After(openWait):
+		p.stateLock.Lock()
+		p.outbound = outboundConn{}
+		p.stateLock.Unlock()
+		tcpconn.Close()
+		p.connectFailed("Idle", eventHoldTimerExpires, "no OPEN received")
+	case <-p.Context.Done():
+	}
+}
+
+func (p *Peer) connectFailed(state string, event string, reason string) {
+	log.Debugf("[connect %s] Connection failed: %s", p.ToKey(), reason)
+	p.Log("Connection failed: " + reason)
+	p.SetState(common.FSMUpdate{
+		State: state,
+		Event: event,
+	})
+}
+
+// takeOutbound reports whether the neighbor is on the connection the server
+// made to the peer, stopping connect from waiting for its OPEN
+func (p *Peer) takeOutbound(n *fgbgp.Neighbor) bool {
+	ip, port := n.GetLocalAddress()
+	if ip == nil {
+		return false
+	}
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	if p.outbound.opened == nil || p.outbound.addr != addr {
+		return false
+	}
+	close(p.outbound.opened)
+	p.outbound = outboundConn{}
+	return true
+}
@@ -0,0 +1,199 @@
+package bgp
+
+import (
+	"github.com/bgptools/fgbgp/messages"
+	"github.com/hamptonmoore/bgp.exposed/backend/common"
+)
+
+// Four-octet AS numbers towards peers without the capability, RFC 6793
+const (
+	asTrans           = 23456 // Stands in for ASNs that don't fit in two octets
+	attrAS4Path       = 17
+	attrAS4Aggregator = 18
+	capAS4            = 65
+)
+
+// OPEN Message Error subcode from RFC 5492
+const openUnsupportedCapability = 7
+
+// openASN returns the ASN a peer sent in its OPEN, taken from the four-octet
+// AS capability when it advertised one
+func openASN(open *messages.BGPMessageOpen) (asn uint32, fourOctet bool) {
+	for _, param := range open.Parameters {
+		capabilities, ok := param.Data.(messages.BGPCapabilities)
+		if !ok {
+			continue
+		}
+		for _, capability := range capabilities.BGPCapabilities {
+			if c, ok := capability.(messages.BGPCapability_ASN); ok {
+				return c.ASN, true
+			}
+		}
+	}
+	return uint32(open.ASN), false
+}
+
+// fourOctetCapability encodes the four-octet AS capability, as the data of an
+// Unsupported Capability NOTIFICATION
+func fourOctetCapability(asn uint32) []byte {
+	return []byte{capAS4, 4, byte(asn >> 24), byte(asn >> 16), byte(asn >> 8), byte(asn)}
+}
+
+// setTwoOctetAS records whether the peer's last OPEN lacked the four-octet AS
+// capability
+func (p *Peer) setTwoOctetAS(twoOctet bool) {
+	p.stateLock.Lock()
+	p.twoOctetAS = twoOctet
+	p.stateLock.Unlock()
+}
+
+// twoOctet reports whether the peer only understands two-octet ASNs
+func (p *Peer) twoOctet() bool {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	return p.twoOctetAS
+}
+
+// encodeAsPath encodes the segments of an AS_PATH or AS4_PATH, splitting
+// sequences longer than a segment can hold. The two-octet encoding replaces
+// ASNs that don't fit with AS_TRANS.
+func encodeAsPath(path common.AsPath, twoOctet bool) []byte {
+	data := []byte{}
+	for _, segment := range path {
+		code, _ := common.SegmentTypeCode(segment.Type)
+		for start := 0; start < len(segment.ASNs); start += common.MaxSegmentLength {
+			end := start + common.MaxSegmentLength
+			if end > len(segment.ASNs) {
+				end = len(segment.ASNs)
+			}
+			data = append(data, code, byte(end-start))
+			for _, asn := range segment.ASNs[start:end] {
+				if !twoOctet {
+					data = append(data, byte(asn>>24), byte(asn>>16), byte(asn>>8), byte(asn))
+					continue
+				}
+				asn = twoOctetASN(asn)
+				data = append(data, byte(asn>>8), byte(asn))
+			}
+		}
+	}
+	return data
+}
+
+// decodeAsPath decodes the segments of an AS_PATH or AS4_PATH, stopping at
+// anything truncated
+func decodeAsPath(data []byte, asLen int) common.AsPath {
+	path := common.AsPath{}
+	for len(data) >= 2 {
+		segment := common.AsPathSegment{Type: common.SegmentTypeName(data[0])}
+		n := int(data[1])
+		data = data[2:]
+		if len(data) < n*asLen {
+			break
+		}
+		for i := 0; i < n; i++ {
+			var asn uint32
+			for _, b := range data[:asLen] {
+				asn = asn<<8 | uint32(b)
+			}
+			segment.ASNs = append(segment.ASNs, asn)
+			data = data[asLen:]
+		}
+		path = append(path, segment)
+	}
+	return path
+}
+
+// as4PathFor returns the AS4_PATH to send with a path to a two-octet peer, or
+// nil if every ASN fits in two octets. Confederation segments are left out as
+// RFC 6793 section 3 requires.
+func as4PathFor(path common.AsPath) common.AsPath {
+	as4Path := common.AsPath{}
+	needed := false
+	for _, segment := range path {
+		if segment.Type != common.SegmentSequence && segment.Type != common.SegmentSet {
+			continue
+		}
+		as4Path = append(as4Path, segment)
+		for _, asn := range segment.ASNs {
+			needed = needed || asn > 0xffff
+		}
+	}
+	if !needed {
+		return nil
+	}
+	return as4Path
+}
+
+// twoOctetASN returns an ASN as a two-octet speaker sees it, AS_TRANS when it
+// doesn't fit
+func twoOctetASN(asn uint32) uint32 {
+	if asn > 0xffff {
+		return asTrans
+	}
+	return asn
+}
+
+// as4Attributes returns the AS4_PATH and AS4_AGGREGATOR a two-octet peer
+// needs next to a route's AS_PATH and AGGREGATOR, for the ASNs that were
+// replaced with AS_TRANS (RFC 6793 section 4.2.2)
+func as4Attributes(route *common.RouteData) []messages.BGPAttributeIf {
+	attrs := []messages.BGPAttributeIf{}
+	if as4Path := as4PathFor(route.AsPath); as4Path != nil {
+		attrs = append(attrs, pathAttribute{flags: messages.ATTRIBUTE_TRANSITIVEOPT, code: attrAS4Path, value: encodeAsPath(as4Path, false)})
+	}
+	if route.Aggregator != nil && route.Aggregator.ASN > 0xffff {
+		attrs = append(attrs, pathAttribute{flags: messages.ATTRIBUTE_TRANSITIVEOPT, code: attrAS4Aggregator, value: encodeAggregator(route.Aggregator, false)})
+	}
+	return attrs
+}
+
+// mergeAS4Path rebuilds the path a two-octet peer learned from four-octet
+// speakers as described in RFC 6793 section 4.2.3: the leading ASNs of the
+// AS_PATH that the AS4_PATH doesn't cover, followed by the AS4_PATH. It
+// reports false when the AS4_PATH is longer than the AS_PATH and must be
+// ignored.
+func mergeAS4Path(asPath, as4Path common.AsPath) (common.AsPath, bool) {
+	filtered := common.AsPath{}
+	for _, segment := range as4Path {
+		if segment.Type == common.SegmentSequence || segment.Type == common.SegmentSet {
+			filtered = append(filtered, segment)
+		}
+	}
+	lead := asPath.Length() - filtered.Length()
+	if lead < 0 {
+		return asPath, false
+	}
+
+	merged := common.AsPath{}
+	for _, segment := range asPath {
+		if lead == 0 {
+			break
+		}
+		switch segment.Type {
+		case common.SegmentSequence:
+			take := len(segment.ASNs)
+			if take > lead {
+				take = lead
+			}
+			merged = append(merged, common.AsPathSegment{Type: segment.Type, ASNs: segment.ASNs[:take]})
+			lead -= take
+		case common.SegmentSet:
+			merged = append(merged, segment)
+			lead--
+		default:
+			merged = append(merged, segment)
+		}
+	}
+	for _, segment := range filtered {
+		// Join the two halves of a sequence split where AS4_PATH starts
+		last := len(merged) - 1
+		if last >= 0 && segment.Type == common.SegmentSequence && merged[last].Type == common.SegmentSequence {
+			asns := append(append([]uint32{}, merged[last].ASNs...), segment.ASNs...)
+			merged[last] = common.AsPathSegment{Type: common.SegmentSequence, ASNs: asns}
+			continue
+		}
+		merged = append(merged, segment)
+	}
+	return merged, true
+}
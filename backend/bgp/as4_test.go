@@ -0,0 +1,191 @@
+package bgp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/hamptonmoore/bgp.exposed/backend/common"
+)
+
+func sequence(asns ...uint32) common.AsPathSegment {
+	return common.AsPathSegment{Type: common.SegmentSequence, ASNs: asns}
+}
+
+func set(asns ...uint32) common.AsPathSegment {
+	return common.AsPathSegment{Type: common.SegmentSet, ASNs: asns}
+}
+
+func TestMergeAS4Path(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		asPath  common.AsPath
+		as4Path common.AsPath
+		want    common.AsPath
+		ok      bool
+	}{
+		{
+			name:    "AS_TRANS replaced",
+			asPath:  common.AsPath{sequence(65000, asTrans, asTrans)},
+			as4Path: common.AsPath{sequence(4200000001, 4200000002)},
+			want:    common.AsPath{sequence(65000, 4200000001, 4200000002)},
+			ok:      true,
+		},
+		{
+			name:    "same length",
+			asPath:  common.AsPath{sequence(asTrans, 65001)},
+			as4Path: common.AsPath{sequence(4200000001, 65001)},
+			want:    common.AsPath{sequence(4200000001, 65001)},
+			ok:      true,
+		},
+		{
+			name:    "AS4_PATH longer than AS_PATH",
+			asPath:  common.AsPath{sequence(65000, asTrans)},
+			as4Path: common.AsPath{sequence(65000, 4200000001, 65002)},
+			want:    common.AsPath{sequence(65000, asTrans)},
+		},
+		{
+			name:    "AS_SET counts as one",
+			asPath:  common.AsPath{sequence(65000, 65001), set(asTrans, 65003)},
+			as4Path: common.AsPath{set(4200000001, 65003)},
+			want:    common.AsPath{sequence(65000, 65001), set(4200000001, 65003)},
+			ok:      true,
+		},
+		{
+			name:    "AS_SET in the leading part",
+			asPath:  common.AsPath{set(65000, 65001), sequence(asTrans)},
+			as4Path: common.AsPath{sequence(4200000001)},
+			want:    common.AsPath{set(65000, 65001), sequence(4200000001)},
+			ok:      true,
+		},
+		{
+			name:    "AS_SET makes AS4_PATH longer",
+			asPath:  common.AsPath{set(65000, asTrans)},
+			as4Path: common.AsPath{sequence(65000, 4200000001)},
+			want:    common.AsPath{set(65000, asTrans)},
+		},
+		{
+			name: "confederation segments kept from AS_PATH",
+			asPath: common.AsPath{
+				{Type: common.SegmentConfedSequence, ASNs: []uint32{64512, 64513}},
+				sequence(65000, asTrans),
+			},
+			as4Path: common.AsPath{sequence(4200000001)},
+			want: common.AsPath{
+				{Type: common.SegmentConfedSequence, ASNs: []uint32{64512, 64513}},
+				sequence(65000, 4200000001),
+			},
+			ok: true,
+		},
+		{
+			name:   "confederation segments dropped from AS4_PATH",
+			asPath: common.AsPath{sequence(65000, asTrans)},
+			as4Path: common.AsPath{
+				{Type: common.SegmentConfedSet, ASNs: []uint32{64512}},
+				sequence(4200000001),
+			},
+			want: common.AsPath{sequence(65000, 4200000001)},
+			ok:   true,
+		},
+		{
+			name:    "empty AS4_PATH",
+			asPath:  common.AsPath{sequence(65000, 65001)},
+			as4Path: common.AsPath{},
+			want:    common.AsPath{sequence(65000, 65001)},
+			ok:      true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := mergeAS4Path(test.asPath, test.as4Path)
+			if ok != test.ok {
+				t.Errorf("got ok %t, want %t", ok, test.ok)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEncodeAsPath(t *testing.T) {
+	long := make([]uint32, common.MaxSegmentLength+1)
+	for i := range long {
+		long[i] = uint32(65000 + i%2)
+	}
+	for _, test := range []struct {
+		name     string
+		path     common.AsPath
+		twoOctet bool
+		want     common.AsPath // Decoded path, when different
+	}{
+		{name: "four-octet", path: common.AsPath{sequence(65000, 4200000001)}},
+		{name: "all segment types", path: common.AsPath{
+			{Type: common.SegmentConfedSequence, ASNs: []uint32{64512}},
+			{Type: common.SegmentConfedSet, ASNs: []uint32{64513, 64514}},
+			sequence(65000),
+			set(65001, 65002),
+		}},
+		{name: "two-octet", path: common.AsPath{sequence(65000, 65001), set(65002)}, twoOctet: true},
+		{
+			name:     "AS_TRANS",
+			path:     common.AsPath{sequence(65000, 4200000001), set(4200000002, 65003)},
+			twoOctet: true,
+			want:     common.AsPath{sequence(65000, asTrans), set(asTrans, 65003)},
+		},
+		{
+			name: "long sequence split",
+			path: common.AsPath{sequence(long...)},
+			want: common.AsPath{sequence(long[:common.MaxSegmentLength]...), sequence(long[common.MaxSegmentLength:]...)},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			asLen := 4
+			if test.twoOctet {
+				asLen = 2
+			}
+			want := test.want
+			if want == nil {
+				want = test.path
+			}
+			got := decodeAsPath(encodeAsPath(test.path, test.twoOctet), asLen)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestEncodeAsPathWire(t *testing.T) {
+	path := common.AsPath{sequence(65000, 4200000001)}
+	for _, test := range []struct {
+		twoOctet bool
+		want     []byte
+	}{
+		{false, []byte{2, 2, 0, 0, 0xfd, 0xe8, 0xfa, 0x56, 0xea, 0x01}},
+		{true, []byte{2, 2, 0xfd, 0xe8, 0x5b, 0xa0}},
+	} {
+		if got := encodeAsPath(path, test.twoOctet); !bytes.Equal(got, test.want) {
+			t.Errorf("two-octet %t: got %x, want %x", test.twoOctet, got, test.want)
+		}
+	}
+}
+
+func TestDecodeAsPathTruncated(t *testing.T) {
+	// The second segment claims two ASNs but only has one
+	data := []byte{2, 1, 0, 0, 0xfd, 0xe8, 1, 2, 0, 0, 0xfd, 0xe9}
+	want := common.AsPath{sequence(65000)}
+	if got := decodeAsPath(data, 4); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestAS4PathFor(t *testing.T) {
+	confed := common.AsPathSegment{Type: common.SegmentConfedSequence, ASNs: []uint32{4200000009}}
+	if got := as4PathFor(common.AsPath{confed, sequence(65000, 65001)}); got != nil {
+		t.Errorf("got %s for two-octet ASNs, want none", got)
+	}
+	want := common.AsPath{sequence(65000, 4200000001)}
+	if got := as4PathFor(common.AsPath{confed, sequence(65000, 4200000001)}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,95 @@
+package bgp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// asnRange is an inclusive range of ASNs
+type asnRange struct {
+	first uint32
+	last  uint32
+}
+
+// Private use ASNs from RFC 6996
+var privateASNs = []asnRange{
+	{64512, 65534},
+	{4200000000, 4294967294},
+}
+
+// ASNPolicy limits which local ASNs sessions may use. The zero value allows
+// any ASN.
+type ASNPolicy struct {
+	any    bool
+	ranges []asnRange
+	desc   string
+}
+
+// ParseASNPolicy parses a comma separated list where each entry is "any",
+// "private" for the RFC 6996 ranges, an ASN or a range like 65000-65010
+func ParseASNPolicy(s string) (ASNPolicy, error) {
+	policy := ASNPolicy{desc: s}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch entry {
+		case "":
+			continue
+		case "any":
+			policy.any = true
+			continue
+		case "private":
+			policy.ranges = append(policy.ranges, privateASNs...)
+			continue
+		}
+
+		first, last, isRange := strings.Cut(entry, "-")
+		if !isRange {
+			last = first
+		}
+		r := asnRange{}
+		for _, bound := range []struct {
+			s string
+			n *uint32
+		}{{first, &r.first}, {last, &r.last}} {
+			n, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(bound.s), "as"), 10, 32)
+			if err != nil {
+				return ASNPolicy{}, fmt.Errorf("invalid ASN %q", bound.s)
+			}
+			*bound.n = uint32(n)
+		}
+		if r.first > r.last {
+			return ASNPolicy{}, fmt.Errorf("invalid ASN range %q", entry)
+		}
+		policy.ranges = append(policy.ranges, r)
+	}
+	if len(policy.ranges) == 0 {
+		policy.any = true
+	}
+	return policy, nil
+}
+
+// Allows reports whether a session may use the local ASN. ASN 0 and AS_TRANS
+// are never allowed as a peer can't tell them apart from a missing or
+// four-octet ASN.
+func (p ASNPolicy) Allows(asn uint32) bool {
+	if asn == 0 || asn == asTrans {
+		return false
+	}
+	if p.any || len(p.ranges) == 0 {
+		return true
+	}
+	for _, r := range p.ranges {
+		if asn >= r.first && asn <= r.last {
+			return true
+		}
+	}
+	return false
+}
+
+func (p ASNPolicy) String() string {
+	if p.desc == "" {
+		return "any"
+	}
+	return p.desc
+}
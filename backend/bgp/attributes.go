@@ -0,0 +1,133 @@
+package bgp
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/bgptools/fgbgp/messages"
+	"github.com/hamptonmoore/bgp.exposed/backend/common"
+)
+
+// Attribute flag for a two-octet length, fgbgp's ATTRIBUTE_EXTENDED also sets
+// two of the unused bits
+const attrFlagExtendedLength = 0x10
+
+// pathAttribute is a path attribute written with exactly the given flags,
+// using a two-octet length when the flags ask for it or the value needs it
+type pathAttribute struct {
+	flags byte
+	code  byte
+	value []byte
+}
+
+func (a pathAttribute) extended() bool {
+	return a.flags&attrFlagExtendedLength != 0 || len(a.value) > 0xff
+}
+
+func (a pathAttribute) Len() int {
+	if a.extended() {
+		return 4 + len(a.value)
+	}
+	return 3 + len(a.value)
+}
+
+func (a pathAttribute) Write(w io.Writer) {
+	header := []byte{a.flags, a.code, byte(len(a.value))}
+	if a.extended() {
+		header = []byte{a.flags | attrFlagExtendedLength, a.code, byte(len(a.value) >> 8), byte(len(a.value))}
+	}
+	w.Write(header)
+	w.Write(a.value)
+}
+
+func (a pathAttribute) String() string {
+	return fmt.Sprintf("Attribute %d (flags 0x%02x): %x", a.code, a.flags, a.value)
+}
+
+// rawAttributes encodes the attributes a client gave as flags, type code and
+// hex value
+func rawAttributes(raw []common.RawAttribute) []messages.BGPAttributeIf {
+	attrs := []messages.BGPAttributeIf{}
+	for _, r := range raw {
+		value, _ := hex.DecodeString(r.Value)
+		attrs = append(attrs, pathAttribute{flags: r.Flags, code: r.TypeCode, value: value})
+	}
+	return attrs
+}
+
+// extendedCommunityAttributes encodes extended communities into the RFC 4360
+// attribute and the RFC 5701 attribute for IPv6 address specific ones
+func extendedCommunityAttributes(communities []string) ([]messages.BGPAttributeIf, error) {
+	var extended, ipv6 []byte
+	for _, c := range communities {
+		b, err := common.ParseExtendedCommunity(c)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) == 20 {
+			ipv6 = append(ipv6, b...)
+		} else {
+			extended = append(extended, b...)
+		}
+	}
+	attrs := []messages.BGPAttributeIf{}
+	if len(extended) > 0 {
+		attrs = append(attrs, pathAttribute{flags: messages.ATTRIBUTE_TRANSITIVEOPT, code: common.AttrExtendedCommunities, value: extended})
+	}
+	if len(ipv6) > 0 {
+		attrs = append(attrs, pathAttribute{flags: messages.ATTRIBUTE_TRANSITIVEOPT, code: common.AttrIPv6ExtendedCommunities, value: ipv6})
+	}
+	return attrs, nil
+}
+
+// routeAttributes encodes MULTI_EXIT_DISC, LOCAL_PREF, ATOMIC_AGGREGATE,
+// AGGREGATOR and ONLY_TO_CUSTOMER. fgbgp marks LOCAL_PREF, ATOMIC_AGGREGATE
+// and AGGREGATOR optional non-transitive, so they are written as
+// pathAttributes with the flags from RFC 4271.
+func routeAttributes(route *common.RouteData, twoOctet bool) []messages.BGPAttributeIf {
+	attrs := []messages.BGPAttributeIf{}
+	if route.Med != nil {
+		attrs = append(attrs, messages.BGPAttribute_MED{Med: *route.Med})
+	}
+	if route.LocalPref != nil {
+		pref := *route.LocalPref
+		attrs = append(attrs, pathAttribute{
+			flags: messages.ATTRIBUTE_TRANSITIVE,
+			code:  messages.ATTRIBUTE_LOCPREF,
+			value: []byte{byte(pref >> 24), byte(pref >> 16), byte(pref >> 8), byte(pref)},
+		})
+	}
+	if route.AtomicAggregate {
+		attrs = append(attrs, pathAttribute{flags: messages.ATTRIBUTE_TRANSITIVE, code: messages.ATTRIBUTE_ATOMIC_AGGREGATE, value: []byte{}})
+	}
+	if route.Aggregator != nil {
+		attrs = append(attrs, pathAttribute{flags: messages.ATTRIBUTE_TRANSITIVEOPT, code: messages.ATTRIBUTE_AGGREGATOR, value: encodeAggregator(route.Aggregator, twoOctet)})
+	}
+	if route.OTC != nil {
+		otc := *route.OTC
+		attrs = append(attrs, pathAttribute{flags: messages.ATTRIBUTE_TRANSITIVEOPT, code: attrOTC, value: []byte{byte(otc >> 24), byte(otc >> 16), byte(otc >> 8), byte(otc)}})
+	}
+	return attrs
+}
+
+// asPathAttribute encodes an AS_PATH, with AS_TRANS in place of ASNs that
+// don't fit when the peer only understands two-octet ASNs. fgbgp's own
+// encoding writes a zero length for segments of exactly 255 ASNs, so it isn't
+// used here.
+func asPathAttribute(path common.AsPath, twoOctet bool) pathAttribute {
+	return pathAttribute{flags: messages.ATTRIBUTE_TRANSITIVE, code: messages.ATTRIBUTE_ASPATH, value: encodeAsPath(path, twoOctet)}
+}
+
+// encodeAggregator encodes the value of an AGGREGATOR or AS4_AGGREGATOR, the
+// two-octet encoding using AS_TRANS for ASNs that don't fit
+func encodeAggregator(aggregator *common.Aggregator, twoOctet bool) []byte {
+	asn := aggregator.ASN
+	address := net.ParseIP(aggregator.Address).To4()
+	if twoOctet {
+		asn = twoOctetASN(asn)
+		return append([]byte{byte(asn >> 8), byte(asn)}, address...)
+	}
+	return append([]byte{byte(asn >> 24), byte(asn >> 16), byte(asn >> 8), byte(asn)}, address...)
+}
@@ -1,16 +1,26 @@
 package bgp
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
 	"net"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/bgptools/fgbgp/messages"
 	fgbgp "github.com/bgptools/fgbgp/server"
+	"github.com/hamptonmoore/bgp.exposed/backend/aspa"
+	"github.com/hamptonmoore/bgp.exposed/backend/auth"
+	"github.com/hamptonmoore/bgp.exposed/backend/bmp"
 	"github.com/hamptonmoore/bgp.exposed/backend/common"
+	"github.com/hamptonmoore/bgp.exposed/backend/metrics"
 	"github.com/sirupsen/logrus"
 )
 
@@ -18,6 +28,9 @@ var log *logrus.Logger
 
 type Peer struct {
 	Key              string
+	Token            string `json:"-"` // Proves ownership of the session
+	ShareToken       string `json:"-"` // Allows watching the session without changing it
+	Owner            string `json:"-"` // Address of the client that created the session
 	PeerASN          uint32 `json:"peerASN"`
 	PeerIP           string `json:"peerIP"`
 	LocalASN         uint32 `json:"localASN"`
@@ -28,22 +41,127 @@ type Peer struct {
 	RoutesToAnnounce chan *common.RouteData
 	Context          context.Context
 	Cancel           context.CancelFunc
+
+	Received  *RIB // Routes the peer announced to us
+	Announced *RIB // Routes we announced to the peer
+
+	stateLock     sync.Mutex
+	FSM           common.FSMUpdate
+	EstablishedAt time.Time
+	events        eventLog
+	maxPrefix     maxPrefixState
+	downEvent     string             // Why the session is going down, see setDownEvent
+	downNeighbor  *fgbgp.Neighbor    // Last neighbor that went down, fgbgp may report it twice
+	active        *common.ActiveMode // Connect out to the peer if set
+	outbound      outboundConn
+	inspect       bool   // Send clients every BGP message, see SetInspect
+	robustness    bool   // Robustness tests are running
+	twoOctetAS    bool   // The peer's OPEN lacked the four-octet AS capability
+	role          string // Our BGP Role, empty to advertise none
+	roleStrict    bool   // Refuse peers without a BGP Role
+	peerRole      string // The peer's BGP Role once it matched ours
+	openSent      []byte // The OPEN we sent on the current connection, for BMP
+	replay        Replay // Last capture replayed into the session
+
+	subLock      sync.Mutex
+	controller   *Subscriber
+	subscribers  map[*Subscriber]struct{}
+	graceTimer   *time.Timer
+	dispatchOnce sync.Once
 }
 
-func (p *Peer) Log(msg string) {
+// SetState moves the peer to a new FSM state, tracking it in the metrics and
+// sending the FSMUpdate to the client. Staying in the same state isn't a
+// transition and is ignored.
+func (p *Peer) SetState(update common.FSMUpdate) {
+	p.stateLock.Lock()
+	if update.State == p.FSM.State {
+		p.stateLock.Unlock()
+		return
+	}
+	update.Previous = p.FSM.State
+	update.Since = uint64(time.Now().UTC().UnixNano())
+	if p.FSM.State != "" {
+		metrics.Sessions.WithLabelValues(p.FSM.State).Dec()
+	}
+	if p.FSM.State == "Established" && update.State != "Established" {
+		metrics.SessionDuration.Observe(time.Since(p.EstablishedAt).Seconds())
+	}
+	if update.State == "Established" && p.FSM.State != "Established" {
+		p.EstablishedAt = time.Now()
+	}
+	p.FSM = update
+	metrics.Sessions.WithLabelValues(p.FSM.State).Inc()
+	p.stateLock.Unlock()
+
 	p.SendChan <- &common.Packet{
 		Type: "FSMUpdate",
-		Data: common.Event{
-			Time:    uint64(time.Now().UTC().UnixNano()),
-			Message: msg,
-		},
+		Data: update,
 	}
+	p.logState(update)
+}
+
+// Session summarizes the peer for the REST API
+func (p *Peer) Session() common.Session {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+
+	session := common.Session{
+		PeerIP:            p.PeerIP,
+		PeerASN:           p.PeerASN,
+		LocalASN:          p.LocalASN,
+		State:             p.FSM.State,
+		HoldTimer:         p.FSM.HoldTimer,
+		KeepaliveTimer:    p.FSM.KeepaliveTimer,
+		ReceivedPrefixes:  p.Received.Len(),
+		AnnouncedPrefixes: p.Announced.Len(),
+		Role:              p.role,
+		PeerRole:          p.peerRole,
+	}
+	if p.FSM.State == "Established" {
+		session.EstablishedAt = uint64(p.EstablishedAt.UTC().UnixNano())
+	}
+	return session
+}
+
+// CheckToken reports whether the token is the session's ownership token
+func (p *Peer) CheckToken(token string) bool {
+	return auth.Equal(token, p.Token)
+}
+
+// CheckShareToken reports whether the token is the session's read-only share
+// token
+func (p *Peer) CheckShareToken(token string) bool {
+	return auth.Equal(token, p.ShareToken)
 }
 
 func (p *Peer) ToKey() string {
 	return p.PeerIP + "|" + strconv.FormatUint(uint64(p.PeerASN), 10)
 }
 
+// stop tears down a session whose context was cancelled
+func (p *Peer) stop() {
+	log.Tracef("[stop %s] Websocket closed", p.ToKey())
+
+	p.SetState(common.FSMUpdate{
+		State: "Idle",
+		Event: eventManualStop,
+	})
+	if n := p.neighbor(); n != nil {
+		if p.Server.BMP != nil {
+			p.Server.BMP.SetDownReason(p.Key, bmp.ReasonLocalNoNotification, []byte{0, 0})
+		}
+		n.Disconnect()
+	}
+	p.Server.PeerLock.Lock()
+	delete(p.Server.Peers, p.Key)
+	p.Server.PeerLock.Unlock()
+	p.stateLock.Lock()
+	metrics.Sessions.WithLabelValues(p.FSM.State).Dec()
+	p.stateLock.Unlock()
+	log.Tracef("[stop %s] Peer deleted", p.ToKey())
+}
+
 func (p *Peer) Handler() {
 	// Wait for the peer to raise
 	log.Tracef("[Handler %s] Waiting for peer to come up", p.ToKey())
@@ -51,98 +169,280 @@ func (p *Peer) Handler() {
 
 	log.Tracef("[Handler %s] Peer came up", p.ToKey())
 
-	p.Log("recv-keepalive")
-	p.Log("sent-keepalive")
-main:
+	// A route taken from the queue just as the session went down, sent once
+	// it is back up
+	var pending *common.RouteData
 	for {
+		// Closing may also queue a KEEPALIVE to wake us, the select picks
+		// between ready cases at random so the context is checked first
+		if p.Context.Err() != nil {
+			p.stop()
+			return
+		}
+		// Routes stay queued until the session is up to send them, the peer's
+		// KEEPALIVE on reaching Established wakes the loop to pick them up
+		var routes chan *common.RouteData
+		if n := p.neighbor(); n != nil && p.State() == "Established" {
+			if pending != nil {
+				p.announce(n, pending)
+				pending = nil
+				continue
+			}
+			routes = p.RoutesToAnnounce
+		}
+
 		select {
 		case <-p.Context.Done():
-			log.Tracef("[Handler %s] Websocket closed", p.ToKey())
-
-			p.SendChan <- &common.Packet{
-				Type: "FSMUpdate",
-				Data: common.FSMUpdate{
-					State: "Idle",
-				},
-			}
-			if p.Neighbor != nil {
-				p.Neighbor.Disconnect()
-			}
-			p.Server.PeerLock.Lock()
-			delete(p.Server.Peers, p.Key)
-			p.Server.PeerLock.Unlock()
-			log.Tracef("[Handler %s] Peer deleted", p.ToKey())
-			break main
+			p.stop()
+			return
 		case <-time.After(time.Second * 30):
 			p.KeepAlive <- &messages.BGPMessageKeepAlive{}
 		case <-p.KeepAlive:
 			log.Tracef("[Handler %s] Sending KEEPALIVE", p.ToKey())
-			if p.Neighbor != nil {
-				p.Neighbor.OutQueue <- messages.BGPMessageKeepAlive{}
-				p.Log("sent-keepalive")
+			if n := p.neighbor(); n != nil {
+				n.OutQueue <- messages.BGPMessageKeepAlive{}
+				p.logMessage("sent", messageBytes(messages.BGPMessageKeepAlive{}), false)
 			}
-		case route := <-p.RoutesToAnnounce:
-			announcement := &messages.BGPMessageUpdate{}
-			if len(route.Withdraws) > 0 {
-				log.Tracef("[Handler %s] Withdrawing routes: %+v", p.ToKey(), route.Withdraws)
-				for _, prefix := range route.Withdraws {
-					_, pref, _ := net.ParseCIDR(prefix.Prefix)
-
-					announcement.WithdrawnRoutes = append(announcement.WithdrawnRoutes, messages.NLRI_IPPrefix{
-						Prefix: *pref,
-						PathId: prefix.ID,
-					})
-				}
+		case route := <-routes:
+			if n := p.neighbor(); n != nil && p.State() == "Established" {
+				p.announce(n, route)
+			} else {
+				pending = route
 			}
-			if len(route.Prefixes) > 0 {
-				log.Tracef("[Handler %s] Announcing routes: %+v", p.ToKey(), route.Prefixes)
-				pa := []messages.BGPAttributeIf{
-					messages.BGPAttribute_ORIGIN{
-						Origin: byte(route.Origin),
-					},
-					messages.BGPAttribute_NEXTHOP{NextHop: net.ParseIP(route.NextHop)},
-					messages.BGPAttribute_ASPATH{Segments: []messages.ASPath_Segment{
-						{
-							SType:  2,
-							ASPath: route.AsPath,
-						},
-					}},
-				}
-				if len(route.Communities) > 0 {
-					communities := []uint32{}
-					for _, c := range route.Communities {
-						communities = append(communities, uint32(c[1])+(uint32(c[0])*65536))
-					}
-					pa = append(pa, messages.BGPAttribute_COMMUNITIES{
-						Communities: communities,
-					})
-				}
-				if len(route.LargeCommunities) > 0 {
-					pa = append(pa, messages.BGPAttribute_LARGECOMMUNITIES{
-						Communities: route.LargeCommunities,
-					})
-				}
+		}
+	}
+}
 
-				announcement.PathAttributes = pa
+// announce sends a RouteData to the peer
+func (p *Peer) announce(n *fgbgp.Neighbor, route *common.RouteData) {
+	if err := p.checkPrefixLimits(route); err != nil {
+		log.Debugf("[announce %s] Refusing routes: %s", p.ToKey(), err.Message)
+		p.SendError(*err)
+		return
+	}
+	announcement := &messages.BGPMessageUpdate{}
+	if len(route.Withdraws) > 0 {
+		log.Tracef("[announce %s] Withdrawing routes: %+v", p.ToKey(), route.Withdraws)
+		for _, prefix := range route.Withdraws {
+			_, pref, _ := net.ParseCIDR(prefix.Prefix)
 
-				for _, prefix := range route.Prefixes {
-					_, pref, _ := net.ParseCIDR(prefix.Prefix)
+			announcement.WithdrawnRoutes = append(announcement.WithdrawnRoutes, messages.NLRI_IPPrefix{
+				Prefix: *pref,
+				PathId: prefix.ID,
+			})
+		}
+	}
+	// Attributes of the announcement, shared with its FlowSpec rules
+	// which take everything but the NEXT_HOP
+	var pa []messages.BGPAttributeIf
+	if len(route.Prefixes) > 0 || len(route.FlowSpec) > 0 {
+		pa = []messages.BGPAttributeIf{
+			messages.BGPAttribute_ORIGIN{
+				Origin: byte(route.Origin),
+			},
+		}
+		pa = append(pa, asPathAttribute(route.AsPath, p.twoOctet()))
+		if route.LocalPref != nil && p.PeerASN != p.LocalASN {
+			log.Debugf("[announce %s] Refusing routes: LOCAL_PREF on an external session", p.ToKey())
+			p.SendError(common.Error{Message: "LOCAL_PREF can only be sent to internal peers, where the local and peer ASN are the same"})
+			return
+		}
+		pa = append(pa, routeAttributes(route, p.twoOctet())...)
+		if p.twoOctet() {
+			pa = append(pa, as4Attributes(route)...)
+		}
+		if len(route.Communities) > 0 {
+			communities := []uint32{}
+			for _, c := range route.Communities {
+				communities = append(communities, uint32(c[1])+(uint32(c[0])*65536))
+			}
+			pa = append(pa, messages.BGPAttribute_COMMUNITIES{
+				Communities: communities,
+			})
+		}
+		if len(route.LargeCommunities) > 0 {
+			pa = append(pa, messages.BGPAttribute_LARGECOMMUNITIES{
+				Communities: route.LargeCommunities,
+			})
+		}
+		extended, err := extendedCommunityAttributes(route.ExtendedCommunities)
+		if err != nil {
+			log.Debugf("[announce %s] Refusing routes: %s", p.ToKey(), err)
+			p.SendError(common.Error{Message: err.Error()})
+			return
+		}
+		pa = append(pa, extended...)
+		pa = append(pa, rawAttributes(route.RawAttributes)...)
+	}
+	flowSpec, err := flowSpecUpdates(route, pa)
+	if err != nil {
+		log.Debugf("[announce %s] Refusing routes: %s", p.ToKey(), err)
+		p.SendError(common.Error{Message: err.Error()})
+		return
+	}
+	if len(route.Prefixes) > 0 {
+		log.Tracef("[announce %s] Announcing routes: %+v", p.ToKey(), route.Prefixes)
+		next := messages.BGPAttribute_NEXTHOP{NextHop: net.ParseIP(route.NextHop)}
+		announcement.PathAttributes = append([]messages.BGPAttributeIf{pa[0], next}, pa[1:]...)
 
-					announcement.NLRI = append(announcement.NLRI, messages.NLRI_IPPrefix{
-						Prefix: *pref,
-						PathId: prefix.ID,
-					})
-				}
+		for _, prefix := range route.Prefixes {
+			_, pref, _ := net.ParseCIDR(prefix.Prefix)
+
+			announcement.NLRI = append(announcement.NLRI, messages.NLRI_IPPrefix{
+				Prefix: *pref,
+				PathId: prefix.ID,
+			})
+		}
+	}
+	updates, err := splitUpdate(announcement)
+	if err != nil {
+		log.Debugf("[announce %s] Refusing routes: %s", p.ToKey(), err)
+		p.SendError(common.Error{Message: err.Error()})
+		return
+	}
+	if len(route.Prefixes) == 0 && len(route.Withdraws) == 0 && len(flowSpec) > 0 {
+		// Without this the empty UPDATE would be an End-of-RIB marker
+		updates = nil
+	}
+	for _, update := range updates {
+		n.OutQueue <- update
+		p.logMessage("sent", messageBytes(update), false)
+		metrics.UpdatesSent.Inc()
+		metrics.PrefixesSent.WithLabelValues("announce").Add(float64(len(update.NLRI)))
+		metrics.PrefixesSent.WithLabelValues("withdraw").Add(float64(len(update.WithdrawnRoutes)))
+	}
+	if len(flowSpec) > 0 {
+		log.Tracef("[announce %s] Announcing FlowSpec rules %v, withdrawing %v", p.ToKey(), route.FlowSpec, route.FlowSpecWithdraws)
+	}
+	for _, update := range flowSpec {
+		n.OutQueue <- update
+		p.logMessage("sent", messageBytes(update), false)
+		metrics.UpdatesSent.Inc()
+	}
+	p.Announced.Update(route)
+}
+
+// checkPrefixLimits makes sure announcing a route won't take the session or
+// its owner over the server's prefix limits
+func (p *Peer) checkPrefixLimits(route *common.RouteData) *common.Error {
+	limits := p.Server.Limits
+	if limits.Prefixes == 0 && limits.PrefixesPerIP == 0 {
+		return nil
+	}
+
+	after := p.Announced.LenAfter(route)
+	if limits.Prefixes > 0 && after > limits.Prefixes && after > p.Announced.Len() {
+		return &common.Error{
+			Code:    common.ErrPrefixLimit,
+			Message: fmt.Sprintf("Limit of %d announced prefixes per session reached", limits.Prefixes),
+		}
+	}
+	if limits.PrefixesPerIP > 0 {
+		total := after
+		p.Server.PeerLock.RLock()
+		for _, peer := range p.Server.Peers {
+			if peer != p && peer.Owner == p.Owner {
+				total += peer.Announced.Len()
+			}
+		}
+		p.Server.PeerLock.RUnlock()
+		if total > limits.PrefixesPerIP && after > p.Announced.Len() {
+			return &common.Error{
+				Code:    common.ErrPrefixLimit,
+				Message: fmt.Sprintf("Limit of %d announced prefixes per client reached", limits.PrefixesPerIP),
 			}
-			p.Neighbor.OutQueue <- announcement
 		}
 	}
+	return nil
+}
+
+// maxMessageSize is the largest BGP message allowed without the extended
+// message capability (RFC 4271 section 4.1)
+const maxMessageSize = 4096
+
+// splitUpdate breaks an UPDATE that is too large to send into several smaller
+// ones carrying the same path attributes. It fails when the path attributes
+// leave no room for a prefix.
+func splitUpdate(update *messages.BGPMessageUpdate) ([]*messages.BGPMessageUpdate, error) {
+	if update.Len() <= maxMessageSize {
+		return []*messages.BGPMessageUpdate{update}, nil
+	}
+	if len(update.NLRI) > 0 {
+		// The longest prefix has to fit next to the attributes
+		longest := update.NLRI[0]
+		for _, prefix := range update.NLRI {
+			if prefix.Len(update.EnableAddPath) > longest.Len(update.EnableAddPath) {
+				longest = prefix
+			}
+		}
+		single := &messages.BGPMessageUpdate{
+			PathAttributes: update.PathAttributes,
+			NLRI:           []messages.NLRI{longest},
+			EnableAddPath:  update.EnableAddPath,
+		}
+		if single.Len() > maxMessageSize {
+			attrsLen := 0
+			for _, attr := range update.PathAttributes {
+				attrsLen += attr.Len()
+			}
+			return nil, fmt.Errorf("The path attributes are %d octets long, leaving no room for prefixes in an UPDATE of at most %d octets", attrsLen, maxMessageSize)
+		}
+	}
+
+	updates := []*messages.BGPMessageUpdate{}
+	current := &messages.BGPMessageUpdate{EnableAddPath: update.EnableAddPath}
+	for _, prefix := range update.WithdrawnRoutes {
+		if current.Len()+prefix.Len(update.EnableAddPath) > maxMessageSize {
+			updates = append(updates, current)
+			current = &messages.BGPMessageUpdate{EnableAddPath: update.EnableAddPath}
+		}
+		current.WithdrawnRoutes = append(current.WithdrawnRoutes, prefix)
+	}
+	if len(current.WithdrawnRoutes) > 0 {
+		updates = append(updates, current)
+	}
+
+	newUpdate := func() *messages.BGPMessageUpdate {
+		return &messages.BGPMessageUpdate{
+			PathAttributes: update.PathAttributes,
+			EnableAddPath:  update.EnableAddPath,
+		}
+	}
+	current = newUpdate()
+	for _, prefix := range update.NLRI {
+		if current.Len()+prefix.Len(update.EnableAddPath) > maxMessageSize {
+			updates = append(updates, current)
+			current = newUpdate()
+		}
+		current.NLRI = append(current.NLRI, prefix)
+	}
+	if len(current.NLRI) > 0 {
+		updates = append(updates, current)
+	}
+
+	return updates, nil
+}
+
+// Limits caps what a client can do, 0 meaning unlimited
+type Limits struct {
+	SessionsPerIP int // Concurrent sessions created from one client address
+	Prefixes      int // Prefixes announced on one session
+	PrefixesPerIP int // Prefixes announced over all sessions of one client address
+
+	ReceivedPrefixes int // Cap on the maximum-prefix limit of every session
 }
 
 type BGPServer struct {
-	Fgbgp    *fgbgp.Manager
-	PeerLock sync.RWMutex
-	Peers    map[string]*Peer
+	Fgbgp           *fgbgp.Manager
+	PeerLock        sync.RWMutex
+	Peers           map[string]*Peer
+	BMP             *bmp.Client   // Exports sessions to a BMP collector if set
+	GracePeriod     time.Duration // How long a session outlives its client's websocket
+	Limits          Limits
+	LocalASNs       ASNPolicy // Local ASNs sessions may use
+	AllowActive     bool      // Sessions may connect out to their peer
+	AllowRobustness bool      // Sessions may send their peer malformed UPDATEs
+	ASPA            *aspa.Set // ASPA objects to verify routes from downstream peers with, if set
 }
 
 func neighborToKey(n *fgbgp.Neighbor) string {
@@ -157,7 +457,32 @@ func (s *BGPServer) GetPeerFromNeigh(n *fgbgp.Neighbor) (*Peer, bool) {
 	return peer, ok
 }
 
-func (s *BGPServer) CreatePeer(request *common.CreateRequest, ctx context.Context, cancel context.CancelFunc) (*Peer, error) {
+// GetPeer looks up a peer by its key
+func (s *BGPServer) GetPeer(key string) (*Peer, bool) {
+	s.PeerLock.RLock()
+	defer s.PeerLock.RUnlock()
+
+	peer, ok := s.Peers[key]
+	return peer, ok
+}
+
+// ListPeers returns all peers ordered by key
+func (s *BGPServer) ListPeers() []*Peer {
+	s.PeerLock.RLock()
+	defer s.PeerLock.RUnlock()
+
+	peers := make([]*Peer, 0, len(s.Peers))
+	for _, peer := range s.Peers {
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Key < peers[j].Key
+	})
+	return peers
+}
+
+// CreatePeer creates a session for the client at the owner address
+func (s *BGPServer) CreatePeer(request *common.CreateRequest, owner string, ctx context.Context, cancel context.CancelFunc) (*Peer, error) {
 	log.Tracef("[CreatePeer] Creating peer %+v", request)
 
 	s.PeerLock.Lock()
@@ -169,8 +494,58 @@ func (s *BGPServer) CreatePeer(request *common.CreateRequest, ctx context.Contex
 		return nil, errors.New("Peer already exists")
 	}
 
+	if !s.LocalASNs.Allows(request.LocalASN) {
+		log.Debugf("[CreatePeer] Local ASN %d not allowed by policy %s", request.LocalASN, s.LocalASNs)
+		message := fmt.Sprintf("Local ASN %d isn't allowed on this server, use one of: %s", request.LocalASN, s.LocalASNs)
+		if request.LocalASN == 0 || request.LocalASN == asTrans {
+			message = fmt.Sprintf("Local ASN %d is reserved and can't be used", request.LocalASN)
+		}
+		return nil, common.Error{
+			Code:    common.ErrLocalASN,
+			Message: message,
+		}
+	}
+
+	if err := common.ValidateRole(request.Role); err != nil {
+		return nil, err
+	}
+	if request.Role != "" && request.PeerASN == request.LocalASN {
+		return nil, errors.New("BGP Roles are only used on external sessions, where the local and peer ASN differ")
+	}
+	if request.RoleStrict && request.Role == "" {
+		return nil, errors.New("Strict BGP Role mode needs a role")
+	}
+
+	if request.Active != nil && !s.AllowActive {
+		return nil, errors.New("Active mode is disabled on this server, the peer has to connect to us")
+	}
+
+	if s.Limits.SessionsPerIP > 0 {
+		sessions := 0
+		for _, peer := range s.Peers {
+			if peer.Owner == owner {
+				sessions++
+			}
+		}
+		if sessions >= s.Limits.SessionsPerIP {
+			log.Debugf("[CreatePeer] %s already has %d sessions", owner, sessions)
+			return nil, common.Error{
+				Code:    common.ErrSessionLimit,
+				Message: fmt.Sprintf("Limit of %d concurrent sessions per client reached", s.Limits.SessionsPerIP),
+			}
+		}
+	}
+
 	peer := &Peer{
 		Key:              request.ToKey(),
+		Token:            auth.NewToken(),
+		ShareToken:       auth.NewToken(),
+		Owner:            owner,
+		maxPrefix:        maxPrefixState{config: effectiveMaxPrefix(request.MaxPrefix, s.Limits.ReceivedPrefixes)},
+		active:           effectiveActiveMode(request.Active),
+		inspect:          request.Inspect,
+		role:             request.Role,
+		roleStrict:       request.RoleStrict,
 		PeerASN:          request.PeerASN,
 		LocalASN:         request.LocalASN,
 		PeerIP:           request.PeerIP,
@@ -178,14 +553,22 @@ func (s *BGPServer) CreatePeer(request *common.CreateRequest, ctx context.Contex
 		SendChan:         make(chan *common.Packet, 512),
 		KeepAlive:        make(chan *messages.BGPMessageKeepAlive, 512),
 		RoutesToAnnounce: make(chan *common.RouteData, 512),
+		subscribers:      make(map[*Subscriber]struct{}),
+		Received:         NewRIB(),
+		Announced:        NewRIB(),
 		Context:          ctx,
 		Cancel:           cancel,
 	}
-	peer.SendChan <- &common.Packet{
-		Type: "FSMUpdate",
-		Data: common.FSMUpdate{
-			State: "Idle",
-		},
+	peer.SetState(common.FSMUpdate{
+		State: "Idle",
+	})
+	if peer.active != nil {
+		go peer.connectLoop()
+	} else {
+		peer.SetState(common.FSMUpdate{
+			State: "Active",
+			Event: eventPassiveStart,
+		})
 	}
 	s.Peers[request.ToKey()] = peer
 
@@ -196,27 +579,198 @@ func (s *BGPServer) CreatePeer(request *common.CreateRequest, ctx context.Contex
 
 func (s *BGPServer) Notification(msg *messages.BGPMessageNotification, n *fgbgp.Neighbor) bool {
 	log.Debugf("[Notification %s] Received NOTIFICATION message: %+v", neighborToKey(n), msg)
+	metrics.Notifications.WithLabelValues("received", strconv.Itoa(int(msg.ErrorCode)), strconv.Itoa(int(msg.ErrorSubcode))).Inc()
+	if s.BMP != nil {
+		s.BMP.SetDownReason(neighborToKey(n), bmp.ReasonRemoteNotification, messageBytes(msg))
+	}
 	return true
 }
 
+// messageBytes serializes a BGP message including its header
+func messageBytes(msg messages.SerializableInterface) []byte {
+	buf := &bytes.Buffer{}
+	msg.Write(buf)
+	return buf.Bytes()
+}
+
+// flushMarker is queued behind a message to learn when fgbgp has written it
+// to the connection
+type flushMarker chan struct{}
+
+func (f flushMarker) String() string {
+	return "flush marker"
+}
+
+func (f flushMarker) Len() int {
+	return 0
+}
+
+func (f flushMarker) Write(io.Writer) {
+	close(f)
+}
+
+// notify sends a NOTIFICATION to a neighbor and closes the connection once
+// it's written
+func (s *BGPServer) notify(n *fgbgp.Neighbor, code byte, subcode byte, data []byte) {
+	msg := &messages.BGPMessageNotification{
+		ErrorCode:    code,
+		ErrorSubcode: subcode,
+		Data:         data,
+	}
+	log.Debugf("[notify %s] Sending NOTIFICATION message: %+v", neighborToKey(n), msg)
+	metrics.Notifications.WithLabelValues("sent", strconv.Itoa(int(code)), strconv.Itoa(int(subcode))).Inc()
+	if s.BMP != nil {
+		s.BMP.SetDownReason(neighborToKey(n), bmp.ReasonLocalNotification, messageBytes(msg))
+	}
+
+	if peer, ok := s.GetPeerFromNeigh(n); ok {
+		peer.logMessage("sent", messageBytes(msg), false)
+	}
+
+	flushed := make(flushMarker)
+	n.OutQueue <- msg
+	n.OutQueue <- flushed
+	select {
+	case <-flushed:
+	case <-time.After(5 * time.Second):
+	}
+	n.Disconnect()
+}
+
+// Notify sends a NOTIFICATION to the peer and closes the session
+func (p *Peer) Notify(code byte, subcode byte, data []byte) {
+	if n := p.neighbor(); n != nil {
+		p.Server.notify(n, code, subcode, data)
+	}
+}
+
+// openBytes serializes an OPEN message. Optional parameters fgbgp couldn't
+// decode are left out as they can't be written back.
+func openBytes(open *messages.BGPMessageOpen) []byte {
+	clean := *open
+	clean.Parameters = []messages.BGPParameter{}
+	for _, param := range open.Parameters {
+		if param.Data != nil {
+			clean.Parameters = append(clean.Parameters, param)
+		}
+	}
+	return messageBytes(&clean)
+}
+
+// sentOpen builds the OPEN we send to a neighbor, fgbgp's own with the
+// FlowSpec families and, when the session has a role, the BGP Role capability
+// added
+func sentOpen(n *fgbgp.Neighbor, role string) *messages.BGPMessageOpen {
+	var holdTime uint16
+	if n.LocalEnableKeepAlive {
+		holdTime = uint16(n.LocalHoldTime / time.Second)
+	}
+	families := append(append([]messages.BGPCapability_MP{}, n.MultiprotocolList...), flowSpecCapabilities...)
+	open := messages.CraftOpenMessage(n.ASN, holdTime, n.Identifier.To4(), families, n.AddPathList, n.RouteRefresh)
+	if capability := roleCapability(role); capability != nil {
+		capabilities := open.Parameters[0].Data.(*messages.BGPCapabilities)
+		capabilities.BGPCapabilities = append(capabilities.BGPCapabilities, capability)
+	}
+	return open
+}
+
+// setOpenSent records the OPEN sent on the current connection
+func (p *Peer) setOpenSent(open []byte) {
+	p.stateLock.Lock()
+	p.openSent = open
+	p.stateLock.Unlock()
+}
+
+// lastOpenSent returns the OPEN sent on the current connection, exactly as it
+// went out
+func (p *Peer) lastOpenSent() []byte {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	return p.openSent
+}
+
 func (s *BGPServer) ProcessReceived(msg interface{}, n *fgbgp.Neighbor) (bool, error) {
 	n.LocalLastKeepAliveRecv = time.Now()
 	switch v := msg.(type) {
 	case *messages.BGPMessageOpen:
-		key := n.Addr.String() + "|" + strconv.FormatUint(uint64(v.ASN), 10)
+		asn, fourOctet := openASN(v)
+		key := n.Addr.String() + "|" + strconv.FormatUint(uint64(asn), 10)
 		s.PeerLock.Lock()
 		peer, ok := s.Peers[key]
 		s.PeerLock.Unlock()
 		if ok {
 			n.ASN = peer.LocalASN
-			peer.Neighbor = n
+			peer.setNeighbor(n)
 			log.Debugf("[ProcessReceived %s] Received OPEN message: %+v", neighborToKey(n), msg)
-			peer.SendChan <- &common.Packet{
-				Type: "FSMUpdate",
-				Data: common.FSMUpdate{
-					State: "Active",
-				},
+			peer.logMessage("received", openBytes(v), true)
+			if peer.rejectConnection() {
+				log.Infof("[ProcessReceived %s] Rejecting connection after maximum-prefix limit was exceeded", neighborToKey(n))
+				n.PeerASN = peer.PeerASN
+				peer.Log("Rejected connection, the maximum-prefix limit was exceeded")
+				s.notify(n, 6, ceaseConnectionRejected, nil)
+				return false, errors.New("connection rejected")
+			}
+			peer.setTwoOctetAS(!fourOctet)
+			if !fourOctet {
+				if peer.LocalASN > 0xffff {
+					log.Infof("[ProcessReceived %s] Refusing session, local ASN %d needs the four-octet AS capability", neighborToKey(n), peer.LocalASN)
+					n.PeerASN = peer.PeerASN
+					peer.SendError(common.Error{
+						Code:    common.ErrLocalASN,
+						Message: fmt.Sprintf("The peer doesn't support four-octet ASNs (RFC 6793), so local ASN %d can't be used with it. Use a local ASN below 65536.", peer.LocalASN),
+					})
+					peer.setDownEvent(eventBGPOpenMsgErr)
+					s.notify(n, 2, openUnsupportedCapability, fourOctetCapability(peer.LocalASN))
+					return false, errors.New("peer lacks the four-octet AS capability")
+				}
+				peer.Log("The peer lacks the four-octet AS capability, ASNs above 65535 are sent as AS_TRANS with an AS4_PATH")
+			}
+			peerRole, err := peer.checkRole(v)
+			if err != nil {
+				log.Infof("[ProcessReceived %s] Refusing session, BGP Role mismatch: %s", neighborToKey(n), err)
+				n.PeerASN = peer.PeerASN
+				peer.SendError(common.Error{Message: "BGP Role mismatch (RFC 9234): " + err.Error()})
+				peer.setDownEvent(eventBGPOpenMsgErr)
+				s.notify(n, 2, openRoleMismatch, nil)
+				return false, errors.New("BGP Role mismatch")
+			}
+			peer.setPeerRole(peerRole)
+			if peer.role != "" && peerRole == "" {
+				peer.Log("The peer doesn't advertise a BGP Role, OTC isn't checked on its routes")
 			}
+			if s.ASPA != nil && !peer.upstreamASPA() {
+				peer.Log("Routes aren't verified with ASPA, which needs our BGP Role to be provider, peer, rs or rs-client")
+			}
+			if peer.takeOutbound(n) {
+				// Our OPEN went out when connecting, so skip straight to
+				// OpenSent rather than have fgbgp send another
+				n.UpdateState(fgbgp.STATE_OPENSENT)
+				n.OutQueue <- messages.BGPMessageKeepAlive{}
+				peer.logMessage("sent", messageBytes(messages.BGPMessageKeepAlive{}), false)
+				peer.SetState(common.FSMUpdate{
+					State: "OpenConfirm",
+					Event: eventBGPOpen,
+				})
+				return true, nil
+			}
+			// fgbgp only hands over connections once their OPEN arrives. It
+			// would answer with an OPEN lacking our capabilities, so ours and
+			// a KEEPALIVE are sent here instead.
+			peer.SetState(common.FSMUpdate{
+				State: "OpenSent",
+				Event: eventTcpConnectionConfirmed,
+			})
+			open := messageBytes(sentOpen(n, peer.role))
+			peer.setOpenSent(open)
+			n.UpdateState(fgbgp.STATE_OPENSENT)
+			n.OutQueue <- rawMessage(open)
+			n.OutQueue <- messages.BGPMessageKeepAlive{}
+			peer.logMessage("sent", open, false)
+			peer.logMessage("sent", messageBytes(messages.BGPMessageKeepAlive{}), false)
+			peer.SetState(common.FSMUpdate{
+				State: "OpenConfirm",
+				Event: eventBGPOpen,
+			})
 			return true, nil
 		} else {
 			n.PeerASN = uint32(v.ASN)
@@ -228,50 +782,60 @@ func (s *BGPServer) ProcessReceived(msg interface{}, n *fgbgp.Neighbor) (bool, e
 		peer, ok := s.GetPeerFromNeigh(n)
 		if ok {
 			log.Tracef("[ProcessReceived %s] Received KEEPALIVE message", neighborToKey(n))
-			peer.Log("recv-keepalive")
+			peer.logMessage("received", messageBytes(v), true)
+			if peer.State() == "OpenConfirm" {
+				peer.SetState(common.FSMUpdate{
+					State:          "Established",
+					Event:          eventKeepAliveMsg,
+					HoldTimer:      uint(n.LocalHoldTime.Seconds()),
+					KeepaliveTimer: uint(n.LocalHoldTime / time.Second / 3),
+				})
+			}
 			peer.KeepAlive <- v
 		} else {
 			log.Errorf("[ProcessReceived %s] Received KEEPALIVE message for nonexistent peer???", neighborToKey(n))
 		}
+	case *messages.BGPMessageNotification:
+		// The connection may fail before fgbgp gets to handling the message
+		if peer, ok := s.GetPeerFromNeigh(n); ok {
+			peer.logMessage("received", messageBytes(v), true)
+			peer.setDownEvent(eventNotifMsg)
+		}
 	}
 	return true, nil
 }
 
 func (s *BGPServer) ProcessSend(v interface{}, n *fgbgp.Neighbor) (bool, error) {
-	// since we're passive, does this ever get called?
+	// fgbgp never calls this, even for sessions in active mode
 	log.Debugf("[ProcessSend %s]: %v", neighborToKey(n), v)
 	return true, nil
 }
 
-func (s *BGPServer) ProcessUpdateEvent(e *messages.BGPMessageUpdate, n *fgbgp.Neighbor) (add bool) {
-	peer, exists := s.GetPeerFromNeigh(n)
-	if !exists {
-		log.Errorf("[ProcessUpdateEvent %s] Got UPDATE message for nonexistent peer???", neighborToKey(n))
-		return false
-	}
-
-	log.Debugf("[ProcessUpdateEvent %s] Got UPDATE message. Adding prefixes %v, removing prefixes %v, with attributes %v", neighborToKey(n), e.NLRI, e.WithdrawnRoutes, e.PathAttributes)
-	peer.Log("recv-update")
-
-	data := common.RouteData{}
-	for _, v := range e.NLRI {
-		prefix, ok := v.(messages.NLRI_IPPrefix)
-		if ok {
-			data.Prefixes = append(data.Prefixes, common.NLRI{
-				Prefix: prefix.Prefix.String(),
-				ID:     prefix.PathId,
-			})
-		}
-	}
-	for _, v := range e.WithdrawnRoutes {
+// RouteDataFromUpdate converts a parsed UPDATE message into the RouteData sent
+// to clients
+// nlriPrefixes converts the prefixes of an UPDATE or MP_REACH_NLRI and
+// MP_UNREACH_NLRI attributes
+func nlriPrefixes(nlri []messages.NLRI) []common.NLRI {
+	var prefixes []common.NLRI
+	for _, v := range nlri {
 		prefix, ok := v.(messages.NLRI_IPPrefix)
 		if ok {
-			data.Withdraws = append(data.Prefixes, common.NLRI{
+			prefixes = append(prefixes, common.NLRI{
 				Prefix: prefix.Prefix.String(),
 				ID:     prefix.PathId,
 			})
 		}
 	}
+	return prefixes
+}
+
+func RouteDataFromUpdate(e *messages.BGPMessageUpdate) common.RouteData {
+	data := common.RouteData{}
+	var as4Path common.AsPath
+	var as4Aggregator *common.Aggregator
+	twoOctet := false
+	data.Prefixes = nlriPrefixes(e.NLRI)
+	data.Withdraws = nlriPrefixes(e.WithdrawnRoutes)
 
 	for _, v := range e.PathAttributes {
 		switch val := v.(type) {
@@ -290,11 +854,151 @@ func (s *BGPServer) ProcessUpdateEvent(e *messages.BGPMessageUpdate, n *fgbgp.Ne
 		case messages.BGPAttribute_ORIGIN:
 			data.Origin = int(val.Origin)
 		case messages.BGPAttribute_ASPATH:
-			data.AsPath = val.Segments[0].ASPath
+			data.AsPath = common.AsPathFromAttribute(val)
+			twoOctet = val.Enc2Bytes
+		case messages.BGPAttribute_MED:
+			med := val.Med
+			data.Med = &med
+		case messages.BGPAttribute_LOCPREF:
+			pref := val.LocPref
+			data.LocalPref = &pref
+		case messages.BGPAttribute_ATOMIC_AGGREGATE:
+			data.AtomicAggregate = true
+		case messages.BGPAttribute_AGGREGATOR:
+			if len(val.Identifier) == 4 {
+				data.Aggregator = &common.Aggregator{ASN: val.ASN, Address: net.IP(val.Identifier).String()}
+			}
+		// fgbgp parses the NLRI of every SAFI as prefixes, FlowSpec rules are
+		// decoded separately by flowSpecFromUpdate
+		case messages.BGPAttribute_MP_REACH:
+			if val.Safi != messages.SAFI_UNICAST {
+				continue
+			}
+			data.Prefixes = append(data.Prefixes, nlriPrefixes(val.NLRI)...)
+			nextHop := val.NextHop
+			// A link-local address may follow the global one
+			if len(nextHop) == 32 {
+				nextHop = nextHop[:16]
+			}
+			if data.NextHop == "" {
+				data.NextHop = nextHop.String()
+			}
+		case messages.BGPAttribute_MP_UNREACH:
+			if val.Safi == messages.SAFI_UNICAST {
+				data.Withdraws = append(data.Withdraws, nlriPrefixes(val.NLRI)...)
+			}
+		case messages.BGPAttribute:
+			switch val.Code {
+			case attrAS4Path:
+				as4Path = decodeAsPath(val.Data, 4)
+				continue
+			case attrAS4Aggregator:
+				if len(val.Data) == 8 {
+					as4Aggregator = &common.Aggregator{ASN: binary.BigEndian.Uint32(val.Data), Address: net.IP(val.Data[4:]).String()}
+				}
+				continue
+			case attrOTC:
+				if len(val.Data) == 4 {
+					otc := binary.BigEndian.Uint32(val.Data)
+					data.OTC = &otc
+				}
+				continue
+			case common.AttrExtendedCommunities, common.AttrIPv6ExtendedCommunities:
+				data.ExtendedCommunities = append(data.ExtendedCommunities, common.ExtendedCommunitiesFromAttribute(val)...)
+				continue
+			}
+			// Attributes fgbgp and the cases above don't decode are passed on as is
+			data.RawAttributes = append(data.RawAttributes, common.RawAttribute{
+				Flags:    val.Flags,
+				TypeCode: val.Code,
+				Value:    hex.EncodeToString(val.Data),
+			})
+		}
+	}
+
+	// Only two-octet speakers send AS4_PATH and AS4_AGGREGATOR, and both are
+	// ignored when an aggregator that isn't AS_TRANS replaced them, see RFC
+	// 6793 section 4.2.3
+	if twoOctet && (data.Aggregator == nil || data.Aggregator.ASN == asTrans) {
+		if data.Aggregator != nil && as4Aggregator != nil {
+			data.Aggregator = as4Aggregator
 		}
+		if as4Path != nil {
+			if merged, ok := mergeAS4Path(data.AsPath, as4Path); ok {
+				data.WireAsPath = data.AsPath
+				data.AsPath = merged
+			}
+		}
+	}
+
+	return data
+}
+
+// ProcessUpdate implements fgbgp.BGPUpdateHandler. UPDATEs are decoded in
+// order on the neighbor's receive goroutine so the raw message is still
+// around for exporting.
+func (s *BGPServer) ProcessUpdate(msg []byte, n *fgbgp.Neighbor) {
+	buf := &bytes.Buffer{}
+	messages.WriteBGPHeader(messages.MESSAGE_UPDATE, uint16(len(msg)), buf)
+	buf.Write(msg)
+	raw := buf.Bytes()
+
+	if peer, ok := s.GetPeerFromNeigh(n); ok {
+		peer.logMessage("received", raw, false)
+	}
+	msg = s.handleMalformed(msg, n)
+	if msg == nil {
+		return
 	}
+	update, err := messages.ParseUpdate(msg, n.DecodeAddPath, n.Peer2Bytes)
+	if update == nil {
+		log.Errorf("[ProcessUpdate %s] Failed parsing UPDATE message: %s", neighborToKey(n), err)
+		return
+	}
+	if err != nil {
+		log.Warnf("[ProcessUpdate %s] UPDATE message partially parsed: %s", neighborToKey(n), err)
+	}
+
+	if s.BMP != nil {
+		s.BMP.RouteMonitoring(neighborToKey(n), raw, update)
+	}
+
+	data := RouteDataFromUpdate(update)
+	data.FlowSpec, data.FlowSpecWithdraws = flowSpecFromUpdate(msg)
+	s.receiveUpdate(update, data, n)
+}
+
+func (s *BGPServer) Close() {}
 
-	log.Tracef("[ProcessUpdateEvent %s] Sending RouteData to client", neighborToKey(n))
+func (s *BGPServer) ProcessUpdateEvent(e *messages.BGPMessageUpdate, n *fgbgp.Neighbor) (add bool) {
+	return s.receiveUpdate(e, RouteDataFromUpdate(e), n)
+}
+
+// receiveUpdate records the routes of an UPDATE and sends them to the
+// clients, data being the UPDATE decoded along with what fgbgp can't parse
+func (s *BGPServer) receiveUpdate(e *messages.BGPMessageUpdate, data common.RouteData, n *fgbgp.Neighbor) bool {
+	peer, exists := s.GetPeerFromNeigh(n)
+	if !exists {
+		log.Errorf("[receiveUpdate %s] Got UPDATE message for nonexistent peer???", neighborToKey(n))
+		return false
+	}
+
+	log.Debugf("[receiveUpdate %s] Got UPDATE message. Adding prefixes %v, removing prefixes %v, with attributes %v", neighborToKey(n), e.NLRI, e.WithdrawnRoutes, e.PathAttributes)
+	if len(data.FlowSpec) > 0 || len(data.FlowSpecWithdraws) > 0 {
+		log.Debugf("[receiveUpdate %s] Adding FlowSpec rules %v, removing %v", neighborToKey(n), data.FlowSpec, data.FlowSpecWithdraws)
+	}
+
+	data.Leak = peer.otcLeak(&data)
+	data.ASPA = peer.verifyASPA(&data)
+	peer.Received.Update(&data)
+	metrics.UpdatesReceived.Inc()
+	metrics.PrefixesReceived.WithLabelValues("announce").Add(float64(len(data.Prefixes)))
+	metrics.PrefixesReceived.WithLabelValues("withdraw").Add(float64(len(data.Withdraws)))
+	if peer.checkMaxPrefix() {
+		return true
+	}
+
+	log.Tracef("[receiveUpdate %s] Sending RouteData to client", neighborToKey(n))
 	peer.SendChan <- &common.Packet{
 		Type: "RouteData",
 		Data: data,
@@ -303,15 +1007,20 @@ func (s *BGPServer) ProcessUpdateEvent(e *messages.BGPMessageUpdate, n *fgbgp.Ne
 }
 
 func (s *BGPServer) DisconnectedNeighbor(n *fgbgp.Neighbor) {
+	if s.BMP != nil {
+		s.BMP.PeerDown(neighborToKey(n))
+	}
 	peer, ok := s.GetPeerFromNeigh(n)
-	if ok {
+	if ok && !peer.neighborDown(n) {
 		log.Infof("[DisconnectedNeighbor %s] Neighbor is down", neighborToKey(n))
-		peer.SendChan <- &common.Packet{
-			Type: "FSMUpdate",
-			Data: common.FSMUpdate{
-				State: "Idle",
-			},
-		}
+		peer.Received.Clear()
+		peer.Announced.Clear()
+		peer.resetMaxPrefixWarnings()
+		peer.SetState(common.FSMUpdate{
+			State: "Idle",
+			Event: peer.takeDownEvent(n),
+		})
+		peer.autoStart()
 	} else {
 		log.Debugf("[DisconnectedNeighbor %s] Disconnected neighbor for nonexistent peer", neighborToKey(n))
 	}
@@ -322,13 +1031,14 @@ func (s *BGPServer) NewNeighbor(on *messages.BGPMessageOpen, n *fgbgp.Neighbor)
 	peer, ok := s.GetPeerFromNeigh(n)
 	if ok {
 		log.Infof("[NewNeighbor %s] Neighbor is up", neighborToKey(n))
-		peer.SendChan <- &common.Packet{
-			Type: "FSMUpdate",
-			Data: common.FSMUpdate{
-				State:          "Established",
-				HoldTimer:      uint(n.LocalHoldTime.Seconds()),
-				KeepaliveTimer: uint(n.LocalHoldTime / time.Second / 3),
-			},
+		if s.BMP != nil {
+			localAddr, localPort := n.GetLocalAddress()
+			s.BMP.PeerUp(neighborToKey(n), bmp.PeerInfo{
+				Address:    n.Addr,
+				ASN:        n.PeerASN,
+				Identifier: n.PeerIdentifier,
+				TwoByteAS:  n.Peer2Bytes,
+			}, localAddr, uint16(localPort), uint16(n.Port), peer.lastOpenSent(), openBytes(on))
 		}
 	} else {
 		log.Errorf("[NewNeighbor %s] Got neighbor establishment for nonexistent peer???", neighborToKey(n))
@@ -337,30 +1047,39 @@ func (s *BGPServer) NewNeighbor(on *messages.BGPMessageOpen, n *fgbgp.Neighbor)
 }
 
 func (s *BGPServer) OpenSend(on *messages.BGPMessageOpen, n *fgbgp.Neighbor) bool {
-	// since we're passive, does this ever get called?
-	peer, ok := s.GetPeerFromNeigh(n)
-	if ok {
-		log.Debugf("[OpenSend %s] sent message %+v", neighborToKey(n), on)
-		peer.SendChan <- &common.Packet{
-			Type: "FSMUpdate",
-			Data: common.FSMUpdate{
-				State: "OpenSent",
-			},
-		}
-		return true
-	}
-	return false
+	// fgbgp never calls this, even for sessions in active mode, so OpenSent is
+	// reported from ProcessReceived and connect
+	log.Debugf("[OpenSend %s] sent message %+v", neighborToKey(n), on)
+	return true
 }
 
-func CreateBGPServer(asn uint32, listenAddr string, identifier string, logger *logrus.Logger) *BGPServer {
+func CreateBGPServer(asn uint32, listenAddr string, identifier string, bmpClient *bmp.Client, logger *logrus.Logger) *BGPServer {
 	log = logger
-	
+
 	log.Tracef("[CreateBGPServer] creating fgbgp manager")
 	manager := fgbgp.NewManager(asn, net.ParseIP(identifier), false, false)
-	manager.UseDefaultUpdateHandler(10)
-	server := &BGPServer{Fgbgp: manager, Peers: make(map[string]*Peer)}
+	server := &BGPServer{Fgbgp: manager, Peers: make(map[string]*Peer), BMP: bmpClient}
 	manager.SetEventHandler(server)
-	manager.SetUpdateEventHandler(server)
+	manager.HandlerUpdate = server
+
+	metrics.RegisterQueueDepth("send", func() float64 {
+		depth := 0
+		server.PeerLock.RLock()
+		for _, peer := range server.Peers {
+			depth += len(peer.SendChan)
+		}
+		server.PeerLock.RUnlock()
+		return float64(depth)
+	})
+	metrics.RegisterQueueDepth("announce", func() float64 {
+		depth := 0
+		server.PeerLock.RLock()
+		for _, peer := range server.Peers {
+			depth += len(peer.RoutesToAnnounce)
+		}
+		server.PeerLock.RUnlock()
+		return float64(depth)
+	})
 
 	log.Tracef("[CreateBGPServer] creating fgbgp server with listenAddr %s", listenAddr)
 	err := manager.NewServer(listenAddr)
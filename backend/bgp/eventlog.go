@@ -0,0 +1,157 @@
+package bgp
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bgptools/fgbgp/messages"
+	"github.com/hamptonmoore/bgp.exposed/backend/common"
+)
+
+// eventLogSize is how many events each session keeps
+const eventLogSize = 1000
+
+var messageTypes = map[byte]string{
+	messages.MESSAGE_OPEN:         "OPEN",
+	messages.MESSAGE_UPDATE:       "UPDATE",
+	messages.MESSAGE_NOTIFICATION: "NOTIFICATION",
+	messages.MESSAGE_KEEPALIVE:    "KEEPALIVE",
+	messages.MESSAGE_ROUTEREFRESH: "ROUTE-REFRESH",
+}
+
+// eventLog is a ring buffer of a session's most recent events
+type eventLog struct {
+	events []common.Event
+	next   int    // Where the next event goes once the buffer is full
+	seq    uint64 // Sequence number of the last event
+}
+
+func (l *eventLog) add(event common.Event) common.Event {
+	l.seq++
+	event.Seq = l.seq
+	if len(l.events) < eventLogSize {
+		l.events = append(l.events, event)
+	} else {
+		l.events[l.next] = event
+		l.next = (l.next + 1) % eventLogSize
+	}
+	return event
+}
+
+// list returns the events oldest first
+func (l *eventLog) list() []common.Event {
+	events := make([]common.Event, 0, len(l.events))
+	events = append(events, l.events[l.next:]...)
+	return append(events, l.events[:l.next]...)
+}
+
+// record adds an event to the log and sends it to the clients
+func (p *Peer) record(event common.Event) {
+	event.Time = uint64(time.Now().UTC().UnixNano())
+	p.stateLock.Lock()
+	event = p.events.add(event)
+	p.stateLock.Unlock()
+
+	p.SendChan <- &common.Packet{
+		Type: "Event",
+		Data: event,
+	}
+}
+
+// Log records something worth knowing that doesn't fit another kind of event
+func (p *Peer) Log(msg string) {
+	p.record(common.Event{
+		Kind:    common.EventInfo,
+		Message: msg,
+	})
+}
+
+// LogAction records something a client did to the session
+func (p *Peer) LogAction(action string, msg string) {
+	p.record(common.Event{
+		Kind:    common.EventAction,
+		Action:  action,
+		Message: msg,
+	})
+}
+
+// logMessage records a BGP message sent to or received from the peer, given
+// with its header, and sends it to clients inspecting the session
+func (p *Peer) logMessage(direction string, msg []byte, reencoded bool) {
+	msgType, size := msg[messages.GetBGPHeaderLen()-1], len(msg)
+	name := messageTypes[msgType]
+	if name == "" {
+		name = fmt.Sprintf("type %d", msgType)
+	}
+	verb := "Sent"
+	if direction == "received" {
+		verb = "Received"
+	}
+	desc := name
+	if msgType == messages.MESSAGE_NOTIFICATION && size > messages.GetBGPHeaderLen()+1 {
+		desc = fmt.Sprintf("%s %d/%d", name, msg[19], msg[20])
+	}
+	p.record(common.Event{
+		Kind:        common.EventMessage,
+		Message:     fmt.Sprintf("%s %s (%d bytes)", verb, desc, size),
+		Direction:   direction,
+		MessageType: name,
+		Size:        size,
+	})
+	p.inspectMessage(direction, msg, reencoded)
+}
+
+func (p *Peer) logState(update common.FSMUpdate) {
+	msg := update.State
+	if update.Previous != "" {
+		msg = update.Previous + " -> " + msg
+	}
+	if update.Event != "" {
+		msg += " on " + update.Event
+	}
+	p.record(common.Event{
+		Kind:    common.EventState,
+		Message: msg,
+		State:   &update,
+	})
+}
+
+// SendError sends an error to every client of the session and records it
+func (p *Peer) SendError(err common.Error) {
+	p.logError(err)
+	p.SendChan <- &common.Packet{
+		Type: "Error",
+		Data: err,
+	}
+}
+
+func (p *Peer) logError(err common.Error) {
+	p.record(common.Event{
+		Kind:    common.EventError,
+		Message: err.Message,
+		Error:   &err,
+	})
+}
+
+// Events returns the events in the log matching the query, oldest first
+func (p *Peer) Events(query common.EventQuery) []common.Event {
+	p.stateLock.Lock()
+	all := p.events.list()
+	p.stateLock.Unlock()
+
+	kinds := map[string]bool{}
+	for _, kind := range query.Kinds {
+		kinds[kind] = true
+	}
+	events := []common.Event{}
+	for _, event := range all {
+		if event.Seq <= query.After || (len(kinds) > 0 && !kinds[event.Kind]) {
+			continue
+		}
+		events = append(events, event)
+	}
+	if query.Limit > 0 && len(events) > query.Limit {
+		events = events[len(events)-query.Limit:]
+	}
+	return events
+}
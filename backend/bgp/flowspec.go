@@ -0,0 +1,137 @@
+package bgp
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/bgptools/fgbgp/messages"
+	"github.com/hamptonmoore/bgp.exposed/backend/common"
+)
+
+// flowSpecCapabilities are the Multiprotocol capabilities of the FlowSpec
+// families, advertised next to fgbgp's unicast ones
+var flowSpecCapabilities = []messages.BGPCapability_MP{
+	{Afi: messages.AFI_IPV4, Safi: common.SafiFlowSpec},
+	{Afi: messages.AFI_IPV6, Safi: common.SafiFlowSpec},
+}
+
+// flowSpecOfFamily returns the rules of an address family
+func flowSpecOfFamily(rules []common.FlowSpec, afi uint16) []common.FlowSpec {
+	family := []common.FlowSpec{}
+	for i := range rules {
+		if rules[i].IPv6() == (afi == messages.AFI_IPV6) {
+			family = append(family, rules[i])
+		}
+	}
+	return family
+}
+
+// packFlowSpec encodes rules into groups of NLRIs that each fit in space
+// octets
+func packFlowSpec(rules []common.FlowSpec, space int) ([][]byte, error) {
+	groups := [][]byte{}
+	var group []byte
+	for i := range rules {
+		b, err := rules[i].Encode()
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > space {
+			return nil, fmt.Errorf("FlowSpec rule %s doesn't fit in an UPDATE with its attributes", rules[i])
+		}
+		if len(group)+len(b) > space {
+			groups = append(groups, group)
+			group = nil
+		}
+		group = append(group, b...)
+	}
+	if len(group) > 0 {
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// flowSpecUpdates builds the UPDATEs withdrawing and announcing a route's
+// FlowSpec rules. Each family gets its own UPDATEs as one only holds a single
+// MP_REACH_NLRI and MP_UNREACH_NLRI. Announcements carry attrs, which must
+// not have a NEXT_HOP.
+func flowSpecUpdates(route *common.RouteData, attrs []messages.BGPAttributeIf) ([]*messages.BGPMessageUpdate, error) {
+	attrsLen := 0
+	for _, attr := range attrs {
+		attrsLen += attr.Len()
+	}
+	updates := []*messages.BGPMessageUpdate{}
+	for _, afi := range []uint16{messages.AFI_IPV4, messages.AFI_IPV6} {
+		header := []byte{byte(afi >> 8), byte(afi), common.SafiFlowSpec}
+
+		// Room left by the message header, length fields and an extended
+		// length MP_UNREACH_NLRI with its AFI and SAFI
+		groups, err := packFlowSpec(flowSpecOfFamily(route.FlowSpecWithdraws, afi), maxMessageSize-23-7)
+		if err != nil {
+			return nil, err
+		}
+		for _, nlri := range groups {
+			unreach := pathAttribute{flags: messages.ATTRIBUTE_OPTIONAL, code: messages.ATTRIBUTE_UNREACH, value: append(append([]byte{}, header...), nlri...)}
+			updates = append(updates, &messages.BGPMessageUpdate{PathAttributes: []messages.BGPAttributeIf{unreach}})
+		}
+
+		// MP_REACH_NLRI also has the next hop length and reserved octet. The
+		// next hop is left empty as RFC 8955 section 4 has it.
+		groups, err = packFlowSpec(flowSpecOfFamily(route.FlowSpec, afi), maxMessageSize-23-attrsLen-9)
+		if err != nil {
+			return nil, err
+		}
+		for _, nlri := range groups {
+			value := append(append(append([]byte{}, header...), 0, 0), nlri...)
+			reach := pathAttribute{flags: messages.ATTRIBUTE_OPTIONAL, code: messages.ATTRIBUTE_REACH, value: value}
+			pa := append(append([]messages.BGPAttributeIf{}, attrs...), reach)
+			updates = append(updates, &messages.BGPMessageUpdate{PathAttributes: pa})
+		}
+	}
+	return updates, nil
+}
+
+// flowSpecNLRI decodes the FlowSpec rules in the NLRI of an MP_REACH_NLRI or
+// MP_UNREACH_NLRI. FlowSpec for other address families is ignored.
+func flowSpecNLRI(b []byte, afi uint16) ([]common.FlowSpec, error) {
+	if afi != messages.AFI_IPV4 && afi != messages.AFI_IPV6 {
+		return nil, nil
+	}
+	return common.DecodeFlowSpec(b, afi == messages.AFI_IPV6)
+}
+
+// flowSpecFromUpdate decodes the FlowSpec rules announced and withdrawn by an
+// UPDATE body, which fgbgp can't parse. checkUpdate has gone over the body
+// already, so anything malformed is skipped.
+func flowSpecFromUpdate(body []byte) (announced []common.FlowSpec, withdrawn []common.FlowSpec) {
+	if len(body) < 4 {
+		return nil, nil
+	}
+	attrStart := 4 + int(binary.BigEndian.Uint16(body))
+	if attrStart > len(body) {
+		return nil, nil
+	}
+	attrEnd := attrStart + int(binary.BigEndian.Uint16(body[attrStart-2:]))
+	if attrEnd > len(body) {
+		return nil, nil
+	}
+	for offset := attrStart; offset < attrEnd; {
+		attr, ok := locateAttribute(body[:attrEnd], offset)
+		if !ok {
+			break
+		}
+		offset = attr.end
+		b := attr.value
+		switch attr.code {
+		case messages.ATTRIBUTE_REACH:
+			if len(b) >= 5 && b[2] == common.SafiFlowSpec && 5+int(b[3]) <= len(b) {
+				announced, _ = flowSpecNLRI(b[5+int(b[3]):], binary.BigEndian.Uint16(b))
+			}
+		case messages.ATTRIBUTE_UNREACH:
+			if len(b) >= 3 && b[2] == common.SafiFlowSpec {
+				withdrawn, _ = flowSpecNLRI(b[3:], binary.BigEndian.Uint16(b))
+			}
+		}
+	}
+	return announced, withdrawn
+}
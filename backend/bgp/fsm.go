@@ -0,0 +1,88 @@
+package bgp
+
+import (
+	"time"
+
+	fgbgp "github.com/bgptools/fgbgp/server"
+	"github.com/hamptonmoore/bgp.exposed/backend/common"
+)
+
+// FSM events from RFC 4271 section 8.1 reported with the transitions they cause
+const (
+	eventManualStart            = "ManualStart"
+	eventManualStop             = "ManualStop"
+	eventAutomaticStart         = "AutomaticStart"
+	eventAutomaticStop          = "AutomaticStop"
+	eventPassiveStart           = "ManualStart_with_PassiveTcpEstablishment"
+	eventPassiveRestart         = "AutomaticStart_with_PassiveTcpEstablishment"
+	eventHoldTimerExpires       = "HoldTimer_Expires"
+	eventTcpCRAcked             = "Tcp_CR_Acked"
+	eventTcpConnectionConfirmed = "TcpConnectionConfirmed"
+	eventTcpConnectionFails     = "TcpConnectionFails"
+	eventBGPOpen                = "BGPOpen"
+	eventBGPOpenMsgErr          = "BGPOpenMsgErr"
+	eventKeepAliveMsg           = "KeepAliveMsg"
+	eventNotifMsg               = "NotifMsg"
+	eventUpdateMsgErr           = "UpdateMsgErr"
+)
+
+// State returns the peer's current FSM state
+func (p *Peer) State() string {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	return p.FSM.State
+}
+
+// setDownEvent records why the session is about to go down, for the
+// transition to Idle once fgbgp disconnects the neighbor
+func (p *Peer) setDownEvent(event string) {
+	p.stateLock.Lock()
+	p.downEvent = event
+	p.stateLock.Unlock()
+}
+
+// takeDownEvent returns why the neighbor disconnected, guessing from its
+// timers when nothing was recorded
+func (p *Peer) takeDownEvent(n *fgbgp.Neighbor) string {
+	p.stateLock.Lock()
+	event := p.downEvent
+	p.downEvent = ""
+	p.stateLock.Unlock()
+	if event != "" {
+		return event
+	}
+	if n.LocalEnableKeepAlive && n.LocalLastKeepAliveRecv.Add(n.LocalHoldTime).Before(time.Now()) {
+		return eventHoldTimerExpires
+	}
+	return eventTcpConnectionFails
+}
+
+// neighborDown records the neighbor as down, reporting whether it already was
+func (p *Peer) neighborDown(n *fgbgp.Neighbor) bool {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	if p.downNeighbor == n {
+		return true
+	}
+	p.downNeighbor = n
+	return false
+}
+
+// autoStart has an idle passive session wait for the peer to connect again,
+// unless the session was closed or is refusing connections. Sessions in active
+// mode leave Idle when their ConnectRetry timer expires instead.
+func (p *Peer) autoStart() {
+	if p.active != nil || p.Context.Err() != nil {
+		return
+	}
+	p.stateLock.Lock()
+	idle := p.FSM.State == "Idle"
+	tripped := p.maxPrefix.tripped && (p.maxPrefix.rejectUntil.IsZero() || time.Now().Before(p.maxPrefix.rejectUntil))
+	p.stateLock.Unlock()
+	if idle && !tripped {
+		p.SetState(common.FSMUpdate{
+			State: "Active",
+			Event: eventPassiveRestart,
+		})
+	}
+}
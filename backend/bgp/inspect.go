@@ -0,0 +1,62 @@
+package bgp
+
+import (
+	"encoding/hex"
+	"time"
+
+	"github.com/bgptools/fgbgp/messages"
+	"github.com/hamptonmoore/bgp.exposed/backend/common"
+	"github.com/hamptonmoore/bgp.exposed/backend/inspect"
+)
+
+// SetInspect turns sending every BGP message of the session to its clients as
+// a RawMessage on or off
+func (p *Peer) SetInspect(enabled bool) {
+	p.stateLock.Lock()
+	p.inspect = enabled
+	p.stateLock.Unlock()
+}
+
+// Inspecting reports whether the session's messages are sent to its clients
+func (p *Peer) Inspecting() bool {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	return p.inspect
+}
+
+// wireOptions returns how messages in a direction are encoded on the session
+func (p *Peer) wireOptions(direction string) inspect.Options {
+	n := p.neighbor()
+	if n == nil {
+		return inspect.Options{AS4: true}
+	}
+	if direction == "sent" {
+		return inspect.Options{
+			AS4:     !p.twoOctet(),
+			AddPath: messages.InAfiSafi(messages.AFI_IPV4, messages.SAFI_UNICAST, n.SendAddPath),
+		}
+	}
+	return inspect.Options{
+		AS4:     !n.Peer2Bytes,
+		AddPath: messages.InAfiSafi(messages.AFI_IPV4, messages.SAFI_UNICAST, n.DecodeAddPath),
+	}
+}
+
+// inspectMessage sends a message to the clients of a session being inspected.
+// Reencoded messages were rebuilt from what fgbgp parsed, as it doesn't keep
+// the bytes it received.
+func (p *Peer) inspectMessage(direction string, msg []byte, reencoded bool) {
+	if !p.Inspecting() {
+		return
+	}
+	p.SendChan <- &common.Packet{
+		Type: "RawMessage",
+		Data: common.RawMessage{
+			Time:      uint64(time.Now().UTC().UnixNano()),
+			Direction: direction,
+			Hex:       hex.EncodeToString(msg),
+			Reencoded: reencoded,
+			Tree:      inspect.Decode(msg, p.wireOptions(direction)),
+		},
+	}
+}
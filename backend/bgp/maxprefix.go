@@ -0,0 +1,128 @@
+package bgp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/hamptonmoore/bgp.exposed/backend/common"
+)
+
+// Cease subcodes from RFC 4486
+const (
+	ceaseMaxPrefixes        = 1
+	ceaseConnectionRejected = 5
+)
+
+const defaultMaxPrefixWarning = 75
+
+// maxPrefixState tracks a session's maximum-prefix limit
+type maxPrefixState struct {
+	config common.MaxPrefix
+	warned [familyCount]bool // Per family, reset when the session goes down
+
+	tripped     bool      // The limit was exceeded, refuse connections
+	rejectUntil time.Time // When connections are accepted again, zero for never
+}
+
+// effectiveMaxPrefix combines a session's requested limit with the server's
+// cap on received prefixes
+func effectiveMaxPrefix(requested *common.MaxPrefix, cap int) common.MaxPrefix {
+	config := common.MaxPrefix{}
+	if requested != nil {
+		config = *requested
+	}
+	if cap > 0 && (config.Limit == 0 || config.Limit > uint32(cap)) {
+		config.Limit = uint32(cap)
+	}
+	if config.Warning == 0 || config.Warning > 100 {
+		config.Warning = defaultMaxPrefixWarning
+	}
+	return config
+}
+
+// checkMaxPrefix compares the received table with the limit after an UPDATE,
+// warning the client at the threshold and closing the session once the limit
+// is exceeded. It returns true if the session was closed.
+func (p *Peer) checkMaxPrefix() bool {
+	p.stateLock.Lock()
+	mp := &p.maxPrefix
+	limit := mp.config.Limit
+	p.stateLock.Unlock()
+	if limit == 0 {
+		return false
+	}
+
+	for f, count := range p.Received.LenFamilies() {
+		label := families[f].label
+
+		if uint32(count) > limit {
+			log.Infof("[checkMaxPrefix %s] Peer sent %d %s routes, over the limit of %d", p.ToKey(), count, label, limit)
+
+			p.stateLock.Lock()
+			mp.tripped = true
+			mp.rejectUntil = time.Time{}
+			restart := time.Duration(mp.config.Restart) * time.Second
+			if restart > 0 {
+				mp.rejectUntil = time.Now().Add(restart)
+			}
+			p.stateLock.Unlock()
+
+			message := fmt.Sprintf("Peer sent %d %s routes, over the limit of %d. Closed the session with Cease/Maximum Number of Prefixes Reached.", count, label, limit)
+			if restart > 0 {
+				message += fmt.Sprintf(" It may reconnect in %s.", restart)
+				time.AfterFunc(restart, func() {
+					p.Log("Maximum-prefix restart delay passed, accepting connections again")
+					p.autoStart()
+				})
+			}
+			p.SendError(common.Error{
+				Code:    common.ErrMaxPrefix,
+				Message: message,
+			})
+
+			// RFC 4486 section 4: AFI, SAFI and the upper bound
+			data := make([]byte, 7)
+			binary.BigEndian.PutUint16(data[0:2], families[f].afi)
+			data[2] = families[f].safi
+			binary.BigEndian.PutUint32(data[3:7], limit)
+			p.setDownEvent(eventAutomaticStop)
+			p.Notify(6, ceaseMaxPrefixes, data)
+			return true
+		}
+
+		p.stateLock.Lock()
+		warn := !mp.warned[f] && uint64(count)*100 >= uint64(limit)*uint64(mp.config.Warning)
+		if warn {
+			mp.warned[f] = true
+		}
+		p.stateLock.Unlock()
+		if warn {
+			p.Log(fmt.Sprintf("Maximum-prefix warning: received %d of %d %s routes", count, limit, label))
+		}
+	}
+	return false
+}
+
+// rejectConnection reports whether a new connection must be refused because
+// the maximum-prefix limit was exceeded and the restart delay hasn't passed
+func (p *Peer) rejectConnection() bool {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	mp := &p.maxPrefix
+	if !mp.tripped {
+		return false
+	}
+	if !mp.rejectUntil.IsZero() && time.Now().After(mp.rejectUntil) {
+		mp.tripped = false
+		return false
+	}
+	return true
+}
+
+// resetMaxPrefixWarnings rearms the warnings once the session is down
+func (p *Peer) resetMaxPrefixWarnings() {
+	p.stateLock.Lock()
+	p.maxPrefix.warned = [familyCount]bool{}
+	p.stateLock.Unlock()
+}
@@ -0,0 +1,66 @@
+package bgp
+
+import (
+	"errors"
+
+	"github.com/hamptonmoore/bgp.exposed/backend/common"
+)
+
+// Replay is a capture being replayed into a session, see mrt.Replay. It is
+// kept on the peer rather than the websocket so a client that reattaches can
+// still control it.
+type Replay interface {
+	Control(c common.ReplayControl) error
+	Done() <-chan struct{}
+	Status() common.ReplayStatus
+}
+
+// replayRunning reports whether r is set and still running
+func replayRunning(r Replay) bool {
+	if r == nil {
+		return false
+	}
+	select {
+	case <-r.Done():
+		return false
+	default:
+		return true
+	}
+}
+
+// StartReplay makes r the session's replay, refusing if another one is still
+// running. The caller starts running it.
+func (p *Peer) StartReplay(r Replay) error {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	if replayRunning(p.replay) {
+		return errors.New("A replay is already running")
+	}
+	p.replay = r
+	return nil
+}
+
+// ControlReplay passes a pause, resume, stop or speed action to the session's
+// replay
+func (p *Peer) ControlReplay(c common.ReplayControl) error {
+	p.stateLock.Lock()
+	r := p.replay
+	p.stateLock.Unlock()
+	if r == nil {
+		return errors.New("No replay has been started")
+	}
+	return r.Control(c)
+}
+
+// replayStatus returns the status of the session's last replay, nil if none
+// was started
+func (p *Peer) replayStatus() *common.ReplayStatus {
+	p.stateLock.Lock()
+	r := p.replay
+	p.stateLock.Unlock()
+	if r == nil {
+		return nil
+	}
+	status := r.Status()
+	return &status
+}
@@ -0,0 +1,232 @@
+package bgp
+
+import (
+	"encoding/hex"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bgptools/fgbgp/messages"
+	"github.com/hamptonmoore/bgp.exposed/backend/common"
+)
+
+type ribEntry struct {
+	nlri     common.NLRI
+	flowSpec *common.FlowSpec  // Set instead of nlri for FlowSpec rules
+	attrs    *common.RouteData // Shared by all prefixes announced together
+}
+
+// family is an AFI/SAFI the table holds routes of
+type family int
+
+const (
+	familyIPv4 family = iota
+	familyIPv6
+	familyFlowSpecIPv4
+	familyFlowSpecIPv6
+	familyCount
+)
+
+var families = [familyCount]struct {
+	label string
+	afi   uint16
+	safi  uint8
+}{
+	familyIPv4:         {"IPv4 unicast", messages.AFI_IPV4, messages.SAFI_UNICAST},
+	familyIPv6:         {"IPv6 unicast", messages.AFI_IPV6, messages.SAFI_UNICAST},
+	familyFlowSpecIPv4: {"IPv4 FlowSpec", messages.AFI_IPV4, common.SafiFlowSpec},
+	familyFlowSpecIPv6: {"IPv6 FlowSpec", messages.AFI_IPV6, common.SafiFlowSpec},
+}
+
+// RIB is the table of routes received from or announced to a peer, holding
+// both prefixes and FlowSpec rules
+type RIB struct {
+	lock   sync.Mutex
+	routes map[string]ribEntry
+	counts [familyCount]int // Number of routes in each family
+}
+
+func NewRIB() *RIB {
+	return &RIB{routes: make(map[string]ribEntry)}
+}
+
+// normalize returns the prefix in canonical form so differently written
+// announcements of the same prefix match up
+func normalize(nlri common.NLRI) common.NLRI {
+	if _, prefix, err := net.ParseCIDR(nlri.Prefix); err == nil {
+		nlri.Prefix = prefix.String()
+	}
+	return nlri
+}
+
+func isIPv6(nlri common.NLRI) bool {
+	return strings.Contains(nlri.Prefix, ":")
+}
+
+func ribKey(nlri common.NLRI) string {
+	return nlri.Prefix + "|" + strconv.FormatUint(uint64(nlri.ID), 10)
+}
+
+func (e ribEntry) key() string {
+	if e.flowSpec == nil {
+		return ribKey(e.nlri)
+	}
+	// Rules are keyed by their encoding, which is the same however the
+	// components were written
+	family := common.FlowSpecIPv4
+	if e.flowSpec.IPv6() {
+		family = common.FlowSpecIPv6
+	}
+	b, _ := e.flowSpec.Encode()
+	return "flowspec|" + family + "|" + hex.EncodeToString(b)
+}
+
+func (e ribEntry) family() family {
+	switch {
+	case e.flowSpec != nil && e.flowSpec.IPv6():
+		return familyFlowSpecIPv6
+	case e.flowSpec != nil:
+		return familyFlowSpecIPv4
+	case isIPv6(e.nlri):
+		return familyIPv6
+	}
+	return familyIPv4
+}
+
+// changes returns the entries a RouteData withdraws and announces
+func changes(data *common.RouteData) (withdrawn []ribEntry, announced []ribEntry) {
+	for _, nlri := range data.Withdraws {
+		withdrawn = append(withdrawn, ribEntry{nlri: normalize(nlri)})
+	}
+	for _, rule := range data.FlowSpecWithdraws {
+		rule := rule
+		withdrawn = append(withdrawn, ribEntry{flowSpec: &rule})
+	}
+	if len(data.Prefixes) == 0 && len(data.FlowSpec) == 0 {
+		return withdrawn, nil
+	}
+	attrs := *data
+	attrs.Withdraws = nil
+	attrs.Prefixes = nil
+	attrs.FlowSpec = nil
+	attrs.FlowSpecWithdraws = nil
+	for _, nlri := range data.Prefixes {
+		announced = append(announced, ribEntry{nlri: normalize(nlri), attrs: &attrs})
+	}
+	for _, rule := range data.FlowSpec {
+		rule := rule
+		announced = append(announced, ribEntry{flowSpec: &rule, attrs: &attrs})
+	}
+	return withdrawn, announced
+}
+
+// Update applies the withdraws and announcements of a RouteData to the table
+func (r *RIB) Update(data *common.RouteData) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	withdrawn, announced := changes(data)
+	for _, entry := range withdrawn {
+		key := entry.key()
+		if _, ok := r.routes[key]; ok {
+			r.counts[entry.family()]--
+		}
+		delete(r.routes, key)
+	}
+	for _, entry := range announced {
+		key := entry.key()
+		if _, ok := r.routes[key]; !ok {
+			r.counts[entry.family()]++
+		}
+		r.routes[key] = entry
+	}
+}
+
+// Clear removes every route, used when the session goes down
+func (r *RIB) Clear() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.routes = make(map[string]ribEntry)
+	r.counts = [familyCount]int{}
+}
+
+// Has reports whether the table holds a prefix
+func (r *RIB) Has(nlri common.NLRI) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	_, ok := r.routes[ribKey(normalize(nlri))]
+	return ok
+}
+
+// Len returns the number of prefixes and FlowSpec rules in the table
+func (r *RIB) Len() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.routes)
+}
+
+// LenFamilies returns the number of routes in the table for each family
+func (r *RIB) LenFamilies() [familyCount]int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.counts
+}
+
+// LenAfter returns the number of prefixes and FlowSpec rules the table would
+// hold after applying a RouteData, without applying it
+func (r *RIB) LenAfter(data *common.RouteData) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	present := map[string]bool{}
+	withdrawn, announced := changes(data)
+	for _, entry := range withdrawn {
+		present[entry.key()] = false
+	}
+	for _, entry := range announced {
+		present[entry.key()] = true
+	}
+	n := len(r.routes)
+	for key, after := range present {
+		_, before := r.routes[key]
+		if after && !before {
+			n++
+		} else if !after && before {
+			n--
+		}
+	}
+	return n
+}
+
+// Routes returns the table as RouteData, one per group of prefixes and
+// FlowSpec rules that were announced with the same attributes
+func (r *RIB) Routes() []common.RouteData {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	keys := make([]string, 0, len(r.routes))
+	for key := range r.routes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	groups := map[*common.RouteData]int{}
+	routes := []common.RouteData{}
+	for _, key := range keys {
+		entry := r.routes[key]
+		i, ok := groups[entry.attrs]
+		if !ok {
+			i = len(routes)
+			groups[entry.attrs] = i
+			routes = append(routes, *entry.attrs)
+		}
+		if entry.flowSpec != nil {
+			routes[i].FlowSpec = append(routes[i].FlowSpec, *entry.flowSpec)
+			continue
+		}
+		routes[i].Prefixes = append(routes[i].Prefixes, entry.nlri)
+	}
+	return routes
+}
@@ -0,0 +1,375 @@
+package bgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/bgptools/fgbgp/messages"
+	"github.com/hamptonmoore/bgp.exposed/backend/common"
+	"github.com/hamptonmoore/bgp.exposed/backend/metrics"
+)
+
+const (
+	defaultRobustnessWait = 5
+	maxRobustnessWait     = 60
+	// reestablishWait is how long to wait for the session to come back after
+	// a test reset it
+	reestablishWait = 2 * time.Minute
+)
+
+// probe is the route the robustness tests announce, in wire format
+type probe struct {
+	prefix  []byte // Length and prefix octets as in the NLRI
+	nextHop net.IP
+	asn     uint32
+	as4     bool
+	addPath bool
+}
+
+func attribute(flags byte, code byte, value []byte) []byte {
+	if len(value) > 255 {
+		b := []byte{flags | 0x10, code, 0, 0}
+		binary.BigEndian.PutUint16(b[2:], uint16(len(value)))
+		return append(b, value...)
+	}
+	return append([]byte{flags, code, byte(len(value))}, value...)
+}
+
+func (p probe) origin() []byte {
+	return attribute(0x40, 1, []byte{0})
+}
+
+func (p probe) asPath() []byte {
+	if p.as4 {
+		return attribute(0x40, 2, []byte{2, 1, byte(p.asn >> 24), byte(p.asn >> 16), byte(p.asn >> 8), byte(p.asn)})
+	}
+	return attribute(0x40, 2, []byte{2, 1, byte(p.asn >> 8), byte(p.asn)})
+}
+
+func (p probe) nextHopAttr() []byte {
+	return attribute(0x40, 3, p.nextHop.To4())
+}
+
+func (p probe) nlri() []byte {
+	if p.addPath {
+		return append([]byte{0, 0, 0, 0}, p.prefix...)
+	}
+	return p.prefix
+}
+
+// update builds an UPDATE message from its parts, without checking them
+func (p probe) update(withdrawn []byte, attrs [][]byte, nlri []byte) []byte {
+	body := &bytes.Buffer{}
+	binary.Write(body, binary.BigEndian, uint16(len(withdrawn)))
+	body.Write(withdrawn)
+	pa := bytes.Join(attrs, nil)
+	binary.Write(body, binary.BigEndian, uint16(len(pa)))
+	body.Write(pa)
+	body.Write(nlri)
+
+	msg := &bytes.Buffer{}
+	messages.WriteBGPHeader(messages.MESSAGE_UPDATE, uint16(body.Len()), msg)
+	msg.Write(body.Bytes())
+	return msg.Bytes()
+}
+
+func (p probe) announce() []byte {
+	return p.update(nil, [][]byte{p.origin(), p.asPath(), p.nextHopAttr()}, p.nlri())
+}
+
+func (p probe) withdraw() []byte {
+	return p.update(p.nlri(), nil, nil)
+}
+
+// robustnessTest is a malformed UPDATE and how RFC 7606 says to handle it
+type robustnessTest struct {
+	name        string
+	description string
+	expected    string
+	craft       func(p probe) []byte
+}
+
+var robustnessTests = []robustnessTest{
+	{
+		name:        "attribute-length",
+		description: "ORIGIN with a length of 2 instead of 1",
+		expected:    common.OutcomeTreatAsWithdraw,
+		craft: func(p probe) []byte {
+			return p.update(nil, [][]byte{attribute(0x40, 1, []byte{0, 0}), p.asPath(), p.nextHopAttr()}, p.nlri())
+		},
+	},
+	{
+		name:        "duplicate-attribute",
+		description: "ORIGIN twice, all but the first should be discarded",
+		expected:    common.OutcomeAccepted,
+		craft: func(p probe) []byte {
+			return p.update(nil, [][]byte{p.origin(), attribute(0x40, 1, []byte{2}), p.asPath(), p.nextHopAttr()}, p.nlri())
+		},
+	},
+	{
+		name:        "well-known-flags",
+		description: "ORIGIN flagged optional",
+		expected:    common.OutcomeTreatAsWithdraw,
+		craft: func(p probe) []byte {
+			return p.update(nil, [][]byte{attribute(0xc0, 1, []byte{0}), p.asPath(), p.nextHopAttr()}, p.nlri())
+		},
+	},
+	{
+		name:        "missing-mandatory",
+		description: "NEXT_HOP left out",
+		expected:    common.OutcomeTreatAsWithdraw,
+		craft: func(p probe) []byte {
+			return p.update(nil, [][]byte{p.origin(), p.asPath()}, p.nlri())
+		},
+	},
+	{
+		name:        "truncated-nlri",
+		description: "NLRI ending partway through the prefix",
+		expected:    common.OutcomeSessionReset,
+		craft: func(p probe) []byte {
+			nlri := p.nlri()
+			truncated := append([]byte{}, nlri[:len(nlri)-len(p.prefix)]...)
+			// A prefix length of 24 with only one octet of prefix after it
+			truncated = append(truncated, 24, p.prefix[1])
+			return p.update(nil, [][]byte{p.origin(), p.asPath(), p.nextHopAttr()}, truncated)
+		},
+	},
+}
+
+// rawMessage is a message written to the connection exactly as given,
+// bypassing fgbgp's encoding
+type rawMessage []byte
+
+func (r rawMessage) String() string {
+	return fmt.Sprintf("raw message %x", []byte(r))
+}
+
+func (r rawMessage) Len() int {
+	return len(r)
+}
+
+func (r rawMessage) Write(w io.Writer) {
+	w.Write(r)
+}
+
+// sendRaw queues a message for the peer as is, reporting whether the session
+// was up to send it
+func (p *Peer) sendRaw(msg []byte) bool {
+	n := p.neighbor()
+	if n == nil || p.State() != "Established" {
+		return false
+	}
+	n.OutQueue <- rawMessage(msg)
+	p.logMessage("sent", msg, false)
+	metrics.UpdatesSent.Inc()
+	return true
+}
+
+// lastSeq returns the sequence number of the most recent event
+func (p *Peer) lastSeq() uint64 {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	return p.events.seq
+}
+
+// RunRobustness checks a RobustnessRequest and starts sending the peer its
+// malformed UPDATEs, reporting a RobustnessResult to the clients after each
+func (p *Peer) RunRobustness(request common.RobustnessRequest) error {
+	if !p.Server.AllowRobustness {
+		return errors.New("Robustness tests are disabled on this server")
+	}
+	ip, prefix, err := net.ParseCIDR(request.Prefix)
+	if err != nil || ip.To4() == nil {
+		return fmt.Errorf("Probe prefix %q isn't an IPv4 prefix", request.Prefix)
+	}
+	// The truncated-nlri test keeps the first octet of the prefix
+	if ones, _ := prefix.Mask.Size(); ones < 8 {
+		return fmt.Errorf("Probe prefix %s is shorter than a /8", prefix)
+	}
+	tests := robustnessTests
+	if len(request.Tests) > 0 {
+		tests = nil
+		for _, name := range request.Tests {
+			found := false
+			for _, test := range robustnessTests {
+				if test.name == name {
+					tests = append(tests, test)
+					found = true
+				}
+			}
+			if !found {
+				return fmt.Errorf("Unknown robustness test %q, use one of: %s", name, robustnessTestNames())
+			}
+		}
+	}
+	var nextHop net.IP
+	if request.NextHop != "" {
+		nextHop = net.ParseIP(request.NextHop).To4()
+		if nextHop == nil {
+			return fmt.Errorf("Next hop %q isn't an IPv4 address", request.NextHop)
+		}
+	}
+	wait := request.Wait
+	if wait == 0 {
+		wait = defaultRobustnessWait
+	}
+	if wait > maxRobustnessWait {
+		wait = maxRobustnessWait
+	}
+
+	p.stateLock.Lock()
+	if p.robustness {
+		p.stateLock.Unlock()
+		return errors.New("Robustness tests are already running")
+	}
+	p.robustness = true
+	p.stateLock.Unlock()
+
+	ones, _ := prefix.Mask.Size()
+	pr := probe{
+		prefix:  append([]byte{byte(ones)}, prefix.IP.To4()[:(ones+7)/8]...),
+		nextHop: nextHop,
+		asn:     p.LocalASN,
+	}
+	p.LogAction("robustness", fmt.Sprintf("Started %d robustness tests with %s", len(tests), prefix))
+	go p.runRobustness(pr, prefix.String(), tests, time.Duration(wait)*time.Second)
+	return nil
+}
+
+func (p *Peer) runRobustness(pr probe, prefix string, tests []robustnessTest, wait time.Duration) {
+	defer func() {
+		p.stateLock.Lock()
+		p.robustness = false
+		p.stateLock.Unlock()
+	}()
+
+	matched := 0
+	for _, test := range tests {
+		result := p.robustnessTest(pr, prefix, test, wait)
+		if p.Context.Err() != nil {
+			return
+		}
+		if result.Outcome == result.Expected {
+			matched++
+		}
+		msg := fmt.Sprintf("Robustness test %s: %s, RFC 7606 expects %s", test.name, result.Outcome, result.Expected)
+		if result.Detail != "" {
+			msg += " (" + result.Detail + ")"
+		}
+		p.Log(msg)
+		p.SendChan <- &common.Packet{
+			Type: "RobustnessResult",
+			Data: result,
+		}
+	}
+	p.Log(fmt.Sprintf("Robustness tests finished, %d of %d handled as RFC 7606 expects", matched, len(tests)))
+}
+
+// robustnessTest announces the probe, sends the malformed UPDATE and watches
+// what the peer does. Whether the peer kept or dropped the route is only
+// visible if it announces the probe back to us.
+func (p *Peer) robustnessTest(pr probe, prefix string, test robustnessTest, wait time.Duration) common.RobustnessResult {
+	result := common.RobustnessResult{
+		Test:        test.name,
+		Description: test.description,
+		Expected:    test.expected,
+	}
+	if !p.waitEstablished(reestablishWait) {
+		result.Outcome = common.OutcomeSkipped
+		result.Detail = "the session isn't established"
+		return result
+	}
+
+	n := p.neighbor()
+	if n == nil {
+		result.Outcome = common.OutcomeSkipped
+		result.Detail = "the session went down before the test"
+		return result
+	}
+	pr.as4 = !n.Peer2Bytes
+	pr.addPath = messages.InAfiSafi(messages.AFI_IPV4, messages.SAFI_UNICAST, n.SendAddPath)
+	if pr.nextHop == nil {
+		ip, _ := n.GetLocalAddress()
+		pr.nextHop = ip.To4()
+		if pr.nextHop == nil {
+			result.Outcome = common.OutcomeSkipped
+			result.Detail = "the session isn't over IPv4, give a next hop"
+			return result
+		}
+	}
+	nlri := common.NLRI{Prefix: prefix}
+
+	p.sendRaw(pr.announce())
+	p.sleep(wait)
+	echoed := p.Received.Has(nlri)
+
+	seq := p.lastSeq()
+	if !p.sendRaw(test.craft(pr)) {
+		result.Outcome = common.OutcomeSkipped
+		result.Detail = "the session went down before the test"
+		return result
+	}
+	deadline := time.Now().Add(wait)
+	for time.Now().Before(deadline) && p.State() == "Established" && p.Context.Err() == nil {
+		p.sleep(100 * time.Millisecond)
+	}
+
+	if p.State() != "Established" {
+		result.Outcome = common.OutcomeSessionReset
+		result.Detail = "the session went down"
+		for _, event := range p.Events(common.EventQuery{After: seq, Kinds: []string{common.EventMessage}}) {
+			if event.Direction == "received" && event.MessageType == "NOTIFICATION" {
+				result.Detail = event.Message
+			}
+		}
+		return result
+	}
+	switch {
+	case !echoed:
+		result.Outcome = common.OutcomeNoReset
+		result.Detail = "the peer didn't announce the probe back"
+	case p.Received.Has(nlri):
+		result.Outcome = common.OutcomeAccepted
+	default:
+		result.Outcome = common.OutcomeTreatAsWithdraw
+	}
+	p.sendRaw(pr.withdraw())
+	p.sleep(wait)
+	return result
+}
+
+// waitEstablished waits for the session to be established, reporting whether
+// it was within the timeout
+func (p *Peer) waitEstablished(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for p.State() != "Established" {
+		if time.Now().After(deadline) || p.Context.Err() != nil {
+			return false
+		}
+		p.sleep(time.Second)
+	}
+	return true
+}
+
+// sleep waits unless the session is closed first
+func (p *Peer) sleep(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-p.Context.Done():
+	}
+}
+
+// robustnessTestNames lists the tests for error messages
+func robustnessTestNames() string {
+	names := []string{}
+	for _, test := range robustnessTests {
+		names = append(names, test.name)
+	}
+	return strings.Join(names, ", ")
+}
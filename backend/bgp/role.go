@@ -0,0 +1,129 @@
+package bgp
+
+import (
+	"fmt"
+
+	"github.com/bgptools/fgbgp/messages"
+	"github.com/hamptonmoore/bgp.exposed/backend/common"
+)
+
+// BGP Role capability and Only to Customer attribute, RFC 9234
+const (
+	capRole = 9
+	attrOTC = 35
+)
+
+// OPEN Message Error subcode from RFC 9234
+const openRoleMismatch = 11
+
+// peerRoles maps each of our roles to the only role the peer may have
+var peerRoles = map[string]string{
+	common.RoleProvider: common.RoleCustomer,
+	common.RoleCustomer: common.RoleProvider,
+	common.RoleRS:       common.RoleRSClient,
+	common.RoleRSClient: common.RoleRS,
+	common.RolePeer:     common.RolePeer,
+}
+
+// openRoles returns the values of the Role capabilities in a peer's OPEN
+func openRoles(open *messages.BGPMessageOpen) []byte {
+	roles := []byte{}
+	for _, param := range open.Parameters {
+		capabilities, ok := param.Data.(messages.BGPCapabilities)
+		if !ok {
+			continue
+		}
+		for _, capability := range capabilities.BGPCapabilities {
+			if c, ok := capability.(messages.BGPCapability); ok && c.Type == capRole && len(c.Data) == 1 {
+				roles = append(roles, c.Data[0])
+			}
+		}
+	}
+	return roles
+}
+
+// roleCapability returns the Role capability advertising a role, or nil when
+// no role is set
+func roleCapability(role string) messages.BGPCapabilityIf {
+	code, ok := common.RoleCode(role)
+	if !ok {
+		return nil
+	}
+	return messages.BGPCapability{Type: capRole, Data: []byte{code}}
+}
+
+// checkRole compares the roles in the peer's OPEN with ours as described in
+// RFC 9234 section 4.2. It returns the peer's role, empty when either side
+// has none, or why the roles are a mismatch.
+func (p *Peer) checkRole(open *messages.BGPMessageOpen) (string, error) {
+	if p.role == "" {
+		return "", nil
+	}
+	roles := openRoles(open)
+	if len(roles) == 0 {
+		if p.roleStrict {
+			return "", fmt.Errorf("the peer doesn't advertise a BGP Role, which strict mode requires")
+		}
+		return "", nil
+	}
+	for _, role := range roles[1:] {
+		if role != roles[0] {
+			return "", fmt.Errorf("the peer advertises the BGP Roles %s and %s", common.RoleName(roles[0]), common.RoleName(role))
+		}
+	}
+	role := common.RoleName(roles[0])
+	if peerRoles[p.role] != role {
+		return "", fmt.Errorf("the peer's BGP Role %s doesn't fit our role %s, it should be %s", role, p.role, peerRoles[p.role])
+	}
+	return role, nil
+}
+
+// setPeerRole records the role the peer agreed to for the current connection
+func (p *Peer) setPeerRole(role string) {
+	p.stateLock.Lock()
+	p.peerRole = role
+	p.stateLock.Unlock()
+}
+
+// otcLeak returns why a route's OTC shows it was leaked to us, following the
+// ingress procedure of RFC 9234 section 5. Routes are only checked once both
+// sides agreed on their roles.
+func (p *Peer) otcLeak(route *common.RouteData) string {
+	p.stateLock.Lock()
+	peerRole := p.peerRole
+	p.stateLock.Unlock()
+	if route.OTC == nil || len(route.Prefixes) == 0 {
+		return ""
+	}
+	switch peerRole {
+	case common.RoleCustomer, common.RoleRSClient:
+		return fmt.Sprintf("OTC %d on a route from a %s, which may only send routes it or its customers originate", *route.OTC, peerRole)
+	case common.RolePeer:
+		if *route.OTC != p.PeerASN {
+			return fmt.Sprintf("OTC %d on a route from a lateral peer, which would have set its own ASN %d", *route.OTC, p.PeerASN)
+		}
+	}
+	return ""
+}
+
+// upstreamASPA reports whether routes from the peer get ASPA upstream
+// verification, which applies when our configured role makes the peer a
+// customer, lateral peer, route server client or route server
+func (p *Peer) upstreamASPA() bool {
+	switch p.role {
+	case common.RoleProvider, common.RolePeer, common.RoleRS, common.RoleRSClient:
+		return p.Server.ASPA != nil
+	}
+	return false
+}
+
+// verifyASPA runs ASPA upstream path verification on a received route, if it
+// applies to the peer
+func (p *Peer) verifyASPA(route *common.RouteData) *common.ASPAResult {
+	if !p.upstreamASPA() || len(route.Prefixes) == 0 {
+		return nil
+	}
+	// A transparent route server doesn't add its ASN to the path
+	result := p.Server.ASPA.VerifyUpstream(route.AsPath, p.PeerASN, p.role == common.RoleRSClient)
+	return &result
+}
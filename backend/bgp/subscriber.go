@@ -0,0 +1,179 @@
+package bgp
+
+import (
+	"time"
+
+	"github.com/bgptools/fgbgp/messages"
+	"github.com/hamptonmoore/bgp.exposed/backend/common"
+)
+
+const (
+	// recentEvents is how many of the latest events a reattaching client gets
+	recentEvents = 100
+	// subscriberQueue is how many packets a client may fall behind before
+	// it's dropped
+	subscriberQueue = 512
+)
+
+// Subscriber is a websocket client receiving the packets a peer sends. Each
+// session has at most one controller and any number of read-only observers.
+type Subscriber struct {
+	Packets  chan *common.Packet
+	ReadOnly bool
+
+	peer   *Peer
+	done   chan struct{}
+	reason string
+}
+
+// Done is closed when the subscriber is dropped by the peer, either because
+// another controller attached in its place or because it fell too far behind
+func (s *Subscriber) Done() <-chan struct{} {
+	return s.done
+}
+
+// Reason says why the subscriber was dropped, once Done is closed
+func (s *Subscriber) Reason() string {
+	return s.reason
+}
+
+// Report sends an error to just this client, in order with the packets it
+// gets from the peer, and records it in the session's event log
+func (s *Subscriber) Report(err common.Error) {
+	s.peer.logError(err)
+	select {
+	case s.Packets <- &common.Packet{
+		Type: "Error",
+		Data: err,
+	}:
+	default:
+	}
+}
+
+// dispatch fans packets from SendChan out to every attached client, dropping
+// them while there are none. Anything dropped is still reflected in the
+// snapshot a reattaching client gets.
+func (p *Peer) dispatch() {
+	for {
+		select {
+		case packet := <-p.SendChan:
+			p.subLock.Lock()
+			for sub := range p.subscribers {
+				// A slow client mustn't hold up the session or the others
+				select {
+				case sub.Packets <- packet:
+				default:
+					log.Warnf("[dispatch %s] Client fell behind, dropping it", p.ToKey())
+					p.dropLocked(sub, "Fell too far behind the session, reattach to catch up")
+				}
+			}
+			p.subLock.Unlock()
+		case <-p.Context.Done():
+			return
+		}
+	}
+}
+
+// dropLocked removes a subscriber, telling it why. It must be called with
+// subLock held.
+func (p *Peer) dropLocked(sub *Subscriber, reason string) {
+	if _, ok := p.subscribers[sub]; !ok {
+		return
+	}
+	delete(p.subscribers, sub)
+	sub.reason = reason
+	close(sub.done)
+	if p.controller == sub {
+		p.controller = nil
+		p.startGraceLocked()
+	}
+}
+
+// startGraceLocked closes the session after the server's grace period unless
+// a controller attaches before then. It must be called with subLock held.
+func (p *Peer) startGraceLocked() {
+	grace := p.Server.GracePeriod
+	log.Debugf("[Detach %s] Controller detached, closing session in %s unless it reattaches", p.ToKey(), grace)
+	p.graceTimer = time.AfterFunc(grace, func() {
+		p.subLock.Lock()
+		attached := p.controller != nil
+		p.subLock.Unlock()
+		if !attached {
+			log.Infof("[Detach %s] No controller reattached, closing session", p.ToKey())
+			p.Close()
+		}
+	})
+}
+
+// Attach adds a client receiving the peer's packets and returns a snapshot of
+// the session for it to start from. A new controller replaces any previous
+// one. Packets queued before the snapshot may be delivered after it.
+func (p *Peer) Attach(readOnly bool) (*Subscriber, common.Snapshot) {
+	sub := &Subscriber{
+		Packets:  make(chan *common.Packet, subscriberQueue),
+		ReadOnly: readOnly,
+		peer:     p,
+		done:     make(chan struct{}),
+	}
+
+	p.subLock.Lock()
+	if !readOnly {
+		if p.controller != nil {
+			old := p.controller
+			p.controller = nil
+			p.dropLocked(old, "Another client took control of the session")
+		}
+		p.controller = sub
+		if p.graceTimer != nil {
+			p.graceTimer.Stop()
+			p.graceTimer = nil
+		}
+	}
+	p.subscribers[sub] = struct{}{}
+	p.subLock.Unlock()
+
+	// Nothing is dispatched until the first client attaches so it gets
+	// everything from the start
+	p.dispatchOnce.Do(func() {
+		go p.dispatch()
+	})
+
+	p.stateLock.Lock()
+	snapshot := common.Snapshot{
+		ReadOnly: readOnly,
+		FSM:      p.FSM,
+	}
+	p.stateLock.Unlock()
+	snapshot.Events = p.Events(common.EventQuery{Limit: recentEvents})
+	snapshot.Received = p.Received.Routes()
+	snapshot.Announced = p.Announced.Routes()
+	snapshot.Replay = p.replayStatus()
+
+	return sub, snapshot
+}
+
+// Detach removes a client whose websocket closed. If it was the controller
+// the session is kept for the server's grace period so it can reattach, then
+// closed.
+func (p *Peer) Detach(sub *Subscriber) {
+	p.subLock.Lock()
+	defer p.subLock.Unlock()
+	if _, ok := p.subscribers[sub]; !ok {
+		return
+	}
+	delete(p.subscribers, sub)
+	if p.controller == sub {
+		p.controller = nil
+		p.startGraceLocked()
+	}
+}
+
+// Close tears down the session
+func (p *Peer) Close() {
+	// The handler waits for the first KEEPALIVE before it watches the context
+	select {
+	case p.KeepAlive <- &messages.BGPMessageKeepAlive{}:
+	default:
+	}
+	p.Cancel()
+}
@@ -0,0 +1,478 @@
+package bgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/bgptools/fgbgp/messages"
+	fgbgp "github.com/bgptools/fgbgp/server"
+	"github.com/hamptonmoore/bgp.exposed/backend/common"
+	"github.com/hamptonmoore/bgp.exposed/backend/inspect"
+)
+
+// Handling of malformed UPDATEs from RFC 7606, from least to most severe
+const (
+	handlingNone = iota
+	handlingAttributeDiscard
+	handlingTreatAsWithdraw
+	handlingSessionReset
+)
+
+var handlingNames = map[int]string{
+	handlingAttributeDiscard: common.HandlingAttributeDiscard,
+	handlingTreatAsWithdraw:  common.HandlingTreatAsWithdraw,
+	handlingSessionReset:     common.HandlingSessionReset,
+}
+
+// UPDATE Message Error subcodes from RFC 4271
+const (
+	subcodeMalformedAttributeList = 1
+	subcodeInvalidNetworkField    = 10
+)
+
+// Optional and Transitive bits each attribute must have
+var attributeFlags = map[byte]byte{
+	1:  0x40, // ORIGIN
+	2:  0x40, // AS_PATH
+	3:  0x40, // NEXT_HOP
+	4:  0x80, // MULTI_EXIT_DISC
+	5:  0x40, // LOCAL_PREF
+	6:  0x40, // ATOMIC_AGGREGATE
+	7:  0xc0, // AGGREGATOR
+	8:  0xc0, // COMMUNITIES
+	9:  0x80, // ORIGINATOR_ID
+	10: 0x80, // CLUSTER_LIST
+	14: 0x80, // MP_REACH_NLRI
+	15: 0x80, // MP_UNREACH_NLRI
+	16: 0xc0, // EXTENDED_COMMUNITIES
+	17: 0xc0, // AS4_PATH
+	18: 0xc0, // AS4_AGGREGATOR
+	25: 0xc0, // IPV6_EXTENDED_COMMUNITIES
+	32: 0xc0, // LARGE_COMMUNITIES
+	35: 0xc0, // ONLY_TO_CUSTOMER
+}
+
+// discardOnly are attributes whose specifications have them discarded when
+// malformed, even when their flags are wrong
+var discardOnly = map[byte]bool{
+	6:  true,
+	7:  true,
+	17: true,
+	18: true,
+}
+
+// rawAttribute is a path attribute located in an UPDATE
+type rawAttribute struct {
+	flags byte
+	code  byte
+	start int // Offset of the attribute header in the UPDATE body
+	end   int
+	value []byte
+}
+
+// updateCheck is the result of checking a received UPDATE against RFC 7606
+type updateCheck struct {
+	handling  int
+	problems  []common.MalformedAttribute
+	subcode   byte              // For the NOTIFICATION if the session is reset
+	withdraw  []messages.NLRI   // Every prefix in the UPDATE, for treat-as-withdraw
+	flowSpec  []common.FlowSpec // Every FlowSpec rule in the UPDATE
+	discard   map[int]bool      // Start of each attribute to discard
+	attrStart int
+	attrEnd   int
+}
+
+func (c *updateCheck) add(handling int, attribute string, code byte, reason string, rule string) {
+	if handling > c.handling {
+		c.handling = handling
+	}
+	c.problems = append(c.problems, common.MalformedAttribute{
+		Attribute: attribute,
+		TypeCode:  code,
+		Handling:  handlingNames[handling],
+		Reason:    reason,
+		Rule:      "RFC 7606 section " + rule,
+	})
+}
+
+func (c *updateCheck) reset(subcode byte, attribute string, code byte, reason string, rule string) {
+	if c.handling < handlingSessionReset {
+		c.subcode = subcode
+	}
+	c.add(handlingSessionReset, attribute, code, reason, rule)
+}
+
+func (c *updateCheck) attributeProblem(handling int, attr rawAttribute, reason string, rule string) {
+	if handling == handlingAttributeDiscard {
+		c.discard[attr.start] = true
+	}
+	if handling == handlingSessionReset {
+		c.reset(subcodeMalformedAttributeList, inspect.AttributeName(attr.code), attr.code, reason, rule)
+		return
+	}
+	c.add(handling, inspect.AttributeName(attr.code), attr.code, reason, rule)
+}
+
+// checkUpdate checks an UPDATE body for the errors RFC 7606 handles. ebgp is
+// whether the peer is in another AS, as4 whether AS numbers are 4 octets.
+func checkUpdate(body []byte, ebgp bool, as4 bool, addPath []messages.AfiSafi) *updateCheck {
+	c := &updateCheck{discard: map[int]bool{}}
+	addPathIPv4 := messages.InAfiSafi(messages.AFI_IPV4, messages.SAFI_UNICAST, addPath)
+
+	if len(body) < 4 {
+		c.reset(subcodeMalformedAttributeList, "UPDATE", 0, fmt.Sprintf("%d byte body can't hold the length fields", len(body)), "4")
+		return c
+	}
+	withdrawnLen := int(binary.BigEndian.Uint16(body))
+	if 4+withdrawnLen > len(body) {
+		c.reset(subcodeMalformedAttributeList, "Withdrawn Routes Length", 0, fmt.Sprintf("%d runs past the message", withdrawnLen), "4")
+		return c
+	}
+	withdrawn, err := messages.ParseNLRI(body[2:2+withdrawnLen], messages.AFI_IPV4, messages.SAFI_UNICAST, addPathIPv4)
+	if err != nil {
+		c.reset(subcodeMalformedAttributeList, "Withdrawn Routes", 0, err.Error(), "5.3")
+		return c
+	}
+	c.withdraw = append(c.withdraw, withdrawn...)
+
+	c.attrStart = 4 + withdrawnLen
+	attrLen := int(binary.BigEndian.Uint16(body[2+withdrawnLen:]))
+	c.attrEnd = c.attrStart + attrLen
+	if c.attrEnd > len(body) {
+		c.reset(subcodeMalformedAttributeList, "Total Path Attribute Length", 0, fmt.Sprintf("%d runs past the message", attrLen), "4")
+		return c
+	}
+
+	nlri, err := messages.ParseNLRI(body[c.attrEnd:], messages.AFI_IPV4, messages.SAFI_UNICAST, addPathIPv4)
+	if err != nil {
+		c.reset(subcodeInvalidNetworkField, "NLRI", 0, err.Error(), "5.3")
+		return c
+	}
+	c.withdraw = append(c.withdraw, nlri...)
+
+	seen := map[byte]bool{}
+	for offset := c.attrStart; offset < c.attrEnd; {
+		attr, ok := locateAttribute(body[:c.attrEnd], offset)
+		if !ok {
+			c.add(handlingTreatAsWithdraw, "Path Attributes", 0, fmt.Sprintf("attribute at offset %d runs past the Total Path Attribute Length", offset), "4")
+			// Taking the Total Path Attribute Length as right, the attribute
+			// fills the rest of the field so no other attribute follows it.
+			// The NLRI can still be located unless it is an MP_REACH_NLRI or
+			// MP_UNREACH_NLRI itself.
+			if offset+1 < c.attrEnd && (body[offset+1] == 14 || body[offset+1] == 15) {
+				code := body[offset+1]
+				c.reset(subcodeMalformedAttributeList, inspect.AttributeName(code), code, "runs past the Total Path Attribute Length, its NLRI can't be located", "5.3")
+			}
+			break
+		}
+		offset = attr.end
+
+		if seen[attr.code] {
+			if attr.code == 14 || attr.code == 15 {
+				c.attributeProblem(handlingSessionReset, attr, "appears more than once", "3(g)")
+			} else {
+				c.attributeProblem(handlingAttributeDiscard, attr, "appears more than once, only the first is kept", "3(g)")
+			}
+			continue
+		}
+		seen[attr.code] = true
+
+		if expected, ok := attributeFlags[attr.code]; ok && attr.flags&0xc0 != expected {
+			handling := handlingTreatAsWithdraw
+			if discardOnly[attr.code] {
+				handling = handlingAttributeDiscard
+			}
+			c.attributeProblem(handling, attr, fmt.Sprintf("flags 0x%02x, Optional and Transitive should be 0x%02x", attr.flags&0xc0, expected), "3(c)")
+			// Their prefixes are still needed to withdraw them
+			if attr.code == 14 || attr.code == 15 {
+				c.checkAttribute(attr, ebgp, as4, addPath)
+			}
+			continue
+		}
+		c.checkAttribute(attr, ebgp, as4, addPath)
+	}
+
+	// Mandatory attributes only matter if something is announced
+	if len(nlri) > 0 || seen[14] {
+		for _, code := range []byte{1, 2} {
+			if !seen[code] {
+				c.add(handlingTreatAsWithdraw, inspect.AttributeName(code), code, "missing", "3(d)")
+			}
+		}
+		if len(nlri) > 0 && !seen[3] {
+			c.add(handlingTreatAsWithdraw, inspect.AttributeName(3), 3, "missing with NLRI in the NLRI field", "3(d)")
+		}
+	}
+	return c
+}
+
+func locateAttribute(b []byte, offset int) (rawAttribute, bool) {
+	if offset+3 > len(b) {
+		return rawAttribute{}, false
+	}
+	attr := rawAttribute{flags: b[offset], code: b[offset+1], start: offset}
+	header, length := 3, int(b[offset+2])
+	if attr.flags&0x10 != 0 {
+		if offset+4 > len(b) {
+			return rawAttribute{}, false
+		}
+		header, length = 4, int(binary.BigEndian.Uint16(b[offset+2:]))
+	}
+	attr.end = offset + header + length
+	if attr.end > len(b) {
+		return rawAttribute{}, false
+	}
+	attr.value = b[offset+header : attr.end]
+	return attr, true
+}
+
+// checkAttribute applies the rules of RFC 7606 section 7 and the attribute's
+// own specification to an attribute's value
+func (c *updateCheck) checkAttribute(attr rawAttribute, ebgp bool, as4 bool, addPath []messages.AfiSafi) {
+	n := len(attr.value)
+	asLen := 2
+	if as4 {
+		asLen = 4
+	}
+	switch attr.code {
+	case 1:
+		if n != 1 {
+			c.attributeProblem(handlingTreatAsWithdraw, attr, fmt.Sprintf("length %d, should be 1", n), "7.1")
+		} else if attr.value[0] > 2 {
+			c.attributeProblem(handlingTreatAsWithdraw, attr, fmt.Sprintf("undefined value %d", attr.value[0]), "7.1")
+		}
+	case 2, 17:
+		handling, rule := handlingTreatAsWithdraw, "7.2"
+		if attr.code == 17 {
+			// RFC 6793 section 6 has malformed AS4_PATHs discarded
+			asLen, handling, rule = 4, handlingAttributeDiscard, "7.2 and RFC 6793 section 6"
+		}
+		if reason := checkASPath(attr.value, asLen); reason != "" {
+			c.attributeProblem(handling, attr, reason, rule)
+		}
+	case 3:
+		if n != 4 {
+			c.attributeProblem(handlingTreatAsWithdraw, attr, fmt.Sprintf("length %d, should be 4", n), "7.3")
+		}
+	case 4:
+		if n != 4 {
+			c.attributeProblem(handlingTreatAsWithdraw, attr, fmt.Sprintf("length %d, should be 4", n), "7.4")
+		}
+	case 5:
+		if ebgp {
+			c.attributeProblem(handlingAttributeDiscard, attr, "received from an external peer", "7.5")
+		} else if n != 4 {
+			c.attributeProblem(handlingTreatAsWithdraw, attr, fmt.Sprintf("length %d, should be 4", n), "7.5")
+		}
+	case 6:
+		if n != 0 {
+			c.attributeProblem(handlingAttributeDiscard, attr, fmt.Sprintf("length %d, should be 0", n), "7.6")
+		}
+	case 7, 18:
+		expected, rule := asLen+4, "7.7"
+		if attr.code == 18 {
+			expected, rule = 8, "7.7 and RFC 6793 section 6"
+		}
+		if n != expected {
+			c.attributeProblem(handlingAttributeDiscard, attr, fmt.Sprintf("length %d, should be %d", n, expected), rule)
+		}
+	case 8:
+		if n == 0 || n%4 != 0 {
+			c.attributeProblem(handlingTreatAsWithdraw, attr, fmt.Sprintf("length %d, should be a non-zero multiple of 4", n), "7.8")
+		}
+	case 9:
+		if ebgp {
+			c.attributeProblem(handlingAttributeDiscard, attr, "received from an external peer", "7.9")
+		} else if n != 4 {
+			c.attributeProblem(handlingTreatAsWithdraw, attr, fmt.Sprintf("length %d, should be 4", n), "7.9")
+		}
+	case 10:
+		if ebgp {
+			c.attributeProblem(handlingAttributeDiscard, attr, "received from an external peer", "7.10")
+		} else if n == 0 || n%4 != 0 {
+			c.attributeProblem(handlingTreatAsWithdraw, attr, fmt.Sprintf("length %d, should be a non-zero multiple of 4", n), "7.10")
+		}
+	case 14:
+		c.checkMPReach(attr, addPath)
+	case 15:
+		c.checkMPUnreach(attr, addPath)
+	case 16:
+		if n == 0 || n%8 != 0 {
+			c.attributeProblem(handlingTreatAsWithdraw, attr, fmt.Sprintf("length %d, should be a non-zero multiple of 8", n), "7.14")
+		}
+	case 25:
+		if n == 0 || n%20 != 0 {
+			c.attributeProblem(handlingTreatAsWithdraw, attr, fmt.Sprintf("length %d, should be a non-zero multiple of 20", n), "7.14")
+		}
+	case 32:
+		if n == 0 || n%12 != 0 {
+			// RFC 8092 section 6 applies the community rules
+			c.attributeProblem(handlingTreatAsWithdraw, attr, fmt.Sprintf("length %d, should be a non-zero multiple of 12", n), "7.8 and RFC 8092 section 6")
+		}
+	case 35:
+		if n != 4 {
+			c.attributeProblem(handlingTreatAsWithdraw, attr, fmt.Sprintf("length %d, should be 4", n), "7 and RFC 9234 section 5")
+		}
+	}
+}
+
+// checkASPath returns why an AS_PATH is malformed, if it is
+func checkASPath(b []byte, asLen int) string {
+	for offset := 0; offset < len(b); {
+		if offset+2 > len(b) {
+			return "ends partway through a segment header"
+		}
+		segType, count := b[offset], int(b[offset+1])
+		if segType < 1 || segType > 4 {
+			return fmt.Sprintf("unrecognized segment type %d", segType)
+		}
+		if count == 0 {
+			return "segment with no ASNs"
+		}
+		offset += 2 + count*asLen
+		if offset > len(b) {
+			return fmt.Sprintf("segment of %d ASNs overruns the attribute", count)
+		}
+	}
+	return ""
+}
+
+// mpNLRI parses the NLRI of an address family, reporting whether they're
+// prefixes that could be parsed. NLRI of other address families are skipped.
+func mpNLRI(b []byte, afi uint16, safi byte, addPath []messages.AfiSafi) ([]messages.NLRI, error) {
+	if (afi != messages.AFI_IPV4 && afi != messages.AFI_IPV6) || (safi != messages.SAFI_UNICAST && safi != messages.SAFI_MULTICAST) {
+		return nil, nil
+	}
+	return messages.ParseNLRI(b, afi, safi, messages.InAfiSafi(afi, safi, addPath))
+}
+
+func (c *updateCheck) checkMPReach(attr rawAttribute, addPath []messages.AfiSafi) {
+	b := attr.value
+	if len(b) < 5 {
+		c.attributeProblem(handlingSessionReset, attr, fmt.Sprintf("length %d is too short for the AFI, SAFI and next hop length", len(b)), "7.11")
+		return
+	}
+	afi, safi, nextHopLen := binary.BigEndian.Uint16(b), b[2], int(b[3])
+	if 5+nextHopLen > len(b) {
+		c.attributeProblem(handlingSessionReset, attr, fmt.Sprintf("next hop length %d runs past the attribute", nextHopLen), "7.11")
+		return
+	}
+	if safi == common.SafiFlowSpec {
+		c.checkFlowSpec(attr, b[5+nextHopLen:], afi)
+		return
+	}
+	nlri, err := mpNLRI(b[5+nextHopLen:], afi, safi, addPath)
+	if err != nil {
+		c.attributeProblem(handlingSessionReset, attr, err.Error(), "5.3")
+		return
+	}
+	c.withdraw = append(c.withdraw, nlri...)
+}
+
+func (c *updateCheck) checkMPUnreach(attr rawAttribute, addPath []messages.AfiSafi) {
+	b := attr.value
+	if len(b) < 3 {
+		c.attributeProblem(handlingSessionReset, attr, fmt.Sprintf("length %d is too short for the AFI and SAFI", len(b)), "7.12")
+		return
+	}
+	if b[2] == common.SafiFlowSpec {
+		c.checkFlowSpec(attr, b[3:], binary.BigEndian.Uint16(b))
+		return
+	}
+	withdrawn, err := mpNLRI(b[3:], binary.BigEndian.Uint16(b), b[2], addPath)
+	if err != nil {
+		c.attributeProblem(handlingSessionReset, attr, err.Error(), "5.3")
+		return
+	}
+	c.withdraw = append(c.withdraw, withdrawn...)
+}
+
+// checkFlowSpec decodes the FlowSpec rules of an MP_REACH_NLRI or
+// MP_UNREACH_NLRI. FlowSpec NLRI are typed, so they can't be skipped when
+// malformed.
+func (c *updateCheck) checkFlowSpec(attr rawAttribute, b []byte, afi uint16) {
+	rules, err := flowSpecNLRI(b, afi)
+	if err != nil {
+		c.attributeProblem(handlingSessionReset, attr, err.Error(), "5.4")
+		return
+	}
+	c.flowSpec = append(c.flowSpec, rules...)
+}
+
+// withoutDiscarded returns the UPDATE body without the attributes being
+// discarded
+func (c *updateCheck) withoutDiscarded(body []byte) []byte {
+	attrs := &bytes.Buffer{}
+	for offset := c.attrStart; offset < c.attrEnd; {
+		attr, ok := locateAttribute(body[:c.attrEnd], offset)
+		if !ok {
+			break
+		}
+		if !c.discard[attr.start] {
+			attrs.Write(body[attr.start:attr.end])
+		}
+		offset = attr.end
+	}
+	out := &bytes.Buffer{}
+	out.Write(body[:c.attrStart-2])
+	binary.Write(out, binary.BigEndian, uint16(attrs.Len()))
+	out.Write(attrs.Bytes())
+	out.Write(body[c.attrEnd:])
+	return out.Bytes()
+}
+
+// report tells the clients how a malformed UPDATE was handled and records it
+// in the event log
+func (c *updateCheck) report(p *Peer) {
+	report := common.MalformedUpdate{
+		Handling: handlingNames[c.handling],
+		Problems: c.problems,
+	}
+	if c.handling == handlingTreatAsWithdraw {
+		report.Withdrawn = RouteDataFromUpdate(&messages.BGPMessageUpdate{WithdrawnRoutes: c.withdraw}).Withdraws
+		report.WithdrawnFlowSpec = c.flowSpec
+	}
+	reasons := []string{}
+	for _, problem := range c.problems {
+		reasons = append(reasons, fmt.Sprintf("%s %s (%s, %s)", problem.Attribute, problem.Reason, problem.Handling, problem.Rule))
+	}
+	p.logError(common.Error{
+		Code:    common.ErrMalformed,
+		Message: fmt.Sprintf("Malformed UPDATE handled with %s: %s", report.Handling, strings.Join(reasons, "; ")),
+	})
+	p.SendChan <- &common.Packet{
+		Type: "MalformedUpdate",
+		Data: report,
+	}
+}
+
+// handleMalformed applies RFC 7606 to an UPDATE body, returning the body to
+// parse or nil if nothing more should be done with it
+func (s *BGPServer) handleMalformed(body []byte, n *fgbgp.Neighbor) []byte {
+	peer, ok := s.GetPeerFromNeigh(n)
+	if !ok {
+		return body
+	}
+	c := checkUpdate(body, peer.PeerASN != peer.LocalASN, !n.Peer2Bytes, n.DecodeAddPath)
+	if c.handling == handlingNone {
+		return body
+	}
+	log.Infof("[handleMalformed %s] Malformed UPDATE message: %+v", neighborToKey(n), c.problems)
+	c.report(peer)
+
+	switch c.handling {
+	case handlingSessionReset:
+		peer.setDownEvent(eventUpdateMsgErr)
+		s.notify(n, 3, c.subcode, nil)
+		return nil
+	case handlingTreatAsWithdraw:
+		withdraw := &messages.BGPMessageUpdate{WithdrawnRoutes: c.withdraw}
+		data := RouteDataFromUpdate(withdraw)
+		data.FlowSpecWithdraws = c.flowSpec
+		s.receiveUpdate(withdraw, data, n)
+		return nil
+	}
+	return c.withoutDiscarded(body)
+}
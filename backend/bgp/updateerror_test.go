@@ -0,0 +1,176 @@
+package bgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// updateBody builds an UPDATE body from its parts, without checking them
+func updateBody(withdrawn []byte, attrs [][]byte, nlri []byte) []byte {
+	body := &bytes.Buffer{}
+	binary.Write(body, binary.BigEndian, uint16(len(withdrawn)))
+	body.Write(withdrawn)
+	pa := bytes.Join(attrs, nil)
+	binary.Write(body, binary.BigEndian, uint16(len(pa)))
+	body.Write(pa)
+	body.Write(nlri)
+	return body.Bytes()
+}
+
+var (
+	testOrigin  = attribute(0x40, 1, []byte{0})
+	testASPath  = attribute(0x40, 2, []byte{2, 1, 0, 0, 0xfd, 0xe9})
+	testNextHop = attribute(0x40, 3, []byte{192, 0, 2, 1})
+	testNLRI    = []byte{24, 203, 0, 113}
+	// 2001:db8::/32 with a next hop of 2001:db8::1
+	testMPReach = attribute(0x80, 14, []byte{
+		0, 2, 1, 16,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+		0,
+		32, 0x20, 0x01, 0x0d, 0xb8,
+	})
+	// 2001:db8:1::/48
+	testMPUnreach = attribute(0x80, 15, []byte{0, 2, 1, 48, 0x20, 0x01, 0x0d, 0xb8, 0, 1})
+)
+
+// announce returns the UPDATE body of a well formed announcement of testNLRI
+// with extra attributes after the mandatory ones
+func announce(extra ...[]byte) []byte {
+	return updateBody(nil, append([][]byte{testOrigin, testASPath, testNextHop}, extra...), testNLRI)
+}
+
+func TestCheckUpdate(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		body      []byte
+		ibgp      bool
+		handling  int
+		subcode   byte // Checked on session reset
+		withdrawn int  // Prefixes withdrawn, checked on treat-as-withdraw
+	}{
+		{name: "well formed", body: announce()},
+		{name: "withdraw only", body: updateBody(testNLRI, nil, nil)},
+		{name: "well formed MP_REACH_NLRI", body: updateBody(nil, [][]byte{testOrigin, testASPath, testMPReach}, nil)},
+
+		// Section 4, the message can't be parsed
+		{name: "body too short", body: []byte{0, 0}, handling: handlingSessionReset, subcode: subcodeMalformedAttributeList},
+		{name: "withdrawn length overrun", body: []byte{0, 9, 24, 203, 0, 113, 0, 0}, handling: handlingSessionReset, subcode: subcodeMalformedAttributeList},
+		{name: "malformed withdrawn routes", body: updateBody([]byte{24, 203}, nil, nil), handling: handlingSessionReset, subcode: subcodeMalformedAttributeList},
+		{name: "total attribute length overrun", body: []byte{0, 0, 0, 40, 0x40, 1, 1, 0}, handling: handlingSessionReset, subcode: subcodeMalformedAttributeList},
+		{name: "truncated NLRI", body: updateBody(nil, [][]byte{testOrigin, testASPath, testNextHop}, []byte{24, 203}), handling: handlingSessionReset, subcode: subcodeInvalidNetworkField},
+		{
+			name:      "attribute overrun",
+			body:      announce([]byte{0xc0, 8, 8, 0, 0, 0, 1}),
+			handling:  handlingTreatAsWithdraw,
+			withdrawn: 1,
+		},
+		{
+			name:      "attribute header overrun",
+			body:      announce([]byte{0xc0}),
+			handling:  handlingTreatAsWithdraw,
+			withdrawn: 1,
+		},
+		{
+			name:      "attribute overrun after the MP attributes",
+			body:      updateBody(nil, [][]byte{testOrigin, testASPath, testMPReach, testMPUnreach, {0xc0, 8, 8, 0}}, nil),
+			handling:  handlingTreatAsWithdraw,
+			withdrawn: 2,
+		},
+		{
+			name:     "MP_REACH_NLRI overrun",
+			body:     updateBody(nil, [][]byte{testOrigin, testASPath, testMPReach[:len(testMPReach)-2]}, nil),
+			handling: handlingSessionReset,
+			subcode:  subcodeMalformedAttributeList,
+		},
+
+		// Section 3
+		{name: "bad flags", body: updateBody(nil, [][]byte{attribute(0xc0, 1, []byte{0}), testASPath, testNextHop}, testNLRI), handling: handlingTreatAsWithdraw, withdrawn: 1},
+		{name: "bad flags on a discard only attribute", body: announce(attribute(0x40, 7, []byte{0, 0, 0xfd, 0xe9, 192, 0, 2, 1})), handling: handlingAttributeDiscard},
+		{
+			name:      "bad flags on MP_UNREACH_NLRI",
+			body:      updateBody(nil, [][]byte{append([]byte{0xc0}, testMPUnreach[1:]...)}, nil),
+			handling:  handlingTreatAsWithdraw,
+			withdrawn: 1,
+		},
+		{name: "missing ORIGIN", body: updateBody(nil, [][]byte{testASPath, testNextHop}, testNLRI), handling: handlingTreatAsWithdraw, withdrawn: 1},
+		{name: "missing NEXT_HOP", body: updateBody(nil, [][]byte{testOrigin, testASPath}, testNLRI), handling: handlingTreatAsWithdraw, withdrawn: 1},
+		{name: "missing AS_PATH with MP_REACH_NLRI", body: updateBody(nil, [][]byte{testOrigin, testMPReach}, nil), handling: handlingTreatAsWithdraw, withdrawn: 1},
+		{name: "duplicate attribute", body: announce(testOrigin), handling: handlingAttributeDiscard},
+		{name: "duplicate MP_REACH_NLRI", body: updateBody(nil, [][]byte{testOrigin, testASPath, testMPReach, testMPReach}, nil), handling: handlingSessionReset, subcode: subcodeMalformedAttributeList},
+
+		// Section 7
+		{name: "ORIGIN length", body: updateBody(nil, [][]byte{attribute(0x40, 1, []byte{0, 0}), testASPath, testNextHop}, testNLRI), handling: handlingTreatAsWithdraw, withdrawn: 1},
+		{name: "ORIGIN value", body: updateBody(nil, [][]byte{attribute(0x40, 1, []byte{3}), testASPath, testNextHop}, testNLRI), handling: handlingTreatAsWithdraw, withdrawn: 1},
+		{name: "AS_PATH segment overrun", body: updateBody(nil, [][]byte{testOrigin, attribute(0x40, 2, []byte{2, 2, 0, 0, 0xfd, 0xe9}), testNextHop}, testNLRI), handling: handlingTreatAsWithdraw, withdrawn: 1},
+		{name: "AS_PATH segment type", body: updateBody(nil, [][]byte{testOrigin, attribute(0x40, 2, []byte{5, 1, 0, 0, 0xfd, 0xe9}), testNextHop}, testNLRI), handling: handlingTreatAsWithdraw, withdrawn: 1},
+		{name: "malformed AS4_PATH", body: announce(attribute(0xc0, 17, []byte{2, 1, 0, 0})), handling: handlingAttributeDiscard},
+		{name: "NEXT_HOP length", body: updateBody(nil, [][]byte{testOrigin, testASPath, attribute(0x40, 3, []byte{192, 0, 2})}, testNLRI), handling: handlingTreatAsWithdraw, withdrawn: 1},
+		{name: "LOCAL_PREF from an external peer", body: announce(attribute(0x40, 5, []byte{0, 0, 0, 100})), handling: handlingAttributeDiscard},
+		{name: "LOCAL_PREF length", body: announce(attribute(0x40, 5, []byte{0, 100})), ibgp: true, handling: handlingTreatAsWithdraw, withdrawn: 1},
+		{name: "ATOMIC_AGGREGATE length", body: announce(attribute(0x40, 6, []byte{0})), handling: handlingAttributeDiscard},
+		{name: "AGGREGATOR length", body: announce(attribute(0xc0, 7, []byte{0xfd, 0xe9, 192, 0, 2, 1})), handling: handlingAttributeDiscard},
+		{name: "COMMUNITIES length", body: announce(attribute(0xc0, 8, []byte{0, 0, 1})), handling: handlingTreatAsWithdraw, withdrawn: 1},
+		{name: "LARGE_COMMUNITIES length", body: announce(attribute(0xc0, 32, make([]byte, 11))), handling: handlingTreatAsWithdraw, withdrawn: 1},
+		{name: "ONLY_TO_CUSTOMER length", body: announce(attribute(0xc0, 35, []byte{0, 0, 1})), handling: handlingTreatAsWithdraw, withdrawn: 1},
+		{name: "MP_REACH_NLRI too short", body: updateBody(nil, [][]byte{testOrigin, testASPath, attribute(0x80, 14, []byte{0, 2, 1, 16})}, nil), handling: handlingSessionReset, subcode: subcodeMalformedAttributeList},
+		{name: "MP_REACH_NLRI next hop overrun", body: updateBody(nil, [][]byte{testOrigin, testASPath, attribute(0x80, 14, []byte{0, 2, 1, 16, 0x20, 0x01, 0})}, nil), handling: handlingSessionReset, subcode: subcodeMalformedAttributeList},
+		{name: "MP_REACH_NLRI malformed NLRI", body: updateBody(nil, [][]byte{testOrigin, testASPath, attribute(0x80, 14, append(append([]byte{}, testMPReach[3:len(testMPReach)-5]...), 64, 0x20, 0x01))}, nil), handling: handlingSessionReset, subcode: subcodeMalformedAttributeList},
+		{name: "MP_UNREACH_NLRI too short", body: updateBody(nil, [][]byte{attribute(0x80, 15, []byte{0, 2})}, nil), handling: handlingSessionReset, subcode: subcodeMalformedAttributeList},
+		{name: "MP_UNREACH_NLRI malformed NLRI", body: updateBody(nil, [][]byte{attribute(0x80, 15, []byte{0, 2, 1, 64, 0x20})}, nil), handling: handlingSessionReset, subcode: subcodeMalformedAttributeList},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := checkUpdate(test.body, !test.ibgp, true, nil)
+			if c.handling != test.handling {
+				t.Fatalf("handling %q, want %q: %+v", handlingNames[c.handling], handlingNames[test.handling], c.problems)
+			}
+			if c.handling == handlingSessionReset && c.subcode != test.subcode {
+				t.Errorf("subcode %d, want %d", c.subcode, test.subcode)
+			}
+			if c.handling == handlingTreatAsWithdraw && len(c.withdraw) != test.withdrawn {
+				t.Errorf("withdraws %d prefixes, want %d", len(c.withdraw), test.withdrawn)
+			}
+			if c.handling != handlingNone && len(c.problems) == 0 {
+				t.Error("no problem reported")
+			}
+		})
+	}
+}
+
+func TestCheckUpdateTwoOctet(t *testing.T) {
+	// A four-octet AS_PATH segment overruns when read with two-octet ASNs
+	path := attribute(0x40, 2, []byte{2, 2, 0xfd, 0xe9})
+	body := updateBody(nil, [][]byte{testOrigin, path, testNextHop, attribute(0xc0, 7, []byte{0xfd, 0xe9, 192, 0, 2, 1})}, testNLRI)
+	if c := checkUpdate(body, true, false, nil); c.handling != handlingTreatAsWithdraw {
+		t.Errorf("handling %q, want %q: %+v", handlingNames[c.handling], handlingNames[handlingTreatAsWithdraw], c.problems)
+	}
+	body = updateBody(nil, [][]byte{testOrigin, attribute(0x40, 2, []byte{2, 1, 0xfd, 0xe9}), testNextHop, attribute(0xc0, 7, []byte{0xfd, 0xe9, 192, 0, 2, 1})}, testNLRI)
+	if c := checkUpdate(body, true, false, nil); c.handling != handlingNone {
+		t.Errorf("two-octet AGGREGATOR handled with %q: %+v", handlingNames[c.handling], c.problems)
+	}
+}
+
+func TestWithoutDiscarded(t *testing.T) {
+	badAtomic := attribute(0x40, 6, []byte{0})
+	community := attribute(0xc0, 8, []byte{0xfd, 0xe9, 0, 1})
+	body := updateBody(nil, [][]byte{testOrigin, testASPath, testOrigin, testNextHop, badAtomic, community}, testNLRI)
+
+	c := checkUpdate(body, true, true, nil)
+	if c.handling != handlingAttributeDiscard {
+		t.Fatalf("handling %q, want %q: %+v", handlingNames[c.handling], handlingNames[handlingAttributeDiscard], c.problems)
+	}
+	want := updateBody(nil, [][]byte{testOrigin, testASPath, testNextHop, community}, testNLRI)
+	if got := c.withoutDiscarded(body); !bytes.Equal(got, want) {
+		t.Errorf("rewritten body %x, want %x", got, want)
+	}
+
+	// Withdrawn routes are kept in front of the rewritten attributes
+	body = updateBody([]byte{16, 198, 51}, [][]byte{testOrigin, testASPath, testNextHop, badAtomic}, testNLRI)
+	want = updateBody([]byte{16, 198, 51}, [][]byte{testOrigin, testASPath, testNextHop}, testNLRI)
+	if got := checkUpdate(body, true, true, nil).withoutDiscarded(body); !bytes.Equal(got, want) {
+		t.Errorf("rewritten body %x, want %x", got, want)
+	}
+	if c := checkUpdate(want, true, true, nil); c.handling != handlingNone {
+		t.Errorf("rewritten body is still malformed: %+v", c.problems)
+	}
+}
@@ -0,0 +1,368 @@
+package bmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bgptools/fgbgp/messages"
+	"github.com/sirupsen/logrus"
+)
+
+// Message types from RFC 7854 section 4.1
+const (
+	TypeRouteMonitoring  = 0
+	TypeStatisticsReport = 1
+	TypePeerDown         = 2
+	TypePeerUp           = 3
+	TypeInitiation       = 4
+	TypeTermination      = 5
+)
+
+// Peer Down reasons from RFC 7854 section 4.9
+const (
+	ReasonLocalNotification   = 1
+	ReasonLocalNoNotification = 2
+	ReasonRemoteNotification  = 3
+	ReasonRemoteNoData        = 4
+)
+
+// Statistics types from RFC 7854 section 4.8
+const (
+	StatDuplicatePrefixes  = 1
+	StatDuplicateWithdraws = 2
+	StatAdjRIBInRoutes     = 7
+)
+
+const (
+	version     = 3
+	reconnect   = 5 * time.Second
+	queueLength = 4096
+)
+
+// PeerInfo is what the per-peer header needs to know about a BGP neighbor
+type PeerInfo struct {
+	Address    net.IP
+	ASN        uint32
+	Identifier net.IP
+	TwoByteAS  bool
+}
+
+type peerState struct {
+	info   PeerInfo
+	peerUp []byte
+
+	adjRIBIn           map[string]struct{}
+	duplicatePrefixes  uint32
+	duplicateWithdraws uint32
+
+	downReason byte
+	downData   []byte
+}
+
+// Client exports sessions to a BMP collector. It reconnects whenever the
+// collector goes away, sending a fresh Initiation and a Peer Up for every
+// session that is still established. Routes received while disconnected
+// aren't replayed.
+type Client struct {
+	Addr          string
+	SysName       string
+	SysDescr      string
+	StatsInterval time.Duration
+
+	lock      sync.Mutex
+	connected bool
+	queue     chan []byte
+	peers     map[string]*peerState
+	log       *logrus.Logger
+}
+
+func NewClient(addr string, sysName string, sysDescr string, statsInterval time.Duration, log *logrus.Logger) *Client {
+	return &Client{
+		Addr:          addr,
+		SysName:       sysName,
+		SysDescr:      sysDescr,
+		StatsInterval: statsInterval,
+		queue:         make(chan []byte, queueLength),
+		peers:         make(map[string]*peerState),
+		log:           log,
+	}
+}
+
+// Start connects to the collector in the background
+func (c *Client) Start() {
+	go c.run()
+}
+
+func writeCommonHeader(buf *bytes.Buffer, msgType byte, length int) {
+	buf.WriteByte(version)
+	binary.Write(buf, binary.BigEndian, uint32(6+length))
+	buf.WriteByte(msgType)
+}
+
+func writeTLV(buf *bytes.Buffer, t uint16, value []byte) {
+	binary.Write(buf, binary.BigEndian, t)
+	binary.Write(buf, binary.BigEndian, uint16(len(value)))
+	buf.Write(value)
+}
+
+func writeAddress(buf *bytes.Buffer, ip net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		buf.Write(make([]byte, 12))
+		buf.Write(ip4)
+		return
+	}
+	buf.Write(ip.To16())
+}
+
+func writePeerHeader(buf *bytes.Buffer, info PeerInfo, ts time.Time) {
+	var flags byte
+	if info.Address.To4() == nil {
+		flags |= 0x80
+	}
+	if info.TwoByteAS {
+		flags |= 0x20
+	}
+	buf.WriteByte(0) // Global Instance Peer
+	buf.WriteByte(flags)
+	buf.Write(make([]byte, 8)) // Peer Distinguisher
+	writeAddress(buf, info.Address)
+	binary.Write(buf, binary.BigEndian, info.ASN)
+	id := info.Identifier.To4()
+	if id == nil {
+		id = make([]byte, 4)
+	}
+	buf.Write(id)
+	binary.Write(buf, binary.BigEndian, uint32(ts.Unix()))
+	binary.Write(buf, binary.BigEndian, uint32(ts.Nanosecond()/1000))
+}
+
+// message wraps a body in the common header
+func message(msgType byte, body []byte) []byte {
+	buf := &bytes.Buffer{}
+	writeCommonHeader(buf, msgType, len(body))
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+func (c *Client) initiation() []byte {
+	body := &bytes.Buffer{}
+	writeTLV(body, 1, []byte(c.SysDescr))
+	writeTLV(body, 2, []byte(c.SysName))
+	return message(TypeInitiation, body.Bytes())
+}
+
+// enqueue queues a message for the collector. It must be called with the lock
+// held so messages can't slip in while a reconnect is resyncing state.
+func (c *Client) enqueue(msg []byte) {
+	if !c.connected {
+		return
+	}
+	select {
+	case c.queue <- msg:
+	default:
+		c.log.Warnf("[BMP %s] queue full, dropping message", c.Addr)
+	}
+}
+
+// PeerUp reports a session as established along with the OPEN messages we
+// sent and received, as full BGP messages
+func (c *Client) PeerUp(key string, info PeerInfo, localAddr net.IP, localPort uint16, remotePort uint16, sentOpen []byte, recvOpen []byte) {
+	body := &bytes.Buffer{}
+	writePeerHeader(body, info, time.Now())
+	writeAddress(body, localAddr)
+	binary.Write(body, binary.BigEndian, localPort)
+	binary.Write(body, binary.BigEndian, remotePort)
+	body.Write(sentOpen)
+	body.Write(recvOpen)
+	msg := message(TypePeerUp, body.Bytes())
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.peers[key] = &peerState{
+		info:       info,
+		peerUp:     msg,
+		adjRIBIn:   make(map[string]struct{}),
+		downReason: ReasonRemoteNoData,
+	}
+	c.enqueue(msg)
+}
+
+// SetDownReason records why the session is about to go down, reported in the
+// Peer Down message once it does
+func (c *Client) SetDownReason(key string, reason byte, data []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if peer, ok := c.peers[key]; ok {
+		peer.downReason = reason
+		peer.downData = data
+	}
+}
+
+// PeerDown reports a session going down
+func (c *Client) PeerDown(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	peer, ok := c.peers[key]
+	if !ok {
+		return
+	}
+	delete(c.peers, key)
+
+	body := &bytes.Buffer{}
+	writePeerHeader(body, peer.info, time.Now())
+	body.WriteByte(peer.downReason)
+	body.Write(peer.downData)
+	c.enqueue(message(TypePeerDown, body.Bytes()))
+}
+
+func prefixKey(nlri messages.NLRI) string {
+	if prefix, ok := nlri.(messages.NLRI_IPPrefix); ok {
+		return prefix.Prefix.String() + "|" + strconv.FormatUint(uint64(prefix.PathId), 10)
+	}
+	return nlri.String()
+}
+
+// RouteMonitoring exports a received UPDATE, given as the full BGP message,
+// and tracks the peer's Adj-RIB-In for statistics
+func (c *Client) RouteMonitoring(key string, msg []byte, update *messages.BGPMessageUpdate) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	peer, ok := c.peers[key]
+	if !ok {
+		return
+	}
+
+	withdrawn := append([]messages.NLRI{}, update.WithdrawnRoutes...)
+	announced := append([]messages.NLRI{}, update.NLRI...)
+	for _, attr := range update.PathAttributes {
+		switch a := attr.(type) {
+		case messages.BGPAttribute_MP_REACH:
+			announced = append(announced, a.NLRI...)
+		case messages.BGPAttribute_MP_UNREACH:
+			withdrawn = append(withdrawn, a.NLRI...)
+		}
+	}
+	for _, nlri := range withdrawn {
+		k := prefixKey(nlri)
+		if _, ok := peer.adjRIBIn[k]; !ok {
+			peer.duplicateWithdraws++
+		}
+		delete(peer.adjRIBIn, k)
+	}
+	for _, nlri := range announced {
+		k := prefixKey(nlri)
+		if _, ok := peer.adjRIBIn[k]; ok {
+			peer.duplicatePrefixes++
+		}
+		peer.adjRIBIn[k] = struct{}{}
+	}
+
+	body := &bytes.Buffer{}
+	writePeerHeader(body, peer.info, time.Now())
+	body.Write(msg)
+	c.enqueue(message(TypeRouteMonitoring, body.Bytes()))
+}
+
+func (c *Client) statistics() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, peer := range c.peers {
+		body := &bytes.Buffer{}
+		writePeerHeader(body, peer.info, time.Now())
+		binary.Write(body, binary.BigEndian, uint32(3))
+
+		stat := make([]byte, 4)
+		binary.BigEndian.PutUint32(stat, peer.duplicatePrefixes)
+		writeTLV(body, StatDuplicatePrefixes, stat)
+		stat = make([]byte, 4)
+		binary.BigEndian.PutUint32(stat, peer.duplicateWithdraws)
+		writeTLV(body, StatDuplicateWithdraws, stat)
+		stat = make([]byte, 8)
+		binary.BigEndian.PutUint64(stat, uint64(len(peer.adjRIBIn)))
+		writeTLV(body, StatAdjRIBInRoutes, stat)
+
+		c.enqueue(message(TypeStatisticsReport, body.Bytes()))
+	}
+}
+
+// resync marks the client connected and returns the messages a freshly
+// connected collector needs, dropping anything queued for the old connection
+func (c *Client) resync() [][]byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for len(c.queue) > 0 {
+		<-c.queue
+	}
+	c.connected = true
+
+	msgs := [][]byte{c.initiation()}
+	for _, peer := range c.peers {
+		msgs = append(msgs, peer.peerUp)
+	}
+	return msgs
+}
+
+func (c *Client) disconnected() {
+	c.lock.Lock()
+	c.connected = false
+	c.lock.Unlock()
+}
+
+func (c *Client) run() {
+	for {
+		conn, err := net.DialTimeout("tcp", c.Addr, 10*time.Second)
+		if err != nil {
+			c.log.Warnf("[BMP %s] failed connecting to collector: %s", c.Addr, err)
+			time.Sleep(reconnect)
+			continue
+		}
+		c.log.Infof("[BMP %s] connected to collector", c.Addr)
+		c.serve(conn)
+		c.disconnected()
+		conn.Close()
+		c.log.Warnf("[BMP %s] disconnected from collector", c.Addr)
+		time.Sleep(reconnect)
+	}
+}
+
+func (c *Client) serve(conn net.Conn) {
+	for _, msg := range c.resync() {
+		if _, err := conn.Write(msg); err != nil {
+			c.log.Warnf("[BMP %s] write failed: %s", c.Addr, err)
+			return
+		}
+	}
+
+	// Collectors never send anything, so a read returning means the
+	// connection is gone
+	closed := make(chan struct{})
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(c.StatsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg := <-c.queue:
+			if _, err := conn.Write(msg); err != nil {
+				c.log.Warnf("[BMP %s] write failed: %s", c.Addr, err)
+				return
+			}
+		case <-ticker.C:
+			c.statistics()
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package bmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bgptools/fgbgp/messages"
+	"github.com/sirupsen/logrus"
+)
+
+// collector accepts the client's connection and reads its messages
+type collector struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func startCollector(t *testing.T) (*Client, *collector) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+	// Statistics Reports are sent by calling statistics directly so they
+	// arrive in a known order
+	c := NewClient(listener.Addr().String(), "test-name", "test-descr", time.Hour, log)
+	c.Start()
+
+	listener.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return c, &collector{t: t, conn: conn}
+}
+
+// read returns the body of the next message after checking its common header
+func (col *collector) read(msgType byte) []byte {
+	col.t.Helper()
+	col.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(col.conn, header); err != nil {
+		col.t.Fatalf("reading common header: %s", err)
+	}
+	if header[0] != version {
+		col.t.Fatalf("version %d, want %d", header[0], version)
+	}
+	if header[5] != msgType {
+		col.t.Fatalf("message type %d, want %d", header[5], msgType)
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length < 6 {
+		col.t.Fatalf("message length %d is shorter than the common header", length)
+	}
+	body := make([]byte, length-6)
+	if _, err := io.ReadFull(col.conn, body); err != nil {
+		col.t.Fatalf("reading message body: %s", err)
+	}
+	return body
+}
+
+// checkPeerHeader checks the per-peer header at the start of body and returns
+// the rest
+func checkPeerHeader(t *testing.T, body []byte, info PeerInfo) []byte {
+	t.Helper()
+	if len(body) < 42 {
+		t.Fatalf("body of %d octets can't hold a per-peer header", len(body))
+	}
+	if body[0] != 0 {
+		t.Errorf("peer type %d, want 0", body[0])
+	}
+	if body[1] != 0x20 {
+		t.Errorf("peer flags %#x, want 0x20 for an IPv4 peer using two-octet ASNs", body[1])
+	}
+	if !bytes.Equal(body[2:10], make([]byte, 8)) {
+		t.Errorf("peer distinguisher %x, want zero", body[2:10])
+	}
+	if want := append(make([]byte, 12), info.Address.To4()...); !bytes.Equal(body[10:26], want) {
+		t.Errorf("peer address %x, want %x", body[10:26], want)
+	}
+	if asn := binary.BigEndian.Uint32(body[26:]); asn != info.ASN {
+		t.Errorf("peer ASN %d, want %d", asn, info.ASN)
+	}
+	if !net.IP(body[30:34]).Equal(info.Identifier) {
+		t.Errorf("peer BGP ID %s, want %s", net.IP(body[30:34]), info.Identifier)
+	}
+	if seconds := binary.BigEndian.Uint32(body[34:]); seconds == 0 {
+		t.Error("timestamp isn't set")
+	}
+	return body[42:]
+}
+
+func bgpMessage(msgType byte, body []byte) []byte {
+	buf := &bytes.Buffer{}
+	messages.WriteBGPHeader(msgType, uint16(len(body)), buf)
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+func stats(t *testing.T, body []byte) map[uint16][]byte {
+	t.Helper()
+	if len(body) < 4 {
+		t.Fatalf("Statistics Report of %d octets lacks the count", len(body))
+	}
+	count := binary.BigEndian.Uint32(body)
+	body = body[4:]
+	values := make(map[uint16][]byte)
+	for i := uint32(0); i < count; i++ {
+		if len(body) < 4 || len(body) < 4+int(binary.BigEndian.Uint16(body[2:])) {
+			t.Fatalf("statistic %d is truncated", i)
+		}
+		length := int(binary.BigEndian.Uint16(body[2:]))
+		values[binary.BigEndian.Uint16(body)] = body[4 : 4+length]
+		body = body[4+length:]
+	}
+	if len(body) != 0 {
+		t.Errorf("%d octets left after %d statistics", len(body), count)
+	}
+	return values
+}
+
+func TestClient(t *testing.T) {
+	c, col := startCollector(t)
+
+	body := col.read(TypeInitiation)
+	want := &bytes.Buffer{}
+	writeTLV(want, 1, []byte("test-descr"))
+	writeTLV(want, 2, []byte("test-name"))
+	if !bytes.Equal(body, want.Bytes()) {
+		t.Errorf("Initiation TLVs %x, want %x", body, want.Bytes())
+	}
+
+	info := PeerInfo{
+		Address:    net.ParseIP("192.0.2.1"),
+		ASN:        65000,
+		Identifier: net.ParseIP("192.0.2.255"),
+		TwoByteAS:  true,
+	}
+	open := &bytes.Buffer{}
+	messages.CraftOpenMessage(65001, 90, net.ParseIP("198.51.100.1").To4(), nil, nil, false).Write(open)
+	sentOpen := open.Bytes()
+	open = &bytes.Buffer{}
+	messages.CraftOpenMessage(65000, 180, info.Identifier.To4(), nil, nil, true).Write(open)
+	recvOpen := open.Bytes()
+	c.PeerUp("peer", info, net.ParseIP("198.51.100.1"), 179, 50000, sentOpen, recvOpen)
+
+	body = checkPeerHeader(t, col.read(TypePeerUp), info)
+	if len(body) < 20 {
+		t.Fatalf("Peer Up of %d octets after the per-peer header", len(body))
+	}
+	if want := append(make([]byte, 12), 198, 51, 100, 1); !bytes.Equal(body[:16], want) {
+		t.Errorf("local address %x, want %x", body[:16], want)
+	}
+	if port := binary.BigEndian.Uint16(body[16:]); port != 179 {
+		t.Errorf("local port %d, want 179", port)
+	}
+	if port := binary.BigEndian.Uint16(body[18:]); port != 50000 {
+		t.Errorf("remote port %d, want 50000", port)
+	}
+	if opens := append(append([]byte{}, sentOpen...), recvOpen...); !bytes.Equal(body[20:], opens) {
+		t.Errorf("OPEN messages %x, want %x", body[20:], opens)
+	}
+
+	_, prefix, _ := net.ParseCIDR("203.0.113.0/24")
+	announce := bgpMessage(messages.MESSAGE_UPDATE, []byte{0, 0, 0, 0, 24, 203, 0, 113})
+	withdraw := bgpMessage(messages.MESSAGE_UPDATE, []byte{0, 4, 24, 203, 0, 114, 0, 0})
+	_, other, _ := net.ParseCIDR("203.0.114.0/24")
+	c.RouteMonitoring("peer", announce, &messages.BGPMessageUpdate{NLRI: []messages.NLRI{messages.NLRI_IPPrefix{Prefix: *prefix}}})
+	c.RouteMonitoring("peer", announce, &messages.BGPMessageUpdate{NLRI: []messages.NLRI{messages.NLRI_IPPrefix{Prefix: *prefix}}})
+	c.RouteMonitoring("peer", withdraw, &messages.BGPMessageUpdate{WithdrawnRoutes: []messages.NLRI{messages.NLRI_IPPrefix{Prefix: *other}}})
+	// Unknown sessions aren't exported
+	c.RouteMonitoring("unknown", announce, &messages.BGPMessageUpdate{})
+
+	for _, msg := range [][]byte{announce, announce, withdraw} {
+		body = checkPeerHeader(t, col.read(TypeRouteMonitoring), info)
+		if !bytes.Equal(body, msg) {
+			t.Errorf("Route Monitoring carries %x, want %x", body, msg)
+		}
+	}
+
+	c.statistics()
+	values := stats(t, checkPeerHeader(t, col.read(TypeStatisticsReport), info))
+	for stat, want := range map[uint16]uint64{
+		StatDuplicatePrefixes:  1,
+		StatDuplicateWithdraws: 1,
+		StatAdjRIBInRoutes:     1,
+	} {
+		value, ok := values[stat]
+		switch {
+		case !ok:
+			t.Errorf("statistic %d missing", stat)
+		case stat == StatAdjRIBInRoutes && len(value) != 8:
+			t.Errorf("statistic %d is %d octets, want a 64-bit gauge", stat, len(value))
+		case stat != StatAdjRIBInRoutes && len(value) != 4:
+			t.Errorf("statistic %d is %d octets, want a 32-bit counter", stat, len(value))
+		case len(value) == 8 && binary.BigEndian.Uint64(value) != want,
+			len(value) == 4 && uint64(binary.BigEndian.Uint32(value)) != want:
+			t.Errorf("statistic %d is %x, want %d", stat, value, want)
+		}
+	}
+
+	notification := bgpMessage(messages.MESSAGE_NOTIFICATION, []byte{6, 2})
+	c.SetDownReason("peer", ReasonLocalNotification, notification)
+	c.PeerDown("peer")
+	body = checkPeerHeader(t, col.read(TypePeerDown), info)
+	if want := append([]byte{ReasonLocalNotification}, notification...); !bytes.Equal(body, want) {
+		t.Errorf("Peer Down reason and data %x, want %x", body, want)
+	}
+
+	// Once down, the session is neither exported nor part of the statistics
+	c.PeerDown("peer")
+	c.statistics()
+	c.RouteMonitoring("peer", announce, &messages.BGPMessageUpdate{})
+	col.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, _ := col.conn.Read(make([]byte, 1)); n != 0 {
+		t.Error("message sent for a session that is down")
+	}
+}
+
+// TestResync checks a collector that reconnects gets a fresh Initiation
+// and a Peer Up for sessions that are still established
+func TestResync(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+	c := NewClient("127.0.0.1:0", "name", "descr", time.Hour, log)
+	info := PeerInfo{Address: net.ParseIP("192.0.2.1"), ASN: 65000, Identifier: net.ParseIP("192.0.2.255")}
+
+	// Nothing is queued while disconnected, but the Peer Up is kept
+	c.PeerUp("peer", info, net.ParseIP("198.51.100.1"), 179, 50000, nil, nil)
+	if len(c.queue) != 0 {
+		t.Fatalf("%d messages queued while disconnected", len(c.queue))
+	}
+
+	msgs := c.resync()
+	if len(msgs) != 2 {
+		t.Fatalf("resync returned %d messages, want an Initiation and a Peer Up", len(msgs))
+	}
+	if msgs[0][5] != TypeInitiation || msgs[1][5] != TypePeerUp {
+		t.Errorf("resync returned message types %d and %d, want %d and %d", msgs[0][5], msgs[1][5], TypeInitiation, TypePeerUp)
+	}
+}
@@ -0,0 +1,154 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/bgptools/fgbgp/messages"
+)
+
+// AS_PATH segment types from RFC 4271 and RFC 5065
+const (
+	SegmentSet            = "set"
+	SegmentSequence       = "sequence"
+	SegmentConfedSequence = "confed-sequence"
+	SegmentConfedSet      = "confed-set"
+)
+
+var segmentCodes = map[string]byte{
+	SegmentSet:            1,
+	SegmentSequence:       2,
+	SegmentConfedSequence: 3,
+	SegmentConfedSet:      4,
+}
+
+// MaxSegmentLength is the most ASNs a single segment can hold on the wire.
+// Longer sequences are split when encoded, longer sets can't be sent.
+const MaxSegmentLength = 255
+
+// AsPathSegment is one segment of an AS_PATH
+type AsPathSegment struct {
+	Type string   `json:"type"`
+	ASNs []uint32 `json:"asns"`
+}
+
+// AsPath is an AS_PATH as its list of segments
+type AsPath []AsPathSegment
+
+// UnmarshalJSON also accepts a plain array of ASNs, the format AS paths had
+// before segments, as a single AS_SEQUENCE
+func (a *AsPath) UnmarshalJSON(data []byte) error {
+	var asns []uint32
+	if err := json.Unmarshal(data, &asns); err == nil {
+		*a = nil
+		if len(asns) > 0 {
+			*a = AsPath{{Type: SegmentSequence, ASNs: asns}}
+		}
+		return nil
+	}
+	var segments []AsPathSegment
+	if err := json.Unmarshal(data, &segments); err != nil {
+		return err
+	}
+	*a = segments
+	return nil
+}
+
+// SegmentTypeCode returns the wire type of a segment type
+func SegmentTypeCode(t string) (byte, bool) {
+	code, ok := segmentCodes[t]
+	return code, ok
+}
+
+// SegmentTypeName returns the segment type for a wire type, unknown types are
+// kept as their number
+func SegmentTypeName(code byte) string {
+	for name, c := range segmentCodes {
+		if c == code {
+			return name
+		}
+	}
+	return strconv.Itoa(int(code))
+}
+
+// AsPathFromAttribute converts a decoded AS_PATH attribute, keeping every
+// segment
+func AsPathFromAttribute(attr messages.BGPAttribute_ASPATH) AsPath {
+	path := AsPath{}
+	for _, segment := range attr.Segments {
+		path = append(path, AsPathSegment{
+			Type: SegmentTypeName(segment.SType),
+			ASNs: append([]uint32{}, segment.ASPath...),
+		})
+	}
+	return path
+}
+
+// Validate checks that every segment has a known type and can be encoded
+func (a AsPath) Validate() error {
+	for i, segment := range a {
+		if _, ok := segmentCodes[segment.Type]; !ok {
+			return fmt.Errorf("invalid AS path, segment %d has unknown type %q", i+1, segment.Type)
+		}
+		if len(segment.ASNs) == 0 {
+			return fmt.Errorf("invalid AS path, segment %d is empty", i+1)
+		}
+		if (segment.Type == SegmentSet || segment.Type == SegmentConfedSet) && len(segment.ASNs) > MaxSegmentLength {
+			return fmt.Errorf("invalid AS path, the %s in segment %d has more than %d ASNs", segment.Type, i+1, MaxSegmentLength)
+		}
+	}
+	return nil
+}
+
+// Length returns the path length used for route selection, where an AS_SET
+// counts as one AS and confederation segments don't count
+func (a AsPath) Length() int {
+	length := 0
+	for _, segment := range a {
+		switch segment.Type {
+		case SegmentSequence:
+			length += len(segment.ASNs)
+		case SegmentSet:
+			length++
+		}
+	}
+	return length
+}
+
+// Origin returns the originating AS as defined by RFC 6811, which is only
+// known when the path ends in an AS_SEQUENCE
+func (a AsPath) Origin() (uint32, bool) {
+	if len(a) == 0 {
+		return 0, false
+	}
+	last := a[len(a)-1]
+	if last.Type != SegmentSequence || len(last.ASNs) == 0 {
+		return 0, false
+	}
+	return last.ASNs[len(last.ASNs)-1], true
+}
+
+// String formats the path the usual way, with AS_SETs in braces,
+// AS_CONFED_SEQUENCEs in parentheses and AS_CONFED_SETs in brackets
+func (a AsPath) String() string {
+	parts := []string{}
+	for _, segment := range a {
+		asns := make([]string, len(segment.ASNs))
+		for i, asn := range segment.ASNs {
+			asns[i] = strconv.FormatUint(uint64(asn), 10)
+		}
+		joined := strings.Join(asns, " ")
+		switch segment.Type {
+		case SegmentSet:
+			joined = "{" + joined + "}"
+		case SegmentConfedSequence:
+			joined = "(" + joined + ")"
+		case SegmentConfedSet:
+			joined = "[" + joined + "]"
+		}
+		parts = append(parts, joined)
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,97 @@
+package common
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/bgptools/fgbgp/messages"
+)
+
+var testPath = AsPath{
+	{Type: SegmentConfedSequence, ASNs: []uint32{64512, 64513}},
+	{Type: SegmentConfedSet, ASNs: []uint32{64514}},
+	{Type: SegmentSequence, ASNs: []uint32{65000, 4200000001}},
+	{Type: SegmentSet, ASNs: []uint32{65002, 65003}},
+}
+
+func TestAsPathFromAttribute(t *testing.T) {
+	attr := messages.BGPAttribute_ASPATH{}
+	for _, segment := range testPath {
+		code, ok := SegmentTypeCode(segment.Type)
+		if !ok {
+			t.Fatalf("no code for %s", segment.Type)
+		}
+		attr.Segments = append(attr.Segments, messages.ASPath_Segment{SType: code, ASPath: segment.ASNs})
+	}
+	attr.Segments = append(attr.Segments, messages.ASPath_Segment{SType: 9, ASPath: []uint32{65004}})
+
+	want := append(append(AsPath{}, testPath...), AsPathSegment{Type: "9", ASNs: []uint32{65004}})
+	got := AsPathFromAttribute(attr)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if err := got.Validate(); err == nil {
+		t.Error("unknown segment type validated")
+	}
+}
+
+func TestAsPath(t *testing.T) {
+	if got, want := testPath.String(), "(64512 64513) [64514] 65000 4200000001 {65002 65003}"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// Confederation segments don't count and the AS_SET counts as one
+	if got := testPath.Length(); got != 3 {
+		t.Errorf("got length %d, want 3", got)
+	}
+	if origin, ok := testPath.Origin(); ok {
+		t.Errorf("got origin %d for a path ending in an AS_SET", origin)
+	}
+	if origin, ok := testPath[:3].Origin(); !ok || origin != 4200000001 {
+		t.Errorf("got origin %d, want 4200000001", origin)
+	}
+	if err := testPath.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAsPathUnmarshalJSON(t *testing.T) {
+	for _, test := range []struct {
+		json string
+		want AsPath
+	}{
+		{`[65000, 4200000001]`, AsPath{{Type: SegmentSequence, ASNs: []uint32{65000, 4200000001}}}},
+		{`[]`, nil},
+		{`null`, nil},
+		{
+			`[{"type": "sequence", "asns": [65000]}, {"type": "set", "asns": [65001, 65002]}]`,
+			AsPath{{Type: SegmentSequence, ASNs: []uint32{65000}}, {Type: SegmentSet, ASNs: []uint32{65001, 65002}}},
+		},
+		{`[{"type": "confed-sequence", "asns": [64512]}]`, AsPath{{Type: SegmentConfedSequence, ASNs: []uint32{64512}}}},
+	} {
+		var got AsPath
+		if err := json.Unmarshal([]byte(test.json), &got); err != nil {
+			t.Errorf("%s: %v", test.json, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.json, got, test.want)
+		}
+	}
+
+	for _, invalid := range []string{`[-1]`, `[65000, {"type": "set"}]`, `{"type": "sequence"}`, `"65000"`} {
+		var path AsPath
+		if err := json.Unmarshal([]byte(invalid), &path); err == nil {
+			t.Errorf("%s: decoded as %+v, want an error", invalid, path)
+		}
+	}
+
+	// Inside a route, where the flat form comes from older clients
+	var route RouteData
+	if err := json.Unmarshal([]byte(`{"asPath": [65000, 65001]}`), &route); err != nil {
+		t.Fatal(err)
+	}
+	if got := route.AsPath.String(); got != "65000 65001" {
+		t.Errorf("got route path %q, want \"65000 65001\"", got)
+	}
+}
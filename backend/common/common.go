@@ -1,7 +1,12 @@
 package common
 
 import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
 	"strconv"
+
 	"github.com/bgptools/fgbgp/messages"
 )
 
@@ -11,19 +16,89 @@ type Packet struct {
 }
 
 type CreateRequest struct {
-	PeerASN  uint32 `json:"peerASN"`
-	PeerIP   string `json:"peerIP"`
-	LocalASN uint32 `json:"localASN"`
+	PeerASN    uint32      `json:"peerASN"`
+	PeerIP     string      `json:"peerIP"`
+	LocalASN   uint32      `json:"localASN"`
+	APIKey     string      `json:"apiKey,omitempty"` // Needed to claim the peer IP if the server's policy requires one
+	MaxPrefix  *MaxPrefix  `json:"maxPrefix,omitempty"`
+	Active     *ActiveMode `json:"active,omitempty"`     // Connect out to the peer instead of waiting for it
+	Inspect    bool        `json:"inspect,omitempty"`    // Send every BGP message as a RawMessage from the start
+	Role       string      `json:"role,omitempty"`       // Our BGP Role from RFC 9234, advertised in the Role capability
+	RoleStrict bool        `json:"roleStrict,omitempty"` // Refuse peers that don't advertise a BGP Role
+}
+
+// ActiveMode has the server connect to the peer, retrying every ConnectRetry
+// seconds while the session is down
+type ActiveMode struct {
+	Port         uint16 `json:"port"`         // Defaults to 179
+	ConnectRetry uint32 `json:"connectRetry"` // Defaults to 120, at least 5
+}
+
+// MaxPrefix limits how many prefixes of each address family the peer may
+// send. Going over closes the session with a Cease NOTIFICATION.
+type MaxPrefix struct {
+	Limit   uint32 `json:"limit"`
+	Warning uint32 `json:"warning"` // Percentage of the limit to warn at, defaults to 75
+	Restart uint32 `json:"restart"` // Seconds until the peer may reconnect, 0 keeps the session down
 }
 
 func (c *CreateRequest) ToKey() string {
 	return c.PeerIP + "|" + strconv.FormatUint(uint64(c.PeerASN), 10)
 }
 
+// CreateResponse is sent once a session is created. The token proves
+// ownership of the session for the REST API and for reattaching, the share
+// token lets others watch the session without being able to change it.
+type CreateResponse struct {
+	Token      string `json:"token"`
+	ShareToken string `json:"shareToken"`
+}
+
+// ReattachRequest takes over an existing session from a new websocket, such
+// as after a page reload, or watches it read-only when given the share token
+type ReattachRequest struct {
+	PeerASN uint32 `json:"peerASN"`
+	PeerIP  string `json:"peerIP"`
+	Token   string `json:"token"`
+}
+
+func (r *ReattachRequest) ToKey() string {
+	return r.PeerIP + "|" + strconv.FormatUint(uint64(r.PeerASN), 10)
+}
+
+// Snapshot brings a reattached client up to date before the live stream
+// continues
+type Snapshot struct {
+	ReadOnly  bool          `json:"readOnly"`
+	FSM       FSMUpdate     `json:"fsm"`
+	Received  []RouteData   `json:"received"`
+	Announced []RouteData   `json:"announced"`
+	Events    []Event       `json:"events"`
+	Replay    *ReplayStatus `json:"replay,omitempty"` // The session's last replay, if any
+}
+
+// Error codes for errors the client may want to handle, such as hitting one of
+// the server's limits
+const (
+	ErrSessionLimit  = "session_limit"
+	ErrPrefixLimit   = "prefix_limit"
+	ErrRateLimit     = "rate_limit"
+	ErrTooManyRoutes = "too_many_routes"
+	ErrQueueFull     = "queue_full"
+	ErrMaxPrefix     = "max_prefix"
+	ErrLocalASN      = "local_asn"
+	ErrMalformed     = "malformed_update"
+)
+
 type Error struct {
+	Code    string `json:"code,omitempty"`
 	Message string `json:"message"`
 }
 
+func (e Error) Error() string {
+	return e.Message
+}
+
 type UpdateRequest struct {
 	FullTable   bool   `json:"fullTable"`
 	AddPath     bool   `json:"addPath"`
@@ -31,13 +106,144 @@ type UpdateRequest struct {
 }
 
 type RouteData struct {
-	Withdraws        []NLRI                    `json:"withdraws"`
-	Prefixes         []NLRI                    `json:"prefixes"`
-	AsPath           []uint32                  `json:"asPath"`
-	NextHop          string                    `json:"nextHop"`
-	Communities      [][]uint16                `json:"communities"`
-	LargeCommunities []messages.LargeCommunity `json:"largeCommunities"`
-	Origin           int                       `json:"origin"`
+	Withdraws           []NLRI                    `json:"withdraws"`
+	Prefixes            []NLRI                    `json:"prefixes"`
+	AsPath              AsPath                    `json:"asPath"`
+	WireAsPath          AsPath                    `json:"wireAsPath,omitempty"` // AS_PATH as received when AS4_PATH was merged into AsPath
+	NextHop             string                    `json:"nextHop"`
+	Communities         [][]uint16                `json:"communities"`
+	LargeCommunities    []messages.LargeCommunity `json:"largeCommunities"`
+	ExtendedCommunities []string                  `json:"extendedCommunities,omitempty"` // Readable form, see ParseExtendedCommunity
+	Origin              int                       `json:"origin"`
+	Med                 *uint32                   `json:"med,omitempty"`
+	LocalPref           *uint32                   `json:"localPref,omitempty"` // Only sent to internal peers
+	AtomicAggregate     bool                      `json:"atomicAggregate,omitempty"`
+	Aggregator          *Aggregator               `json:"aggregator,omitempty"`
+	OTC                 *uint32                   `json:"otc,omitempty"`           // Only to Customer attribute from RFC 9234
+	Leak                string                    `json:"leak,omitempty"`          // Why the OTC shows a received route was leaked, given the BGP Roles
+	ASPA                *ASPAResult               `json:"aspa,omitempty"`          // Verification of a received AS_PATH, when the peer is downstream of us
+	RawAttributes       []RawAttribute            `json:"rawAttributes,omitempty"` // Sent as given, and received attributes that aren't decoded
+	FlowSpec            []FlowSpec                `json:"flowSpec,omitempty"`      // Rules announced with the attributes, which take no next hop
+	FlowSpecWithdraws   []FlowSpec                `json:"flowSpecWithdraws,omitempty"`
+}
+
+// RawAttribute is a path attribute as its flags, type code and value in hex
+type RawAttribute struct {
+	Flags    byte   `json:"flags"`
+	TypeCode byte   `json:"typeCode"`
+	Value    string `json:"value"`
+}
+
+// maxRawAttributeLength keeps a raw attribute within a 4096 octet UPDATE
+const maxRawAttributeLength = 4000
+
+// Validate checks that the value is hex and fits in an UPDATE
+func (a RawAttribute) Validate() error {
+	value, err := hex.DecodeString(a.Value)
+	if err != nil {
+		return fmt.Errorf("invalid value %q for attribute type %d, expected hex", a.Value, a.TypeCode)
+	}
+	if len(value) > maxRawAttributeLength {
+		return fmt.Errorf("attribute type %d is %d octets long, at most %d fit in an UPDATE", a.TypeCode, len(value), maxRawAttributeLength)
+	}
+	return nil
+}
+
+// ASPA path verification outcomes from draft-ietf-sidrops-aspa-verification
+const (
+	ASPAValid   = "valid"
+	ASPAInvalid = "invalid"
+	ASPAUnknown = "unknown"
+)
+
+// ASPAResult is the outcome of verifying an AS_PATH against ASPA objects
+type ASPAResult struct {
+	State  string   `json:"state"`
+	Hop    *ASPAHop `json:"hop,omitempty"`    // Where verification failed
+	Reason string   `json:"reason,omitempty"` // Why the path isn't valid
+}
+
+// ASPAHop is a step in an AS_PATH, from the customer to the AS it sent the
+// route to
+type ASPAHop struct {
+	Customer uint32 `json:"customer"`
+	Provider uint32 `json:"provider"`
+}
+
+// Aggregator is the AS and BGP identifier of the speaker that formed an
+// aggregate route
+type Aggregator struct {
+	ASN     uint32 `json:"asn"`
+	Address string `json:"address"`
+}
+
+// Validate checks that the aggregator's address is an IPv4 address
+func (a *Aggregator) Validate() error {
+	if a == nil {
+		return nil
+	}
+	if ip := net.ParseIP(a.Address); ip == nil || ip.To4() == nil {
+		return errors.New("invalid aggregator address " + strconv.Quote(a.Address) + ", expected an IPv4 address")
+	}
+	return nil
+}
+
+// Validate checks that every prefix and FlowSpec rule in the announcement and
+// withdraws can be encoded, and that announcements have a usable next hop and
+// AS path
+func (r *RouteData) Validate() error {
+	for _, list := range [][]NLRI{r.Withdraws, r.Prefixes} {
+		for _, nlri := range list {
+			if _, _, err := net.ParseCIDR(nlri.Prefix); err != nil {
+				return errors.New("invalid prefix " + strconv.Quote(nlri.Prefix))
+			}
+		}
+	}
+	if len(r.Prefixes) > 0 && net.ParseIP(r.NextHop) == nil {
+		return errors.New("invalid next hop " + strconv.Quote(r.NextHop))
+	}
+	if err := r.AsPath.Validate(); err != nil {
+		return err
+	}
+	if err := r.Aggregator.Validate(); err != nil {
+		return err
+	}
+	for _, a := range r.RawAttributes {
+		if err := a.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, c := range r.ExtendedCommunities {
+		if _, err := ParseExtendedCommunity(c); err != nil {
+			return err
+		}
+	}
+	for _, list := range [][]FlowSpec{r.FlowSpecWithdraws, r.FlowSpec} {
+		for i := range list {
+			if err := list[i].Validate(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RoutesetRoute is a group of prefixes sharing the same attributes within a
+// routeset, as served from /routesets.json
+type RoutesetRoute struct {
+	Prefixes            []string                  `json:"prefixes"`
+	AsPath              AsPath                    `json:"asPath,omitempty"`
+	NextHop             string                    `json:"nextHop,omitempty"`
+	Communities         [][]uint16                `json:"communities,omitempty"`
+	LargeCommunities    []messages.LargeCommunity `json:"largeCommunities,omitempty"`
+	ExtendedCommunities []string                  `json:"extendedCommunities,omitempty"`
+	Origin              int                       `json:"origin,omitempty"`
+	Med                 *uint32                   `json:"med,omitempty"`
+	LocalPref           *uint32                   `json:"localPref,omitempty"`
+	AtomicAggregate     bool                      `json:"atomicAggregate,omitempty"`
+	Aggregator          *Aggregator               `json:"aggregator,omitempty"`
+	OTC                 *uint32                   `json:"otc,omitempty"`
+	RawAttributes       []RawAttribute            `json:"rawAttributes,omitempty"`
 }
 
 type NLRI struct {
@@ -45,15 +251,170 @@ type NLRI struct {
 	ID     uint32 `json:"id"`
 }
 
+// FSMUpdate is a transition of the session's RFC 4271 state machine
 type FSMUpdate struct {
 	State          string `json:"state"`
+	Previous       string `json:"previous,omitempty"`
+	Event          string `json:"event,omitempty"` // RFC 4271 event causing the transition
+	Since          uint64 `json:"since"`           // Epoch timestamp of the transition
 	HoldTimer      uint   `json:"holdTimer"`
 	KeepaliveTimer uint   `json:"keepaliveTimer"`
 }
 
+// Session describes a peer as listed by the REST API
+type Session struct {
+	PeerIP            string `json:"peerIP"`
+	PeerASN           uint32 `json:"peerASN"`
+	LocalASN          uint32 `json:"localASN"`
+	State             string `json:"state"`
+	HoldTimer         uint   `json:"holdTimer"`
+	KeepaliveTimer    uint   `json:"keepaliveTimer"`
+	EstablishedAt     uint64 `json:"establishedAt"` // Epoch timestamp, 0 unless Established
+	ReceivedPrefixes  int    `json:"receivedPrefixes"`
+	AnnouncedPrefixes int    `json:"announcedPrefixes"`
+	Role              string `json:"role,omitempty"`
+	PeerRole          string `json:"peerRole,omitempty"` // Set once the peer advertised a role matching ours
+}
+
+// Kinds of events in a session's event log
+const (
+	EventMessage = "message" // A BGP message was sent or received
+	EventState   = "state"   // The FSM changed state
+	EventError   = "error"   // An error was reported to a client
+	EventAction  = "action"  // A client did something to the session
+	EventInfo    = "info"    // Anything else worth knowing
+)
+
+// Event is an entry in a session's event log. Fields beyond the message are
+// set depending on the kind.
 type Event struct {
+	Seq     uint64 `json:"seq"`  // Increases by one with every event of the session
 	Time    uint64 `json:"time"` // Epoch timestamp
+	Kind    string `json:"kind"`
 	Message string `json:"message"`
+
+	Direction   string     `json:"direction,omitempty"`   // sent or received
+	MessageType string     `json:"messageType,omitempty"` // OPEN, UPDATE, NOTIFICATION, KEEPALIVE or ROUTE-REFRESH
+	Size        int        `json:"size,omitempty"`        // Bytes including the header
+	State       *FSMUpdate `json:"state,omitempty"`
+	Error       *Error     `json:"error,omitempty"`
+	Action      string     `json:"action,omitempty"`
+}
+
+// EventQuery asks for the events in a session's log matching all of the set
+// fields
+type EventQuery struct {
+	After uint64   `json:"after"` // Only events with a greater sequence number
+	Kinds []string `json:"kinds"`
+	Limit int      `json:"limit"` // Only the most recent events, defaults to all
+}
+
+// EventLog answers an EventQuery
+type EventLog struct {
+	Events []Event `json:"events"`
+}
+
+// Field is a node of a decoded BGP message, covering Length bytes from
+// Offset into the message
+type Field struct {
+	Name     string  `json:"name"`
+	Value    string  `json:"value,omitempty"`
+	Offset   int     `json:"offset"`
+	Length   int     `json:"length"`
+	Error    string  `json:"error,omitempty"` // Why the bytes don't make a valid field
+	Children []Field `json:"children,omitempty"`
+}
+
+// RawMessage is a BGP message as it went over the wire, sent to clients
+// inspecting the session
+type RawMessage struct {
+	Time      uint64 `json:"time"`
+	Direction string `json:"direction"` // sent or received
+	Hex       string `json:"hex"`
+	Reencoded bool   `json:"reencoded"` // Rebuilt from the parsed message as the original bytes weren't kept
+	Tree      Field  `json:"tree"`
+}
+
+// InspectRequest turns the session's wire inspector on or off
+type InspectRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+// Outcomes of a robustness test, by how the peer handled the malformed UPDATE
+const (
+	OutcomeTreatAsWithdraw = "treat-as-withdraw"
+	OutcomeSessionReset    = "session-reset"
+	OutcomeAccepted        = "accepted"
+	OutcomeNoReset         = "no-reset" // The peer doesn't announce the probe back, so treat-as-withdraw and acceptance look the same
+	OutcomeSkipped         = "skipped"
+)
+
+// RobustnessRequest starts sending the peer malformed UPDATEs to see how it
+// handles them. Every test announces Prefix and then a malformed version of
+// it.
+type RobustnessRequest struct {
+	Prefix  string   `json:"prefix"`
+	NextHop string   `json:"nextHop,omitempty"` // Defaults to our address on the session
+	Tests   []string `json:"tests,omitempty"`   // Defaults to all of them
+	Wait    uint32   `json:"wait,omitempty"`    // Seconds to wait for the peer's reaction, defaults to 5
+}
+
+// RobustnessResult is how the peer handled one malformed UPDATE
+type RobustnessResult struct {
+	Test        string `json:"test"`
+	Description string `json:"description"`
+	Expected    string `json:"expected"` // What RFC 7606 says the peer should do
+	Outcome     string `json:"outcome"`
+	Detail      string `json:"detail,omitempty"`
+}
+
+// How a malformed UPDATE or attribute was handled, from RFC 7606
+const (
+	HandlingAttributeDiscard = "attribute-discard"
+	HandlingTreatAsWithdraw  = "treat-as-withdraw"
+	HandlingSessionReset     = "session-reset"
+)
+
+// MalformedAttribute is a problem found in a received UPDATE, in an attribute
+// or one of the message's fields
+type MalformedAttribute struct {
+	Attribute string `json:"attribute"`
+	TypeCode  byte   `json:"typeCode,omitempty"` // Unset for fields that aren't attributes
+	Handling  string `json:"handling"`
+	Reason    string `json:"reason"`
+	Rule      string `json:"rule"` // Section of RFC 7606 that was applied
+}
+
+// MalformedUpdate reports a received UPDATE that broke the rules of RFC 7606
+type MalformedUpdate struct {
+	Handling          string               `json:"handling"` // The most severe handling of the problems, applied to the whole UPDATE
+	Problems          []MalformedAttribute `json:"problems"`
+	Withdrawn         []NLRI               `json:"withdrawn,omitempty"`         // Prefixes treated as withdrawn
+	WithdrawnFlowSpec []FlowSpec           `json:"withdrawnFlowSpec,omitempty"` // FlowSpec rules treated as withdrawn
+}
+
+type ReplayRequest struct {
+	File    string  `json:"file"`
+	Speed   float64 `json:"speed"`   // Playback speed multiplier, defaults to 1
+	PeerIP  string  `json:"peerIP"`  // Only replay messages from this peer of the recording
+	PeerASN uint32  `json:"peerASN"` // Only replay messages from this ASN of the recording
+	NextHop string  `json:"nextHop"`
+}
+
+type ReplayControl struct {
+	Action string  `json:"action"` // pause, resume, stop or speed
+	Speed  float64 `json:"speed"`
+}
+
+type ReplayStatus struct {
+	State    string  `json:"state"` // scanning, running, paused, finished, stopped or failed
+	File     string  `json:"file"`
+	Speed    float64 `json:"speed"`
+	Start    uint64  `json:"start"`    // Epoch timestamp of the first replayed message in the recording
+	End      uint64  `json:"end"`      // Epoch timestamp of the last replayed message in the recording
+	Position uint64  `json:"position"` // Epoch timestamp in the recording the replay has reached
+	Sent     int     `json:"sent"`
+	Total    int     `json:"total"`
 }
 
 type InitData struct {
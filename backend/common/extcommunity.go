@@ -0,0 +1,234 @@
+package common
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/bgptools/fgbgp/messages"
+)
+
+// Path attributes carrying extended communities, which fgbgp leaves undecoded
+const (
+	AttrExtendedCommunities     = 16
+	AttrIPv6ExtendedCommunities = 25
+)
+
+// Extended community types from RFC 4360 and RFC 5668, the non-transitive
+// variants have 0x40 set
+const (
+	extTypeTwoOctetAS  = 0x00
+	extTypeIPv4        = 0x01
+	extTypeFourOctetAS = 0x02
+	extTypeOpaque      = 0x03
+)
+
+// Subtypes of the AS and address specific types
+var extSubtypes = map[string]byte{
+	"rt": 0x02, // Route target
+	"ro": 0x03, // Route origin
+}
+
+// FlowSpec traffic filtering actions from RFC 8955 section 7, which use the
+// experimental transitive types. Redirects take the type of their global
+// administrator with 0x80 set.
+const (
+	extTypeFlowSpec              = 0x80
+	extSubtypeTrafficRate        = 0x06
+	extSubtypeRedirect           = 0x08
+	extSubtypeTrafficMarking     = 0x09
+	extSubtypeTrafficRatePackets = 0x0c
+)
+
+// ParseExtendedCommunity parses the readable form of an extended community.
+// It returns 8 octets for RFC 4360 communities and 20 for RFC 5701 IPv6
+// address specific ones. The forms are:
+//
+//	rt:65000:100           two-octet AS specific route target
+//	ro:4200000000:100      four-octet AS specific route origin
+//	rt:65000L:100          four-octet AS specific for an ASN below 65536
+//	rt:192.0.2.1:100       IPv4 address specific
+//	rt:[2001:db8::1]:100   IPv6 address specific
+//	opaque:0c:000000000008 opaque with its subtype and value in hex
+//	raw:0002fde800000064   any other community in hex
+//
+// FlowSpec actions are written as:
+//
+//	traffic-rate:65000:0            limit to bytes per second, 0 discards
+//	traffic-rate-packets:65000:100  limit to packets per second
+//	redirect:65000:100              redirect to a VRF route target, also
+//	                                with an IPv4 address or four-octet ASN
+//	traffic-marking:46              rewrite the DSCP
+func ParseExtendedCommunity(s string) ([]byte, error) {
+	kind, rest, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid extended community %q, expected a type like rt: or ro:", s)
+	}
+	switch kind {
+	case "raw":
+		b, err := hex.DecodeString(rest)
+		if err != nil || (len(b) != 8 && len(b) != 20) {
+			return nil, fmt.Errorf("invalid extended community %q, expected 8 or 20 octets of hex", s)
+		}
+		return b, nil
+	case "opaque":
+		subtype, value, ok := strings.Cut(rest, ":")
+		st, err := hex.DecodeString(subtype)
+		v, err2 := hex.DecodeString(value)
+		if !ok || err != nil || err2 != nil || len(st) != 1 || len(v) != 6 {
+			return nil, fmt.Errorf("invalid extended community %q, expected opaque:<subtype>:<value> with 1 and 6 octets of hex", s)
+		}
+		return append([]byte{extTypeOpaque, st[0]}, v...), nil
+	case "traffic-rate", "traffic-rate-packets":
+		global, rate, ok := strings.Cut(rest, ":")
+		asn, err := strconv.ParseUint(global, 10, 16)
+		r, err2 := strconv.ParseFloat(rate, 32)
+		if !ok || err != nil || err2 != nil || r < 0 || math.IsInf(r, 0) || math.IsNaN(r) {
+			return nil, fmt.Errorf("invalid extended community %q, expected %s:<0-65535>:<rate>", s, kind)
+		}
+		subtype := byte(extSubtypeTrafficRate)
+		if kind == "traffic-rate-packets" {
+			subtype = extSubtypeTrafficRatePackets
+		}
+		b := appendUint16([]byte{extTypeFlowSpec, subtype}, uint16(asn))
+		return appendUint32(b, math.Float32bits(float32(r))), nil
+	case "traffic-marking":
+		dscp, err := strconv.ParseUint(rest, 10, 6)
+		if err != nil {
+			return nil, fmt.Errorf("invalid extended community %q, expected traffic-marking:<DSCP 0-63>", s)
+		}
+		return []byte{extTypeFlowSpec, extSubtypeTrafficMarking, 0, 0, 0, 0, 0, byte(dscp)}, nil
+	case "redirect":
+		b, err := ParseExtendedCommunity("rt:" + rest)
+		if err != nil || len(b) != 8 {
+			return nil, fmt.Errorf("invalid extended community %q, expected redirect:<ASN or IPv4 address>:<local>", s)
+		}
+		b[0] |= extTypeFlowSpec
+		b[1] = extSubtypeRedirect
+		return b, nil
+	}
+
+	subtype, ok := extSubtypes[kind]
+	if !ok {
+		return nil, fmt.Errorf("invalid extended community %q, unknown type %q", s, kind)
+	}
+	i := strings.LastIndex(rest, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid extended community %q, expected %s:<global>:<local>", s, kind)
+	}
+	global, local := rest[:i], rest[i+1:]
+
+	if strings.HasPrefix(global, "[") && strings.HasSuffix(global, "]") {
+		ip := net.ParseIP(global[1 : len(global)-1])
+		n, err := strconv.ParseUint(local, 10, 16)
+		if ip == nil || ip.To4() != nil || err != nil {
+			return nil, fmt.Errorf("invalid extended community %q, expected %s:[<IPv6 address>]:<0-65535>", s, kind)
+		}
+		b := append([]byte{extTypeTwoOctetAS, subtype}, ip.To16()...)
+		return appendUint16(b, uint16(n)), nil
+	}
+	if ip := net.ParseIP(global); ip != nil && ip.To4() != nil {
+		n, err := strconv.ParseUint(local, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid extended community %q, the local part of an IPv4 address specific community is 0-65535", s)
+		}
+		b := append([]byte{extTypeIPv4, subtype}, ip.To4()...)
+		return appendUint16(b, uint16(n)), nil
+	}
+
+	fourOctet := strings.HasSuffix(global, "L")
+	asn, err := strconv.ParseUint(strings.TrimSuffix(global, "L"), 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid extended community %q, %q isn't an ASN or IP address", s, global)
+	}
+	if fourOctet || asn > 0xffff {
+		n, err := strconv.ParseUint(local, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid extended community %q, the local part of a four-octet AS specific community is 0-65535", s)
+		}
+		b := appendUint32([]byte{extTypeFourOctetAS, subtype}, uint32(asn))
+		return appendUint16(b, uint16(n)), nil
+	}
+	n, err := strconv.ParseUint(local, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid extended community %q, the local part of a two-octet AS specific community is 0-4294967295", s)
+	}
+	b := appendUint16([]byte{extTypeTwoOctetAS, subtype}, uint16(asn))
+	return appendUint32(b, uint32(n)), nil
+}
+
+// FormatExtendedCommunity returns the readable form of an extended community
+// as parsed by ParseExtendedCommunity
+func FormatExtendedCommunity(b []byte) string {
+	var kind string
+	if len(b) >= 2 {
+		for name, subtype := range extSubtypes {
+			if b[1] == subtype {
+				kind = name
+			}
+		}
+	}
+
+	switch {
+	case len(b) == 20 && b[0] == extTypeTwoOctetAS && kind != "":
+		return fmt.Sprintf("%s:[%s]:%d", kind, net.IP(b[2:18]), binary.BigEndian.Uint16(b[18:]))
+	case len(b) != 8:
+	case b[0] == extTypeFlowSpec && (b[1] == extSubtypeTrafficRate || b[1] == extSubtypeTrafficRatePackets):
+		name := "traffic-rate"
+		if b[1] == extSubtypeTrafficRatePackets {
+			name = "traffic-rate-packets"
+		}
+		rate := math.Float32frombits(binary.BigEndian.Uint32(b[4:]))
+		return fmt.Sprintf("%s:%d:%s", name, binary.BigEndian.Uint16(b[2:]), strconv.FormatFloat(float64(rate), 'f', -1, 32))
+	case b[0] == extTypeFlowSpec && b[1] == extSubtypeTrafficMarking:
+		return fmt.Sprintf("traffic-marking:%d", b[7]&0x3f)
+	case b[0]&^extTypeFlowSpec <= extTypeFourOctetAS && b[0]&extTypeFlowSpec != 0 && b[1] == extSubtypeRedirect:
+		target := append([]byte{b[0] &^ extTypeFlowSpec, extSubtypes["rt"]}, b[2:]...)
+		return "redirect" + strings.TrimPrefix(FormatExtendedCommunity(target), "rt")
+	case b[0] == extTypeTwoOctetAS && kind != "":
+		return fmt.Sprintf("%s:%d:%d", kind, binary.BigEndian.Uint16(b[2:]), binary.BigEndian.Uint32(b[4:]))
+	case b[0] == extTypeIPv4 && kind != "":
+		return fmt.Sprintf("%s:%s:%d", kind, net.IP(b[2:6]), binary.BigEndian.Uint16(b[6:]))
+	case b[0] == extTypeFourOctetAS && kind != "":
+		asn := binary.BigEndian.Uint32(b[2:])
+		global := strconv.FormatUint(uint64(asn), 10)
+		if asn <= 0xffff {
+			global += "L"
+		}
+		return fmt.Sprintf("%s:%s:%d", kind, global, binary.BigEndian.Uint16(b[6:]))
+	case b[0] == extTypeOpaque:
+		return fmt.Sprintf("opaque:%02x:%s", b[1], hex.EncodeToString(b[2:]))
+	}
+	return "raw:" + hex.EncodeToString(b)
+}
+
+// ExtendedCommunitiesFromAttribute returns the readable form of the extended
+// communities in an attribute, or nil if it doesn't hold any
+func ExtendedCommunitiesFromAttribute(attr messages.BGPAttribute) []string {
+	size := 0
+	switch attr.Code {
+	case AttrExtendedCommunities:
+		size = 8
+	case AttrIPv6ExtendedCommunities:
+		size = 20
+	default:
+		return nil
+	}
+	communities := []string{}
+	for i := 0; i+size <= len(attr.Data); i += size {
+		communities = append(communities, FormatExtendedCommunity(attr.Data[i:i+size]))
+	}
+	return communities
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
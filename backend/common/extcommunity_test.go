@@ -0,0 +1,97 @@
+package common
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestExtendedCommunity(t *testing.T) {
+	for _, test := range []struct {
+		text   string
+		wire   string
+		format string // Readable form, when it differs from text
+	}{
+		{text: "rt:65000:100", wire: "0002fde800000064"},
+		{text: "ro:65000:4294967295", wire: "0003fde8ffffffff"},
+		{text: "ro:4200000000:100", wire: "0203fa56ea000064"},
+		{text: "rt:65000L:100", wire: "02020000fde80064"},
+		{text: "rt:192.0.2.1:100", wire: "0102c00002010064"},
+		{text: "rt:[2001:db8::1]:100", wire: "000220010db80000000000000000000000010064"},
+		{text: "opaque:0c:000000000008", wire: "030c000000000008"},
+		{text: "raw:0604000000000000", wire: "0604000000000000"},
+		{text: "raw:0005" + "20010db8000000000000000000000001" + "0064", wire: "000520010db80000000000000000000000010064"},
+		{text: "raw:0002fde800000064", wire: "0002fde800000064", format: "rt:65000:100"},
+		{text: "traffic-rate:65000:0", wire: "8006fde800000000"},
+		{text: "traffic-rate:0:1250000", wire: "8006000049989680"},
+		{text: "traffic-rate-packets:65000:100", wire: "800cfde842c80000"},
+		{text: "redirect:65000:100", wire: "8008fde800000064"},
+		{text: "redirect:192.0.2.1:100", wire: "8108c00002010064"},
+		{text: "redirect:4200000000:100", wire: "8208fa56ea000064"},
+		{text: "redirect:65000L:100", wire: "82080000fde80064"},
+		{text: "traffic-marking:46", wire: "800900000000002e"},
+	} {
+		t.Run(test.text, func(t *testing.T) {
+			b, err := ParseExtendedCommunity(test.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := hex.EncodeToString(b); got != test.wire {
+				t.Errorf("got %s, want %s", got, test.wire)
+			}
+			format := test.format
+			if format == "" {
+				format = test.text
+			}
+			if got := FormatExtendedCommunity(b); got != format {
+				t.Errorf("formatted as %q, want %q", got, format)
+			}
+		})
+	}
+}
+
+func TestParseExtendedCommunityInvalid(t *testing.T) {
+	for _, text := range []string{
+		"",
+		"rt",
+		"xx:65000:100",
+		"rt:65000",
+		"rt:65000:-1",
+		"rt:65000:4294967296",
+		"rt:4200000000:65536",
+		"rt:65000L:65536",
+		"rt:4294967296:1",
+		"rt:192.0.2.1:65536",
+		"rt:[192.0.2.1]:100",
+		"rt:[2001:db8::1]:65536",
+		"rt:2001:db8::1:100",
+		"rt:example:100",
+		"raw:0002fde8",
+		"raw:zz02fde800000064",
+		"opaque:0c:00",
+		"opaque:0c0c:000000000008",
+		"opaque:000000000008",
+		"traffic-rate:65536:0",
+		"traffic-rate:65000:-1",
+		"traffic-rate:65000:NaN",
+		"traffic-rate:65000:Inf",
+		"traffic-rate:65000:1e39",
+		"traffic-rate:65000",
+		"traffic-marking:64",
+		"traffic-marking:af11",
+		"redirect:[2001:db8::1]:100",
+		"redirect:192.0.2.1:65536",
+	} {
+		if b, err := ParseExtendedCommunity(text); err == nil {
+			t.Errorf("%q parsed as %x, want an error", text, b)
+		}
+	}
+}
+
+func TestFormatExtendedCommunityLength(t *testing.T) {
+	for _, wire := range []string{"", "00", "0002fde8000000", "0002fde80000006400"} {
+		b, _ := hex.DecodeString(wire)
+		if got, want := FormatExtendedCommunity(b), "raw:"+wire; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
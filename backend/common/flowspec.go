@@ -0,0 +1,537 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// FlowSpec families and their SAFI, RFC 8955 and RFC 8956
+const (
+	FlowSpecIPv4 = "ipv4"
+	FlowSpecIPv6 = "ipv6"
+	SafiFlowSpec = 133
+)
+
+// FlowSpec is a traffic filtering rule from RFC 8955, or RFC 8956 for IPv6,
+// matching packets that fit every component that is set. IPv6 prefixes may
+// have an offset, the number of leading bits of the address that aren't
+// matched.
+//
+// Numeric components hold alternatives separated by spaces, each a value or
+// comparisons joined with &, as in "80 443 >=8000&<=8080". The comparisons
+// are =, !=, <, <=, > and >=, a bare value being =, and "8000-8080" is short
+// for the range above.
+//
+// Bitmask components hold alternatives the same way, each a number or flags
+// joined with |. They match when any of the flags is set, with = when all of
+// them are, with ! when none are and with != when not all are, as in
+// "=syn|ack !rst". TCP flags are fin, syn, rst, psh, ack, urg, ece and cwr,
+// fragment flags dont-fragment (IPv4 only), is-fragment, first-fragment and
+// last-fragment.
+type FlowSpec struct {
+	Family            string `json:"family,omitempty"` // Defaults to the family of the prefixes, or IPv4
+	Destination       string `json:"destination,omitempty"`
+	DestinationOffset uint8  `json:"destinationOffset,omitempty"`
+	Source            string `json:"source,omitempty"`
+	SourceOffset      uint8  `json:"sourceOffset,omitempty"`
+	Protocol          string `json:"protocol,omitempty"` // Next header for IPv6
+	Port              string `json:"port,omitempty"`     // Either the source or destination port
+	DestinationPort   string `json:"destinationPort,omitempty"`
+	SourcePort        string `json:"sourcePort,omitempty"`
+	ICMPType          string `json:"icmpType,omitempty"`
+	ICMPCode          string `json:"icmpCode,omitempty"`
+	TCPFlags          string `json:"tcpFlags,omitempty"`
+	PacketLength      string `json:"packetLength,omitempty"`
+	DSCP              string `json:"dscp,omitempty"`
+	Fragment          string `json:"fragment,omitempty"`
+}
+
+// Prefix component types, the others are in flowSpecComponents
+const (
+	flowSpecDestination = 1
+	flowSpecSource      = 2
+)
+
+// Bits of the operator byte shared by numeric and bitmask operators
+const (
+	flowSpecEndOfList = 0x80
+	flowSpecAnd       = 0x40
+	flowSpecLength    = 0x30
+)
+
+// Bits of a bitmask operator, numeric ones use the low three bits for <, >
+// and =
+const (
+	flowSpecNot   = 0x02
+	flowSpecMatch = 0x01
+)
+
+type flowSpecFlag struct {
+	name string
+	bit  uint64
+}
+
+var tcpFlags = []flowSpecFlag{
+	{"fin", 0x01}, {"syn", 0x02}, {"rst", 0x04}, {"psh", 0x08},
+	{"ack", 0x10}, {"urg", 0x20}, {"ece", 0x40}, {"cwr", 0x80},
+}
+
+var fragmentFlags = []flowSpecFlag{
+	{"dont-fragment", 0x01}, {"is-fragment", 0x02}, {"first-fragment", 0x04}, {"last-fragment", 0x08},
+}
+
+// flowSpecComponent is a component type taking a list of operators
+type flowSpecComponent struct {
+	code  byte
+	name  string
+	max   uint64
+	flags []flowSpecFlag // Set for bitmask components
+	field func(f *FlowSpec) *string
+}
+
+var flowSpecComponents = []flowSpecComponent{
+	{3, "protocol", 0xff, nil, func(f *FlowSpec) *string { return &f.Protocol }},
+	{4, "port", 0xffff, nil, func(f *FlowSpec) *string { return &f.Port }},
+	{5, "destination-port", 0xffff, nil, func(f *FlowSpec) *string { return &f.DestinationPort }},
+	{6, "source-port", 0xffff, nil, func(f *FlowSpec) *string { return &f.SourcePort }},
+	{7, "icmp-type", 0xff, nil, func(f *FlowSpec) *string { return &f.ICMPType }},
+	{8, "icmp-code", 0xff, nil, func(f *FlowSpec) *string { return &f.ICMPCode }},
+	{9, "tcp-flags", 0xffff, tcpFlags, func(f *FlowSpec) *string { return &f.TCPFlags }},
+	{10, "packet-length", 0xffff, nil, func(f *FlowSpec) *string { return &f.PacketLength }},
+	{11, "dscp", 0x3f, nil, func(f *FlowSpec) *string { return &f.DSCP }},
+	{12, "fragment", 0x0f, fragmentFlags, func(f *FlowSpec) *string { return &f.Fragment }},
+}
+
+// Numeric comparisons, the two character ones first so they match before
+// their prefixes
+var numericOps = []struct {
+	text string
+	bits byte
+}{{"!=", 0x06}, {"<=", 0x05}, {">=", 0x03}, {"=", 0x01}, {"<", 0x04}, {">", 0x02}}
+
+// flowSpecOp is an operator and its value
+type flowSpecOp struct {
+	and   bool
+	bits  byte
+	value uint64
+}
+
+// IPv6 reports whether the rule is in the IPv6 FlowSpec family
+func (f *FlowSpec) IPv6() bool {
+	switch f.Family {
+	case FlowSpecIPv4:
+		return false
+	case FlowSpecIPv6:
+		return true
+	}
+	return strings.Contains(f.Destination, ":") || strings.Contains(f.Source, ":")
+}
+
+// Validate checks that the rule can be encoded
+func (f *FlowSpec) Validate() error {
+	_, err := f.Encode()
+	return err
+}
+
+// String returns the rule on one line, like
+// "ipv4 destination 192.0.2.0/24 protocol 6 destination-port 80"
+func (f FlowSpec) String() string {
+	parts := []string{FlowSpecIPv4}
+	if f.IPv6() {
+		parts[0] = FlowSpecIPv6
+	}
+	if f.Destination != "" {
+		parts = append(parts, "destination "+f.Destination)
+		if f.DestinationOffset > 0 {
+			parts = append(parts, "offset "+strconv.Itoa(int(f.DestinationOffset)))
+		}
+	}
+	if f.Source != "" {
+		parts = append(parts, "source "+f.Source)
+		if f.SourceOffset > 0 {
+			parts = append(parts, "offset "+strconv.Itoa(int(f.SourceOffset)))
+		}
+	}
+	for _, c := range flowSpecComponents {
+		if text := *c.field(&f); text != "" {
+			parts = append(parts, c.name+" "+text)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// Encode returns the rule as a FlowSpec NLRI, starting with its length
+func (f *FlowSpec) Encode() ([]byte, error) {
+	if f.Family != "" && f.Family != FlowSpecIPv4 && f.Family != FlowSpecIPv6 {
+		return nil, fmt.Errorf("invalid FlowSpec family %q, expected ipv4 or ipv6", f.Family)
+	}
+	ipv6 := f.IPv6()
+	value := []byte{}
+	prefixes := []struct {
+		code   byte
+		prefix string
+		offset uint8
+	}{{flowSpecDestination, f.Destination, f.DestinationOffset}, {flowSpecSource, f.Source, f.SourceOffset}}
+	for _, p := range prefixes {
+		if p.prefix == "" {
+			continue
+		}
+		b, err := encodeFlowSpecPrefix(p.prefix, p.offset, ipv6)
+		if err != nil {
+			return nil, err
+		}
+		value = append(append(value, p.code), b...)
+	}
+	for _, c := range flowSpecComponents {
+		text := strings.TrimSpace(*c.field(f))
+		if text == "" {
+			continue
+		}
+		ops, err := parseFlowSpecOps(text, c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid FlowSpec %s %q: %w", c.name, text, err)
+		}
+		if ipv6 && c.code == 12 {
+			for _, op := range ops {
+				if op.value&0x01 != 0 {
+					return nil, fmt.Errorf("invalid FlowSpec fragment %q: dont-fragment only applies to IPv4", text)
+				}
+			}
+		}
+		value = append(append(value, c.code), encodeFlowSpecOps(ops)...)
+	}
+
+	switch {
+	case len(value) == 0:
+		return nil, errors.New("a FlowSpec rule needs at least one component")
+	case len(value) < 0xf0:
+		return append([]byte{byte(len(value))}, value...), nil
+	case len(value) <= 0xfff:
+		return append(appendUint16(nil, 0xf000|uint16(len(value))), value...), nil
+	}
+	return nil, fmt.Errorf("FlowSpec rule is %d octets long, at most 4095 fit in an NLRI", len(value))
+}
+
+func encodeFlowSpecPrefix(prefix string, offset uint8, ipv6 bool) ([]byte, error) {
+	_, network, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid FlowSpec prefix %q", prefix)
+	}
+	length, bits := network.Mask.Size()
+	if (bits == 128) != ipv6 {
+		return nil, fmt.Errorf("FlowSpec prefix %q doesn't match the family of the rule", prefix)
+	}
+	if !ipv6 {
+		if offset != 0 {
+			return nil, fmt.Errorf("FlowSpec prefix %q has an offset, which only IPv6 prefixes have", prefix)
+		}
+		return append([]byte{byte(length)}, network.IP.To4()[:(length+7)/8]...), nil
+	}
+	if int(offset) > length {
+		return nil, fmt.Errorf("offset %d is past the end of FlowSpec prefix %q", offset, prefix)
+	}
+	// RFC 8956 sends the bits from the offset to the prefix length
+	addr := network.IP.To16()
+	pattern := make([]byte, (length-int(offset)+7)/8)
+	for i := int(offset); i < length; i++ {
+		if addr[i/8]&(0x80>>(i%8)) != 0 {
+			j := i - int(offset)
+			pattern[j/8] |= 0x80 >> (j % 8)
+		}
+	}
+	return append([]byte{byte(length), offset}, pattern...), nil
+}
+
+// parseFlowSpecOps parses the text of a numeric or bitmask component
+func parseFlowSpecOps(text string, c flowSpecComponent) ([]flowSpecOp, error) {
+	ops := []flowSpecOp{}
+	for _, alternative := range strings.Fields(text) {
+		for i, term := range strings.Split(alternative, "&") {
+			var parsed []flowSpecOp
+			var err error
+			if c.flags != nil {
+				parsed, err = parseBitmaskTerm(term, c.flags)
+			} else {
+				parsed, err = parseNumericTerm(term)
+			}
+			if err != nil {
+				return nil, err
+			}
+			for j, op := range parsed {
+				if op.value > c.max {
+					return nil, fmt.Errorf("%d is larger than the maximum %d", op.value, c.max)
+				}
+				op.and = i > 0 || j > 0
+				ops = append(ops, op)
+			}
+		}
+	}
+	return ops, nil
+}
+
+func parseNumericTerm(term string) ([]flowSpecOp, error) {
+	switch term {
+	case "true":
+		return []flowSpecOp{{bits: 0x07}}, nil
+	case "false":
+		return []flowSpecOp{{bits: 0x00}}, nil
+	}
+	if low, high, ok := strings.Cut(term, "-"); ok {
+		from, err := strconv.ParseUint(low, 10, 32)
+		to, err2 := strconv.ParseUint(high, 10, 32)
+		if err != nil || err2 != nil || from > to {
+			return nil, fmt.Errorf("invalid range %q", term)
+		}
+		return []flowSpecOp{{bits: 0x03, value: from}, {bits: 0x05, value: to}}, nil
+	}
+	op := flowSpecOp{bits: 0x01}
+	for _, o := range numericOps {
+		if strings.HasPrefix(term, o.text) {
+			op.bits = o.bits
+			term = term[len(o.text):]
+			break
+		}
+	}
+	value, err := strconv.ParseUint(term, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q", term)
+	}
+	op.value = value
+	return []flowSpecOp{op}, nil
+}
+
+func parseBitmaskTerm(term string, flags []flowSpecFlag) ([]flowSpecOp, error) {
+	op := flowSpecOp{}
+	switch {
+	case strings.HasPrefix(term, "!="):
+		op.bits = flowSpecNot | flowSpecMatch
+	case strings.HasPrefix(term, "!"):
+		op.bits = flowSpecNot
+	case strings.HasPrefix(term, "="):
+		op.bits = flowSpecMatch
+	}
+	term = strings.TrimLeft(term, "!=")
+parts:
+	for _, part := range strings.Split(term, "|") {
+		for _, flag := range flags {
+			if part == flag.name {
+				op.value |= flag.bit
+				continue parts
+			}
+		}
+		value, err := strconv.ParseUint(part, 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("unknown flag %q", part)
+		}
+		op.value |= value
+	}
+	return []flowSpecOp{op}, nil
+}
+
+func encodeFlowSpecOps(ops []flowSpecOp) []byte {
+	b := []byte{}
+	for i, o := range ops {
+		op := o.bits
+		if o.and {
+			op |= flowSpecAnd
+		}
+		if i == len(ops)-1 {
+			op |= flowSpecEndOfList
+		}
+		switch {
+		case o.value > 0xffff:
+			b = appendUint32(append(b, op|0x20), uint32(o.value))
+		case o.value > 0xff:
+			b = appendUint16(append(b, op|0x10), uint16(o.value))
+		default:
+			b = append(b, op, byte(o.value))
+		}
+	}
+	return b
+}
+
+// DecodeFlowSpec decodes the FlowSpec NLRIs in the NLRI field of an
+// MP_REACH_NLRI or MP_UNREACH_NLRI attribute. The rules decoded before an
+// error are returned with it.
+func DecodeFlowSpec(b []byte, ipv6 bool) ([]FlowSpec, error) {
+	rules := []FlowSpec{}
+	for len(b) > 0 {
+		header, length := 1, int(b[0])
+		if b[0]&0xf0 == 0xf0 {
+			if len(b) < 2 {
+				return rules, errors.New("FlowSpec NLRI length is cut off")
+			}
+			header, length = 2, int(binary.BigEndian.Uint16(b)&0x0fff)
+		}
+		if header+length > len(b) {
+			return rules, fmt.Errorf("FlowSpec NLRI length %d runs past the attribute", length)
+		}
+		rule, err := decodeFlowSpecRule(b[header:header+length], ipv6)
+		if err != nil {
+			return rules, err
+		}
+		rules = append(rules, rule)
+		b = b[header+length:]
+	}
+	return rules, nil
+}
+
+func decodeFlowSpecRule(b []byte, ipv6 bool) (FlowSpec, error) {
+	f := FlowSpec{Family: FlowSpecIPv4}
+	if ipv6 {
+		f.Family = FlowSpecIPv6
+	}
+	if len(b) == 0 {
+		return f, errors.New("FlowSpec NLRI has no components")
+	}
+	last := byte(0)
+	for len(b) > 0 {
+		code := b[0]
+		b = b[1:]
+		if code <= last {
+			return f, fmt.Errorf("FlowSpec component type %d follows type %d, they must be in increasing order", code, last)
+		}
+		last = code
+
+		if code == flowSpecDestination || code == flowSpecSource {
+			prefix, offset, n, err := decodeFlowSpecPrefix(b, ipv6)
+			if err != nil {
+				return f, err
+			}
+			if code == flowSpecDestination {
+				f.Destination, f.DestinationOffset = prefix, offset
+			} else {
+				f.Source, f.SourceOffset = prefix, offset
+			}
+			b = b[n:]
+			continue
+		}
+
+		var component *flowSpecComponent
+		for i := range flowSpecComponents {
+			if flowSpecComponents[i].code == code {
+				component = &flowSpecComponents[i]
+			}
+		}
+		if component == nil {
+			return f, fmt.Errorf("unknown FlowSpec component type %d", code)
+		}
+		text, n, err := decodeFlowSpecOps(b, component.flags)
+		if err != nil {
+			return f, fmt.Errorf("FlowSpec %s %w", component.name, err)
+		}
+		*component.field(&f) = text
+		b = b[n:]
+	}
+	return f, nil
+}
+
+func decodeFlowSpecPrefix(b []byte, ipv6 bool) (string, uint8, int, error) {
+	if !ipv6 {
+		if len(b) < 1 || b[0] > 32 || 1+(int(b[0])+7)/8 > len(b) {
+			return "", 0, 0, errors.New("invalid FlowSpec IPv4 prefix")
+		}
+		length := int(b[0])
+		addr := make(net.IP, 4)
+		copy(addr, b[1:1+(length+7)/8])
+		network := net.IPNet{IP: addr, Mask: net.CIDRMask(length, 32)}
+		return network.String(), 0, 1 + (length+7)/8, nil
+	}
+	if len(b) < 2 || b[0] > 128 || b[1] > b[0] {
+		return "", 0, 0, errors.New("invalid FlowSpec IPv6 prefix")
+	}
+	length, offset := int(b[0]), int(b[1])
+	n := 2 + (length-offset+7)/8
+	if n > len(b) {
+		return "", 0, 0, errors.New("FlowSpec IPv6 prefix runs past the NLRI")
+	}
+	addr := make(net.IP, 16)
+	for i := offset; i < length; i++ {
+		j := i - offset
+		if b[2+j/8]&(0x80>>(j%8)) != 0 {
+			addr[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	network := net.IPNet{IP: addr, Mask: net.CIDRMask(length, 128)}
+	return network.String(), uint8(offset), n, nil
+}
+
+// decodeFlowSpecOps decodes an operator list into the text form, returning
+// the number of octets it took
+func decodeFlowSpecOps(b []byte, flags []flowSpecFlag) (string, int, error) {
+	alternatives := []string{}
+	for i := 0; ; {
+		if i >= len(b) {
+			return "", 0, errors.New("operators run past the NLRI")
+		}
+		op := b[i]
+		size := 1 << (op & flowSpecLength >> 4)
+		i++
+		if i+size > len(b) {
+			return "", 0, errors.New("value runs past the NLRI")
+		}
+		var value uint64
+		for _, v := range b[i : i+size] {
+			value = value<<8 | uint64(v)
+		}
+		i += size
+
+		var term string
+		if flags != nil {
+			term = formatBitmaskTerm(op, value, flags)
+		} else {
+			term = formatNumericTerm(op, value)
+		}
+		if op&flowSpecAnd != 0 && len(alternatives) > 0 {
+			alternatives[len(alternatives)-1] += "&" + term
+		} else {
+			alternatives = append(alternatives, term)
+		}
+		if op&flowSpecEndOfList != 0 {
+			return strings.Join(alternatives, " "), i, nil
+		}
+	}
+}
+
+func formatNumericTerm(op byte, value uint64) string {
+	switch op & 0x07 {
+	case 0x00:
+		return "false"
+	case 0x07:
+		return "true"
+	case 0x01:
+		return strconv.FormatUint(value, 10)
+	}
+	for _, o := range numericOps {
+		if o.bits == op&0x07 {
+			return o.text + strconv.FormatUint(value, 10)
+		}
+	}
+	return ""
+}
+
+func formatBitmaskTerm(op byte, value uint64, flags []flowSpecFlag) string {
+	prefix := ""
+	if op&flowSpecNot != 0 {
+		prefix += "!"
+	}
+	if op&flowSpecMatch != 0 {
+		prefix += "="
+	}
+	names := []string{}
+	rest := value
+	for _, flag := range flags {
+		if rest&flag.bit != 0 {
+			names = append(names, flag.name)
+			rest &^= flag.bit
+		}
+	}
+	if rest != 0 || len(names) == 0 {
+		return prefix + strconv.FormatUint(value, 10)
+	}
+	return prefix + strings.Join(names, "|")
+}
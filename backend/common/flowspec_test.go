@@ -0,0 +1,208 @@
+package common
+
+import (
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFlowSpecRoundTrip(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		rule FlowSpec
+		wire string   // Encoded NLRI, when checked
+		want FlowSpec // Decoded rule, when it differs besides the family
+	}{
+		{
+			name: "IPv4 prefixes",
+			rule: FlowSpec{Destination: "192.0.2.0/24", Source: "198.51.100.0/25"},
+			wire: "0b" + "0118c00002" + "0219c6336400",
+		},
+		{
+			name: "IPv4 default route",
+			rule: FlowSpec{Destination: "0.0.0.0/0"},
+			wire: "020100",
+		},
+		{
+			name: "numeric operators",
+			rule: FlowSpec{
+				Destination:     "192.0.2.0/24",
+				Protocol:        "6 17",
+				DestinationPort: "80 >=8000&<=8080 !=443",
+				PacketLength:    "<64 >1500",
+				DSCP:            "46",
+			},
+		},
+		{
+			name: "two-octet value",
+			rule: FlowSpec{Protocol: "6", Port: "443"},
+			wire: "07" + "038106" + "04" + "9101bb",
+		},
+		{
+			name: "range",
+			rule: FlowSpec{SourcePort: "1024-65535"},
+			wire: "07" + "06" + "130400" + "d5ffff",
+			want: FlowSpec{SourcePort: ">=1024&<=65535"},
+		},
+		{
+			name: "true and false",
+			rule: FlowSpec{ICMPType: "true", ICMPCode: "false"},
+		},
+		{
+			name: "bitmask operators",
+			rule: FlowSpec{Protocol: "6", TCPFlags: "syn|ack =syn !rst !=fin|psh"},
+			wire: "0c" + "038106" + "09" + "0012" + "0102" + "0204" + "8309",
+		},
+		{
+			name: "unnamed bits",
+			rule: FlowSpec{TCPFlags: "0x100 syn|0x200"},
+			want: FlowSpec{TCPFlags: "256 514"},
+		},
+		{
+			name: "fragment",
+			rule: FlowSpec{Destination: "192.0.2.1/32", Fragment: "dont-fragment is-fragment|first-fragment"},
+		},
+		{
+			name: "IPv6 prefixes",
+			rule: FlowSpec{Destination: "2001:db8::/32", Source: "2001:db8:1::/48"},
+			wire: "10" + "01200020010db8" + "02300020010db80001",
+		},
+		{
+			name: "IPv6 offset",
+			rule: FlowSpec{Destination: "::1234:5678:9a00:0/104", DestinationOffset: 64},
+			wire: "08" + "016840" + "12345678" + "9a",
+		},
+		{
+			name: "IPv6 components",
+			rule: FlowSpec{
+				Family:       FlowSpecIPv6,
+				Destination:  "2001:db8::/64",
+				Protocol:     "58",
+				ICMPType:     "128 129",
+				Fragment:     "last-fragment",
+				PacketLength: ">=1280",
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			b, err := test.rule.Encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.wire != "" && hex.EncodeToString(b) != test.wire {
+				t.Errorf("encoded as %x, want %s", b, test.wire)
+			}
+			rules, err := DecodeFlowSpec(b, test.rule.IPv6())
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := test.want
+			if reflect.DeepEqual(want, FlowSpec{}) {
+				want = test.rule
+			}
+			want.Family = FlowSpecIPv4
+			if test.rule.IPv6() {
+				want.Family = FlowSpecIPv6
+			}
+			if len(rules) != 1 || !reflect.DeepEqual(rules[0], want) {
+				t.Errorf("decoded as %+v, want %+v", rules, want)
+			}
+		})
+	}
+}
+
+// alternatives returns n destination port values, each taking two octets
+func alternatives(n int) string {
+	return strings.TrimSpace(strings.Repeat("80 ", n))
+}
+
+func TestFlowSpecLength(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		rule   FlowSpec
+		header string
+	}{
+		// A /25 takes 6 octets and a /24 5, the port component takes 1 plus 2 per
+		// value
+		{"239 octets", FlowSpec{Destination: "192.0.2.0/25", DestinationPort: alternatives(116)}, "ef"},
+		{"240 octets", FlowSpec{Destination: "192.0.2.0/24", DestinationPort: alternatives(117)}, "f0f0"},
+		{"4095 octets", FlowSpec{Destination: "192.0.2.0/25", DestinationPort: alternatives(2044)}, "ffff"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			b, err := test.rule.Encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(hex.EncodeToString(b), test.header) {
+				t.Errorf("encoded as %x..., want the length %s", b[:2], test.header)
+			}
+			// Two rules back to back make sure the length is where the next starts
+			rules, err := DecodeFlowSpec(append(append([]byte{}, b...), b...), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rules) != 2 || rules[1].DestinationPort != test.rule.DestinationPort {
+				t.Errorf("decoded %d rules, want 2 with the same ports", len(rules))
+			}
+		})
+	}
+
+	rule := FlowSpec{Destination: "192.0.2.0/24", DestinationPort: alternatives(2045)}
+	if _, err := rule.Encode(); err == nil {
+		t.Error("encoded a 4096 octet rule")
+	}
+}
+
+func TestFlowSpecEncodeInvalid(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		rule FlowSpec
+	}{
+		{"empty", FlowSpec{}},
+		{"family", FlowSpec{Family: "ipv5", Protocol: "6"}},
+		{"prefix", FlowSpec{Destination: "192.0.2.0"}},
+		{"mixed families", FlowSpec{Destination: "192.0.2.0/24", Source: "2001:db8::/32"}},
+		{"family mismatch", FlowSpec{Family: FlowSpecIPv4, Destination: "2001:db8::/32"}},
+		{"IPv4 offset", FlowSpec{Destination: "192.0.2.0/24", DestinationOffset: 8}},
+		{"offset past the prefix", FlowSpec{Destination: "2001:db8::/32", DestinationOffset: 33}},
+		{"value", FlowSpec{Port: "http"}},
+		{"too large", FlowSpec{Protocol: "256"}},
+		{"range", FlowSpec{Port: "8080-8000"}},
+		{"flag", FlowSpec{TCPFlags: "syn|foo"}},
+		{"IPv6 dont-fragment", FlowSpec{Family: FlowSpecIPv6, Fragment: "dont-fragment"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if b, err := test.rule.Encode(); err == nil {
+				t.Errorf("encoded as %x, want an error", b)
+			}
+		})
+	}
+}
+
+func TestDecodeFlowSpecInvalid(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		wire string
+		ipv6 bool
+	}{
+		{"length cut off", "f0", false},
+		{"length past the NLRI", "05010000", false},
+		{"no components", "00", false},
+		{"out of order", "04" + "038106" + "02", false},
+		{"unknown component", "03" + "0d8100", false},
+		{"IPv4 prefix too long", "03" + "0121c0", false},
+		{"IPv4 prefix cut off", "03" + "0118c0", false},
+		{"IPv6 offset past the prefix", "04" + "01202100", true},
+		{"IPv6 prefix cut off", "05" + "0120002001", true},
+		{"no end of list", "03" + "030106", false},
+		{"value cut off", "03" + "039106", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			b, _ := hex.DecodeString(test.wire)
+			if rules, err := DecodeFlowSpec(b, test.ipv6); err == nil {
+				t.Errorf("decoded as %+v, want an error", rules)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package common
+
+import "fmt"
+
+// BGP Roles from RFC 9234
+const (
+	RoleProvider = "provider"
+	RoleRS       = "rs"
+	RoleRSClient = "rs-client"
+	RoleCustomer = "customer"
+	RolePeer     = "peer"
+)
+
+var roleCodes = map[string]byte{
+	RoleProvider: 0,
+	RoleRS:       1,
+	RoleRSClient: 2,
+	RoleCustomer: 3,
+	RolePeer:     4,
+}
+
+// RoleCode returns the value of a role in the BGP Role capability
+func RoleCode(role string) (byte, bool) {
+	code, ok := roleCodes[role]
+	return code, ok
+}
+
+// RoleName returns the role for a BGP Role capability value, unknown values
+// are kept as their number
+func RoleName(code byte) string {
+	for name, c := range roleCodes {
+		if c == code {
+			return name
+		}
+	}
+	return fmt.Sprint(code)
+}
+
+// ValidateRole checks that a role is one RFC 9234 defines, an empty role
+// means none is advertised
+func ValidateRole(role string) error {
+	if _, ok := roleCodes[role]; role != "" && !ok {
+		return fmt.Errorf("invalid BGP Role %q, use one of provider, customer, peer, rs or rs-client", role)
+	}
+	return nil
+}
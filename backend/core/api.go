@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/hamptonmoore/bgp.exposed/backend/bgp"
+	"github.com/hamptonmoore/bgp.exposed/backend/common"
+)
+
+// apiError responds with an Error packet's data, the same error format the
+// websocket uses
+func apiError(c *fiber.Ctx, status int, message string) error {
+	return c.Status(status).JSON(common.Error{
+		Message: message,
+	})
+}
+
+// authorized reports whether the request carries the peer's session token or
+// an API key covering its peer IP. The share token is enough for reading.
+func authorized(c *fiber.Ctx, peer *bgp.Peer, write bool) bool {
+	token := c.Get("X-Session-Token", c.Query("token"))
+	if !write && peer.CheckShareToken(token) {
+		return true
+	}
+	return peer.CheckToken(token) || policy.KeyAllows(c.Get("X-API-Key"), net.ParseIP(peer.PeerIP))
+}
+
+func hasCredentials(c *fiber.Ctx) bool {
+	return c.Get("X-Session-Token", c.Query("token")) != "" || c.Get("X-API-Key") != ""
+}
+
+// lookupPeer finds the peer addressed by the :peerIP and :peerASN route
+// parameters, if the request is authorized to read it, or change it if write
+// is set. Otherwise the error response has already been written and the peer
+// is nil.
+func lookupPeer(c *fiber.Ctx, write bool) (*bgp.Peer, error) {
+	if !hasCredentials(c) {
+		return nil, apiError(c, fiber.StatusUnauthorized, "Session token or API key required")
+	}
+
+	peerIP, err := url.PathUnescape(c.Params("peerIP"))
+	if err != nil {
+		return nil, apiError(c, fiber.StatusBadRequest, "Invalid peer IP")
+	}
+	request := common.CreateRequest{PeerIP: peerIP}
+	asn, err := c.ParamsInt("peerASN")
+	if err != nil || asn < 0 {
+		return nil, apiError(c, fiber.StatusBadRequest, "Invalid peer ASN")
+	}
+	request.PeerASN = uint32(asn)
+
+	peer, ok := server.GetPeer(request.ToKey())
+	if !ok {
+		return nil, apiError(c, fiber.StatusNotFound, "Session not found")
+	}
+	if !authorized(c, peer, write) {
+		return nil, apiError(c, fiber.StatusForbidden, "Invalid session token or API key")
+	}
+	return peer, nil
+}
+
+// registerAPI adds the REST API, which exposes the same sessions as the
+// websocket for scripting and monitoring. Requests need the session token
+// from the CreateResponse in an X-Session-Token header or token query
+// parameter, or an API key from the policy in an X-API-Key header.
+func registerAPI(api fiber.Router) {
+	// List the sessions the request is authorized for
+	api.Get("/sessions", func(c *fiber.Ctx) error {
+		if !hasCredentials(c) {
+			return apiError(c, fiber.StatusUnauthorized, "Session token or API key required")
+		}
+		sessions := []common.Session{}
+		for _, peer := range server.ListPeers() {
+			if authorized(c, peer, false) {
+				sessions = append(sessions, peer.Session())
+			}
+		}
+		return c.JSON(sessions)
+	})
+
+	session := api.Group("/sessions/:peerIP/:peerASN")
+
+	session.Get("/", func(c *fiber.Ctx) error {
+		peer, err := lookupPeer(c, false)
+		if peer == nil {
+			return err
+		}
+		return c.JSON(peer.Session())
+	})
+
+	// Close the session, ending its websocket too
+	session.Delete("/", func(c *fiber.Ctx) error {
+		peer, err := lookupPeer(c, true)
+		if peer == nil {
+			return err
+		}
+		log.Infof("[API] %s closing session %s", c.IP(), peer.Key)
+		peer.LogAction("close", "Session closed over the REST API")
+		peer.Close()
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	session.Get("/routes/received", func(c *fiber.Ctx) error {
+		peer, err := lookupPeer(c, false)
+		if peer == nil {
+			return err
+		}
+		return c.JSON(peer.Received.Routes())
+	})
+
+	session.Get("/routes/announced", func(c *fiber.Ctx) error {
+		peer, err := lookupPeer(c, false)
+		if peer == nil {
+			return err
+		}
+		return c.JSON(peer.Announced.Routes())
+	})
+
+	// Download the session's event log as JSON Lines, optionally only events
+	// after a sequence number, of some kinds or the most recent ones
+	session.Get("/events", func(c *fiber.Ctx) error {
+		peer, err := lookupPeer(c, false)
+		if peer == nil {
+			return err
+		}
+		query := common.EventQuery{}
+		if limit := c.Query("limit"); limit != "" {
+			query.Limit, err = strconv.Atoi(limit)
+			if err != nil {
+				return apiError(c, fiber.StatusBadRequest, "Invalid limit")
+			}
+		}
+		if after := c.Query("after"); after != "" {
+			query.After, err = strconv.ParseUint(after, 10, 64)
+			if err != nil {
+				return apiError(c, fiber.StatusBadRequest, "Invalid after")
+			}
+		}
+		if kinds := c.Query("kind"); kinds != "" {
+			query.Kinds = strings.Split(kinds, ",")
+		}
+
+		buf := &bytes.Buffer{}
+		encoder := json.NewEncoder(buf)
+		for _, event := range peer.Events(query) {
+			encoder.Encode(event)
+		}
+		filename := fmt.Sprintf("bgp.exposed-%s-%d.jsonl", strings.ReplaceAll(peer.PeerIP, ":", "-"), peer.PeerASN)
+		c.Set(fiber.HeaderContentType, "application/x-ndjson")
+		c.Set(fiber.HeaderContentDisposition, `attachment; filename="`+filename+`"`)
+		return c.Send(buf.Bytes())
+	})
+
+	// Announce and/or withdraw routes, taking the same RouteData as the
+	// websocket. They're queued and sent once the session is up.
+	session.Post("/routes", func(c *fiber.Ctx) error {
+		peer, err := lookupPeer(c, true)
+		if peer == nil {
+			return err
+		}
+		if err := checkMessage(c.IP(), nil); err != nil {
+			return c.Status(fiber.StatusTooManyRequests).JSON(err)
+		}
+		v := common.RouteData{}
+		if err := json.Unmarshal(c.Body(), &v); err != nil {
+			return apiError(c, fiber.StatusBadRequest, "Invalid RouteData: "+err.Error())
+		}
+		if err := v.Validate(); err != nil {
+			return apiError(c, fiber.StatusBadRequest, err.Error())
+		}
+		log.Infof("[API] %s announcing/withdrawing routes on %s: %+v", c.IP(), peer.Key, v)
+		if err := queueRoutes(peer, &v); err != nil {
+			status := fiber.StatusTooManyRequests
+			if err.Code == common.ErrTooManyRoutes {
+				status = fiber.StatusRequestEntityTooLarge
+			}
+			return c.Status(status).JSON(err)
+		}
+		return c.SendStatus(fiber.StatusAccepted)
+	})
+}
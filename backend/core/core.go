@@ -5,18 +5,27 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"regexp"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
 	"time"
 
 	_ "embed"
 
-	"github.com/bgptools/fgbgp/messages"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/websocket/v2"
+	"github.com/hamptonmoore/bgp.exposed/backend/aspa"
+	"github.com/hamptonmoore/bgp.exposed/backend/auth"
 	"github.com/hamptonmoore/bgp.exposed/backend/bgp"
+	"github.com/hamptonmoore/bgp.exposed/backend/bmp"
 	"github.com/hamptonmoore/bgp.exposed/backend/common"
+	"github.com/hamptonmoore/bgp.exposed/backend/metrics"
+	"github.com/hamptonmoore/bgp.exposed/backend/mrt"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
 )
 
 var (
@@ -26,21 +35,59 @@ var (
 	bgpPublicAddr = flag.String("bgp.publicAddr", "", "BGP public listen address. Defaults to bgp.addr but cannot be 0.0.0.0.")
 	bgpPort       = flag.Int("bgp.port", 2000, "BGP listen port")
 	bgpRouterId   = flag.String("bgp.routerId", "", "BGP router ID. Defaults to bgp.publicAddr.")
+	bgpASN        = flag.Uint("bgp.asn", 1000, "ASN of connections until they are matched to a session, sessions use their own local ASN")
+	bgpActive     = flag.Bool("bgp.active", true, "Allow sessions to connect out to their peer instead of waiting for it")
+	bgpRobustness = flag.Bool("bgp.robustness", false, "Allow sessions to run robustness tests, which send their peer malformed UPDATEs")
+	bgpLocalASNs  = flag.String("bgp.localASNs", "any", "Local ASNs sessions may use, as a comma separated list of \"any\", \"private\" (RFC 6996), ASNs and ranges like 65000-65010")
 	logLevel      = flag.String("log.level", "info", "Log level can be trace, debug, info, warn, or error")
 	logTimestamp  = flag.Bool("log.timestamp", true, "Show timestamp in logs. Disable if you are using an external logging system like systemd.")
+	bmpCollector  = flag.String("bmp.collector", "", "Address (host:port) of a BMP collector to export sessions to. Disabled if empty.")
+	bmpStats      = flag.Duration("bmp.statsInterval", time.Minute, "Interval between BMP Statistics Reports")
+	replayDir     = flag.String("replay.dir", "", "Directory of MRT BGP4MP update files clients may replay. Replays are disabled if empty.")
+	routesetsMRT  = flag.String("routesets.mrt", "", "Path to a JSON file mapping routeset names to MRT RIB files to expose as routesets")
+	authPolicy    = flag.String("auth.policy", "", "Path to a JSON policy of which client addresses and API keys may claim which peer IPs. Anyone can claim any peer IP if empty.")
+	sessionGrace  = flag.Duration("session.grace", time.Minute, "How long a session is kept after its websocket closes, for the client to reattach")
+	proxyHeader   = flag.String("http.proxyHeader", "", "Header holding the client IP when behind a reverse proxy, like X-Real-IP")
+	aspaFile      = flag.String("aspa.file", "", "Path to an rpki-client JSON export to verify routes from customers, lateral peers and route server clients with ASPA. Disabled if empty.")
+	aspaReload    = flag.Duration("aspa.reload", 10*time.Minute, "How often to check aspa.file for changes")
+)
+
+// Limits on what a client can do
+var (
+	limitSessions         = flag.Int("limits.sessionsPerIP", 0, "Concurrent sessions per client address, 0 for unlimited")
+	limitPrefixes         = flag.Int("limits.prefixes", 0, "Announced prefixes per session, 0 for unlimited")
+	limitPrefixesPerIP    = flag.Int("limits.prefixesPerIP", 0, "Announced prefixes over all sessions of a client address, 0 for unlimited")
+	limitRate             = flag.Float64("limits.messageRate", 0, "Websocket messages per second per connection, 0 for unlimited")
+	limitRatePerIP        = flag.Float64("limits.messageRatePerIP", 0, "Websocket and REST messages per second per client address, 0 for unlimited")
+	limitReceived         = flag.Int("limits.receivedPrefixes", 0, "Cap on the maximum-prefix limit of every session, also applied to sessions without one. 0 for no cap.")
+	limitRoutesPerMessage = flag.Int("limits.routesPerMessage", 0, "Prefixes, FlowSpec rules and withdraws in a single RouteData message, 0 for unlimited.")
 )
 
 var server *bgp.BGPServer
+var policy *auth.Policy
 var log *logrus.Logger
 
 //go:embed routesets.json
 var routesets []byte
 
+func sendError(sub *bgp.Subscriber, message string) {
+	sub.Report(common.Error{
+		Message: message,
+	})
+}
+
 func ClientHandler(c *websocket.Conn) {
-	log.Debugf("[ClientHandler %p] started for client %s", &c, c.RemoteAddr().String())
+	remoteIP, _ := c.Locals("remoteIP").(string)
+	log.Debugf("[ClientHandler %p] started for client %s", &c, remoteIP)
+	metrics.WebsocketClients.Inc()
+	defer metrics.WebsocketClients.Dec()
 	var peer *bgp.Peer
+	var sub *bgp.Subscriber
+	var rate bucket
 
 	started := make(chan bool, 1)
+	// ctx lasts as long as the websocket, the peer has its own context as
+	// it may outlive it
 	ctx, cancel := context.WithCancel(context.Background())
 
 	// send initial data to client
@@ -57,24 +104,41 @@ func ClientHandler(c *websocket.Conn) {
 	go func() {
 		log.Tracef("[ClientHandler %p][peer->web] waiting for bgp server peer create", &c)
 		// Don't do anything until we get a message on the "started" channel
-		<-started
+		select {
+		case <-started:
+		case <-ctx.Done():
+			return
+		}
 
-		go func() {
-			log.Tracef("[ClientHandler %p][peer->web] received \"started\" message, starting loop", &c)
-			for {
-				select {
-				case val := <-peer.SendChan:
-					log.Tracef("[ClientHandler %p][peer->web] received message from peer, passing to client: %+v", &c, val)
-					// take received data, convert to JSON, and send over the WS to the client
-					data, _ := json.Marshal(val)
-					c.WriteMessage(1, data)
-				case <-ctx.Done():
-					log.Debugf("[ClientHandler %p][peer->web] websocket closed, ending goroutine", &c)
-					// If WS closes, return
-					return
-				}
+		log.Tracef("[ClientHandler %p][peer->web] received \"started\" message, starting loop", &c)
+		for {
+			select {
+			case val := <-sub.Packets:
+				log.Tracef("[ClientHandler %p][peer->web] received message from peer, passing to client: %+v", &c, val)
+				// take received data, convert to JSON, and send over the WS to the client
+				data, _ := json.Marshal(val)
+				c.WriteMessage(1, data)
+			case <-sub.Done():
+				log.Debugf("[ClientHandler %p][peer->web] dropped by peer, closing websocket: %s", &c, sub.Reason())
+				data, _ := json.Marshal(common.Packet{
+					Type: "Error",
+					Data: common.Error{
+						Message: sub.Reason(),
+					},
+				})
+				c.WriteMessage(1, data)
+				c.Close()
+				return
+			case <-peer.Context.Done():
+				log.Debugf("[ClientHandler %p][peer->web] session closed, closing websocket", &c)
+				c.Close()
+				return
+			case <-ctx.Done():
+				log.Debugf("[ClientHandler %p][peer->web] websocket closed, ending goroutine", &c)
+				// If WS closes, return
+				return
 			}
-		}()
+		}
 	}()
 
 	log.Tracef("[ClientHandler %p] starting main loop for processing web->peer websocket messages", &c)
@@ -87,6 +151,20 @@ func ClientHandler(c *websocket.Conn) {
 			break
 		}
 
+		if err := checkMessage(remoteIP, &rate); err != nil {
+			log.Debugf("[ClientHandler %p] rate limited, discarding message", &c)
+			if sub != nil {
+				sub.Report(*err)
+			} else {
+				data, _ := json.Marshal(common.Packet{
+					Type: "Error",
+					Data: *err,
+				})
+				c.WriteMessage(1, data)
+			}
+			continue
+		}
+
 		// Unpack it into the Packet struct
 		var packet common.Packet
 		if err := json.Unmarshal(message, &packet); err != nil {
@@ -111,24 +189,90 @@ func ClientHandler(c *websocket.Conn) {
 					log.Warnf("[ClientHandler %p] error unmarshalling CreateRequest, discarding: %s", &c, err)
 					break
 				}
-				log.Infof("[ClientHandler %p] %s requested to create peer on bgp server: %+v", &c, c.RemoteAddr().String(), v)
-				
+				if !policy.AllowClaim(net.ParseIP(remoteIP), v.APIKey, net.ParseIP(v.PeerIP)) {
+					log.Warnf("[ClientHandler %p] %s is not allowed to claim peer IP %s", &c, remoteIP, v.PeerIP)
+					data, _ := json.Marshal(common.Packet{
+						Type: "Error",
+						Data: common.Error{
+							Message: "Not allowed to create a session for peer IP " + v.PeerIP,
+						},
+					})
+					c.WriteMessage(1, data)
+					continue
+				}
+				v.APIKey = ""
+				log.Infof("[ClientHandler %p] %s requested to create peer on bgp server: %+v", &c, remoteIP, v)
+
 				// Create the BGP server using the data we extracted
-				peer, err = server.CreatePeer(&v, ctx, cancel)
+				peerCtx, peerCancel := context.WithCancel(context.Background())
+				peer, err = server.CreatePeer(&v, remoteIP, peerCtx, peerCancel)
 				if err != nil {
+					peerCancel()
 					log.Warnf("[ClientHandler %p] peer create failed: %s", &c, err)
+					e, ok := err.(common.Error)
+					if !ok {
+						e = common.Error{Message: err.Error()}
+					}
 					data, _ := json.Marshal(common.Packet{
 						Type: "Error",
-						Data: common.Error{
-							Message: err.Error(),
-						},
+						Data: e,
 					})
 					c.WriteMessage(1, data)
 				} else {
 					log.Tracef("[ClientHandler %p] peer create succeeded, sending message to peer->web goroutine and starting peer handler", &c)
+					sub, _ = peer.Attach(false)
+					peer.LogAction("create", "Session created")
+					// Hand out the session token before the peer->web
+					// goroutine starts writing to the websocket
+					data, _ := json.Marshal(common.Packet{
+						Type: "CreateResponse",
+						Data: common.CreateResponse{
+							Token:      peer.Token,
+							ShareToken: peer.ShareToken,
+						},
+					})
+					c.WriteMessage(1, data)
 					started <- true
 					go peer.Handler()
 				}
+			} else if packet.Type == "ReattachRequest" {
+				log.Tracef("[ClientHandler %p] packet is ReattachRequest", &c)
+				v := common.ReattachRequest{}
+				if err := json.Unmarshal(data, &v); err != nil {
+					log.Warnf("[ClientHandler %p] error unmarshalling ReattachRequest, discarding: %s", &c, err)
+					continue
+				}
+				existing, ok := server.GetPeer(v.ToKey())
+				// The share token only lets the client watch the session
+				readOnly := ok && existing.CheckShareToken(v.Token)
+				if !ok || (!readOnly && !existing.CheckToken(v.Token)) {
+					log.Warnf("[ClientHandler %p] %s failed reattaching to %s", &c, remoteIP, v.ToKey())
+					data, _ := json.Marshal(common.Packet{
+						Type: "Error",
+						Data: common.Error{
+							Message: "Session not found or invalid token",
+						},
+					})
+					c.WriteMessage(1, data)
+					continue
+				}
+				log.Infof("[ClientHandler %p] %s reattached to %s (read-only: %t)", &c, remoteIP, v.ToKey(), readOnly)
+				peer = existing
+				var snapshot common.Snapshot
+				sub, snapshot = peer.Attach(readOnly)
+				if readOnly {
+					peer.LogAction("attach", "Observer attached")
+				} else {
+					peer.LogAction("attach", "Controller reattached")
+				}
+				// Catch the client up before the peer->web goroutine starts
+				// on the live stream
+				data, _ := json.Marshal(common.Packet{
+					Type: "Snapshot",
+					Data: snapshot,
+				})
+				c.WriteMessage(1, data)
+				started <- true
 			} else {
 				log.Warnf("[ClientHandler %p] Got invalid request type for current state, discarding", &c)
 				data, _ := json.Marshal(common.Packet{
@@ -139,18 +283,29 @@ func ClientHandler(c *websocket.Conn) {
 				})
 				c.WriteMessage(1, data)
 			}
-		// If we've already created a BGP server
+			// If we've already created a BGP server
 		} else if peer != nil {
-			// then a CreateRequest is not valid
-			if packet.Type == "CreateRequest" {
+			// then a CreateRequest or ReattachRequest is not valid
+			if packet.Type == "CreateRequest" || packet.Type == "ReattachRequest" {
 				log.Warnf("[ClientHandler %p] Got CreateRequest but already created peer", &c)
-				data, _ := json.Marshal(common.Packet{
-					Type: "Error",
-					Data: common.Error{
-						Message: "Invalid request type for current state",
-					},
-				})
-				c.WriteMessage(1, data)
+				sendError(sub, "Invalid request type for current state")
+			} else if packet.Type == "EventQuery" {
+				log.Tracef("[ClientHandler %p] packet is EventQuery", &c)
+				v := common.EventQuery{}
+				if err := json.Unmarshal(data, &v); err != nil {
+					log.Warnf("[ClientHandler %p] error unmarshalling EventQuery, discarding: %s", &c, err)
+					continue
+				}
+				select {
+				case sub.Packets <- &common.Packet{
+					Type: "EventLog",
+					Data: common.EventLog{Events: peer.Events(v)},
+				}:
+				default:
+				}
+			} else if sub.ReadOnly {
+				log.Warnf("[ClientHandler %p] read-only observer sent %s, discarding", &c, packet.Type)
+				sendError(sub, "Observers can't change the session")
 			} else if packet.Type == "RouteData" {
 				log.Tracef("[ClientHandler %p] packet is RouteData", &c)
 				// Unpack packet's "data" field into a struct
@@ -159,28 +314,162 @@ func ClientHandler(c *websocket.Conn) {
 					log.Warnf("[ClientHandler %p] error unmarshalling RouteData, discarding: %s", &c, err)
 					break
 				}
+				if err := v.Validate(); err != nil {
+					log.Debugf("[ClientHandler %p] invalid RouteData, discarding: %s", &c, err)
+					sendError(sub, err.Error())
+					continue
+				}
 				log.Infof("[ClientHandler %p] announcing/withdrawing routes: %+v", &c, v)
 				// Send struct to BGP server
-				peer.RoutesToAnnounce <- &v
+				if err := queueRoutes(peer, &v); err != nil {
+					sub.Report(*err)
+				}
+			} else if packet.Type == "InspectRequest" {
+				log.Tracef("[ClientHandler %p] packet is InspectRequest", &c)
+				v := common.InspectRequest{}
+				if err := json.Unmarshal(data, &v); err != nil {
+					log.Warnf("[ClientHandler %p] error unmarshalling InspectRequest, discarding: %s", &c, err)
+					continue
+				}
+				peer.SetInspect(v.Enabled)
+				if v.Enabled {
+					peer.LogAction("inspect", "Started inspecting BGP messages")
+				} else {
+					peer.LogAction("inspect", "Stopped inspecting BGP messages")
+				}
+			} else if packet.Type == "RobustnessRequest" {
+				log.Tracef("[ClientHandler %p] packet is RobustnessRequest", &c)
+				v := common.RobustnessRequest{}
+				if err := json.Unmarshal(data, &v); err != nil {
+					log.Warnf("[ClientHandler %p] error unmarshalling RobustnessRequest, discarding: %s", &c, err)
+					continue
+				}
+				if err := peer.RunRobustness(v); err != nil {
+					sendError(sub, err.Error())
+					continue
+				}
+				log.Infof("[ClientHandler %p] starting robustness tests: %+v", &c, v)
+			} else if packet.Type == "ReplayRequest" {
+				log.Tracef("[ClientHandler %p] packet is ReplayRequest", &c)
+				v := common.ReplayRequest{}
+				if err := json.Unmarshal(data, &v); err != nil {
+					log.Warnf("[ClientHandler %p] error unmarshalling ReplayRequest, discarding: %s", &c, err)
+					continue
+				}
+				if *replayDir == "" {
+					sendError(sub, "Replays are disabled on this server")
+					continue
+				}
+				replay, err := mrt.NewReplay(filepath.Join(*replayDir, filepath.Base(v.File)), &v)
+				if err != nil {
+					sendError(sub, err.Error())
+					continue
+				}
+				if err := peer.StartReplay(replay); err != nil {
+					sendError(sub, err.Error())
+					continue
+				}
+				log.Infof("[ClientHandler %p] starting replay: %+v", &c, v)
+				peer.LogAction("replay", "Started replaying "+filepath.Base(v.File))
+				// The replay lasts as long as the session, not the websocket
+				go replay.Run(peer.Context, replayQueue(peer), peer.SendChan)
+			} else if packet.Type == "ReplayControl" {
+				log.Tracef("[ClientHandler %p] packet is ReplayControl", &c)
+				v := common.ReplayControl{}
+				if err := json.Unmarshal(data, &v); err != nil {
+					log.Warnf("[ClientHandler %p] error unmarshalling ReplayControl, discarding: %s", &c, err)
+					continue
+				}
+				if err := peer.ControlReplay(v); err != nil {
+					sendError(sub, err.Error())
+				} else {
+					peer.LogAction("replay-control", "Replay "+v.Action)
+				}
 			} else {
 				log.Warnf("[ClientHandler %p] unknown or invalid packet type, discarding: %s", &c, packet.Type)
 			}
 		}
 	}
-	if peer != nil {
-		peer.KeepAlive <- &messages.BGPMessageKeepAlive{}
+	// Keep the session around in case the client comes back
+	if peer != nil && sub != nil {
+		peer.Detach(sub)
+		if sub.ReadOnly {
+			peer.LogAction("detach", "Observer detached")
+		} else {
+			peer.LogAction("detach", "Controller detached")
+		}
 	}
 	cancel()
 	time.Sleep(time.Second * 5)
 	log.Debugf("[ClientHandler %p] ending", &c)
 }
 
+// loadMRTRoutesets reads a JSON file of named mrt.RIBSource definitions and adds
+// each as a routeset
+func loadMRTRoutesets(path string, sets map[string][]common.RoutesetRoute) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	sources := map[string]mrt.RIBSource{}
+	if err := json.Unmarshal(data, &sources); err != nil {
+		return err
+	}
+
+	for name, source := range sources {
+		log.Infof("[loadMRTRoutesets] Loading routeset %s from %s", name, source.File)
+		routes, err := mrt.LoadRIB(source, log)
+		if err != nil {
+			return fmt.Errorf("routeset %s: %w", name, err)
+		}
+		sets[name] = routes
+	}
+	return nil
+}
+
+// reloadASPA rereads the ASPA objects whenever rpki-client updated its export
+func reloadASPA(set *aspa.Set) {
+	for range time.Tick(*aspaReload) {
+		reloaded, err := set.Reload()
+		if err != nil {
+			log.Warnf("[reloadASPA] Failed reloading %s, keeping the previous ASPA objects: %s", *aspaFile, err)
+		} else if reloaded {
+			log.Infof("[reloadASPA] Reloaded ASPA objects of %d customer ASes", set.Len())
+		}
+	}
+}
+
+// checkRoutesets makes sure every routeset can be announced as given
+func checkRoutesets(sets map[string][]common.RoutesetRoute) error {
+	for name, routes := range sets {
+		for _, route := range routes {
+			if err := route.AsPath.Validate(); err != nil {
+				return fmt.Errorf("routeset %s: %w", name, err)
+			}
+			if err := route.Aggregator.Validate(); err != nil {
+				return fmt.Errorf("routeset %s: %w", name, err)
+			}
+			for _, c := range route.ExtendedCommunities {
+				if _, err := common.ParseExtendedCommunity(c); err != nil {
+					return fmt.Errorf("routeset %s: %w", name, err)
+				}
+			}
+			for _, a := range route.RawAttributes {
+				if err := a.Validate(); err != nil {
+					return fmt.Errorf("routeset %s: %w", name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
 func main() {
 	flag.Parse()
 
 	// disable logging in underlying libraries
 	logrus.SetLevel(logrus.PanicLevel)
-	 
+
 	log = logrus.New()
 
 	logFormat := &logrus.TextFormatter{
@@ -204,8 +493,20 @@ func main() {
 	}
 	log.Infof("[main] Log level set to %s", *logLevel)
 
-	// Remove whitespace
-	routesets = []byte(regexp.MustCompile(`\s+`).ReplaceAllString(string(routesets), ""))
+	// Parse the embedded routesets and add any from MRT RIB files
+	sets := map[string][]common.RoutesetRoute{}
+	if err := json.Unmarshal(routesets, &sets); err != nil {
+		log.Fatalf("[main] Failed parsing embedded routesets: %s", err)
+	}
+	if *routesetsMRT != "" {
+		if err := loadMRTRoutesets(*routesetsMRT, sets); err != nil {
+			log.Fatalf("[main] Failed loading MRT routesets: %s", err)
+		}
+	}
+	if err := checkRoutesets(sets); err != nil {
+		log.Fatalf("[main] Invalid routeset: %s", err)
+	}
+	routesets, _ = json.Marshal(sets)
 
 	// if bgp.addr is 0.0.0.0, bgp.publicAddr must be set, and we log it for clarity
 	if *bgpAddr == "0.0.0.0" {
@@ -218,7 +519,7 @@ func main() {
 		} else {
 			log.Fatalf("Must specify non-0.0.0.0 bgp.publicAddr")
 		}
-		
+
 	} else {
 		*bgpPublicAddr = *bgpAddr
 
@@ -229,9 +530,49 @@ func main() {
 		log.Infof("[main] Starting BGP server on %s:%d with router ID %s", *bgpAddr, *bgpPort, *bgpRouterId)
 	}
 
-	server = bgp.CreateBGPServer(1000, fmt.Sprintf("%s:%d",*bgpAddr, *bgpPort), *bgpRouterId, log)
+	var bmpClient *bmp.Client
+	if *bmpCollector != "" {
+		log.Infof("[main] Exporting sessions to BMP collector %s", *bmpCollector)
+		bmpClient = bmp.NewClient(*bmpCollector, "bgp.exposed", "bgp.exposed "+*bgpRouterId, *bmpStats, log)
+		bmpClient.Start()
+	}
+
+	if *bgpASN == 0 || *bgpASN > math.MaxUint32 {
+		log.Fatalf("[main] Invalid bgp.asn %d", *bgpASN)
+	}
+	localASNs, err := bgp.ParseASNPolicy(*bgpLocalASNs)
+	if err != nil {
+		log.Fatalf("[main] Invalid bgp.localASNs: %s", err)
+	}
+	log.Infof("[main] Sessions may use local ASNs: %s", localASNs)
+
+	server = bgp.CreateBGPServer(uint32(*bgpASN), fmt.Sprintf("%s:%d", *bgpAddr, *bgpPort), *bgpRouterId, bmpClient, log)
+	server.GracePeriod = *sessionGrace
+	server.Limits = serverLimits()
+	server.LocalASNs = localASNs
+	server.AllowActive = *bgpActive
+	server.AllowRobustness = *bgpRobustness
 
-	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	if *aspaFile != "" {
+		set, err := aspa.Load(*aspaFile)
+		if err != nil {
+			log.Fatalf("[main] Failed loading ASPA objects: %s", err)
+		}
+		log.Infof("[main] Loaded ASPA objects of %d customer ASes from %s", set.Len(), *aspaFile)
+		server.ASPA = set
+		go reloadASPA(set)
+	}
+
+	if *authPolicy != "" {
+		var err error
+		policy, err = auth.Load(*authPolicy)
+		if err != nil {
+			log.Fatalf("[main] Failed loading auth policy: %s", err)
+		}
+		log.Infof("[main] Loaded auth policy from %s", *authPolicy)
+	}
+
+	app := fiber.New(fiber.Config{DisableStartupMessage: true, ProxyHeader: *proxyHeader})
 	app.Use(cors.New())
 
 	// Use middleware to upgrade "/ws" requests to a WebSocket
@@ -240,6 +581,7 @@ func main() {
 		// requested upgrade to the WebSocket protocol.
 		if websocket.IsWebSocketUpgrade(c) {
 			c.Locals("allowed", true)
+			c.Locals("remoteIP", c.IP())
 			return c.Next()
 		}
 		return fiber.ErrUpgradeRequired
@@ -248,12 +590,39 @@ func main() {
 	// Serve requests to /ws via ClientHandler
 	app.Get("/ws/", websocket.New(ClientHandler))
 
+	// REST API for sessions and routes
+	registerAPI(app.Group("/api"))
+
+	// Expose Prometheus metrics
+	metricsHandler := fasthttpadaptor.NewFastHTTPHandler(promhttp.Handler())
+	app.Get("/metrics", func(c *fiber.Ctx) error {
+		metricsHandler(c.Context())
+		return nil
+	})
+
 	// Serve static "routesets.json" file
 	app.Get("/routesets.json", func(c *fiber.Ctx) error {
 		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSONCharsetUTF8)
 		return c.Send(routesets)
 	})
 
+	// List the MRT update files available for replay
+	app.Get("/replays.json", func(c *fiber.Ctx) error {
+		files := []string{}
+		if *replayDir != "" {
+			entries, err := os.ReadDir(*replayDir)
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				if !entry.IsDir() {
+					files = append(files, entry.Name())
+				}
+			}
+		}
+		return c.JSON(files)
+	})
+
 	log.Infof("[main] Starting HTTP API on %s:%d", *httpAddr, *httpPort)
-	log.Fatal(app.Listen(fmt.Sprintf("%s:%d",*httpAddr, *httpPort)))
+	log.Fatal(app.Listen(fmt.Sprintf("%s:%d", *httpAddr, *httpPort)))
 }
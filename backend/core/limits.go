@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hamptonmoore/bgp.exposed/backend/bgp"
+	"github.com/hamptonmoore/bgp.exposed/backend/common"
+)
+
+// bucket is a token bucket allowing rate messages per second, with bursts of
+// up to a second's worth
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) allow(rate float64) bool {
+	if rate <= 0 {
+		return true
+	}
+	now := time.Now()
+	if b.last.IsZero() {
+		b.tokens = rate
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > rate {
+			b.tokens = rate
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// rateLimiter keeps a bucket per client address
+type rateLimiter struct {
+	lock    sync.Mutex
+	buckets map[string]*bucket
+}
+
+var ipRates = &rateLimiter{buckets: make(map[string]*bucket)}
+
+func (r *rateLimiter) allow(ip string, rate float64) bool {
+	if rate <= 0 {
+		return true
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// Buckets idle long enough to have refilled are the same as new ones
+	for key, b := range r.buckets {
+		if time.Since(b.last) > time.Second {
+			delete(r.buckets, key)
+		}
+	}
+	b, ok := r.buckets[ip]
+	if !ok {
+		b = &bucket{}
+		r.buckets[ip] = b
+	}
+	return b.allow(rate)
+}
+
+var errRateLimit = common.Error{
+	Code:    common.ErrRateLimit,
+	Message: "Sending too many messages, slow down",
+}
+
+// checkMessage rate limits a message from a client, with conn the bucket of
+// its websocket connection if any
+func checkMessage(ip string, conn *bucket) *common.Error {
+	if conn != nil && !conn.allow(*limitRate) {
+		return &errRateLimit
+	}
+	if !ipRates.allow(ip, *limitRatePerIP) {
+		return &errRateLimit
+	}
+	return nil
+}
+
+// queueRoutes checks a RouteData against the routes per message limit and
+// queues it for the peer without blocking
+func queueRoutes(peer *bgp.Peer, v *common.RouteData) *common.Error {
+	if err := limitRoutes(peer, v); err != nil {
+		return err
+	}
+	message := fmt.Sprintf("Queued %d prefixes to announce and %d to withdraw", len(v.Prefixes), len(v.Withdraws))
+	if len(v.FlowSpec) > 0 || len(v.FlowSpecWithdraws) > 0 {
+		message += fmt.Sprintf(", %d FlowSpec rules to announce and %d to withdraw", len(v.FlowSpec), len(v.FlowSpecWithdraws))
+	}
+	peer.LogAction("routes", message)
+	return nil
+}
+
+// replayQueue returns how a replay queues its routes. It is limited like a
+// websocket connection of its own, so it can't use up the rate its client
+// needs to control it. Routes aren't logged one by one as the replay reports
+// its progress.
+func replayQueue(peer *bgp.Peer) func(*common.RouteData) *common.Error {
+	rate := &bucket{}
+	return func(v *common.RouteData) *common.Error {
+		if !rate.allow(*limitRate) {
+			return &errRateLimit
+		}
+		return limitRoutes(peer, v)
+	}
+}
+
+// limitRoutes is queueRoutes without logging the action
+func limitRoutes(peer *bgp.Peer, v *common.RouteData) *common.Error {
+	size := len(v.Prefixes) + len(v.Withdraws) + len(v.FlowSpec) + len(v.FlowSpecWithdraws)
+	if *limitRoutesPerMessage > 0 && size > *limitRoutesPerMessage {
+		return &common.Error{
+			Code:    common.ErrTooManyRoutes,
+			Message: fmt.Sprintf("RouteData has %d prefixes, FlowSpec rules and withdraws, the limit is %d", size, *limitRoutesPerMessage),
+		}
+	}
+	select {
+	case peer.RoutesToAnnounce <- v:
+		return nil
+	default:
+		return &common.Error{
+			Code:    common.ErrQueueFull,
+			Message: "Too many routes waiting to be announced, try again later",
+		}
+	}
+}
+
+// serverLimits returns the limits enforced by the BGP server
+func serverLimits() bgp.Limits {
+	return bgp.Limits{
+		SessionsPerIP: *limitSessions,
+		Prefixes:      *limitPrefixes,
+		PrefixesPerIP: *limitPrefixesPerIP,
+
+		ReceivedPrefixes: *limitReceived,
+	}
+}
@@ -0,0 +1,816 @@
+// Package inspect decodes BGP messages into a tree of fields with their
+// offsets, for showing clients exactly what went over the wire
+package inspect
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/hamptonmoore/bgp.exposed/backend/common"
+)
+
+const headerLen = 19
+
+// Options are what was negotiated on the session that changes how messages
+// are encoded
+type Options struct {
+	AS4     bool // AS numbers in AS_PATH and AGGREGATOR are 4 octets
+	AddPath bool // NLRI carry a path identifier
+}
+
+var messageTypes = map[byte]string{
+	1: "OPEN",
+	2: "UPDATE",
+	3: "NOTIFICATION",
+	4: "KEEPALIVE",
+	5: "ROUTE-REFRESH",
+}
+
+var attributeTypes = map[byte]string{
+	1:   "ORIGIN",
+	2:   "AS_PATH",
+	3:   "NEXT_HOP",
+	4:   "MULTI_EXIT_DISC",
+	5:   "LOCAL_PREF",
+	6:   "ATOMIC_AGGREGATE",
+	7:   "AGGREGATOR",
+	8:   "COMMUNITIES",
+	9:   "ORIGINATOR_ID",
+	10:  "CLUSTER_LIST",
+	14:  "MP_REACH_NLRI",
+	15:  "MP_UNREACH_NLRI",
+	16:  "EXTENDED_COMMUNITIES",
+	17:  "AS4_PATH",
+	18:  "AS4_AGGREGATOR",
+	22:  "PMSI_TUNNEL",
+	25:  "IPV6_EXTENDED_COMMUNITIES",
+	29:  "BGP-LS",
+	32:  "LARGE_COMMUNITIES",
+	33:  "BGPsec_PATH",
+	35:  "ONLY_TO_CUSTOMER",
+	128: "ATTR_SET",
+}
+
+var capabilities = map[byte]string{
+	1:   "Multiprotocol Extensions",
+	2:   "Route Refresh",
+	5:   "Extended Next Hop Encoding",
+	6:   "Extended Message",
+	9:   "BGP Role",
+	64:  "Graceful Restart",
+	65:  "4-octet AS Number",
+	69:  "ADD-PATH",
+	70:  "Enhanced Route Refresh",
+	71:  "Long-Lived Graceful Restart",
+	73:  "FQDN",
+	128: "Route Refresh (Cisco)",
+}
+
+var notificationCodes = map[byte]string{
+	1: "Message Header Error",
+	2: "OPEN Message Error",
+	3: "UPDATE Message Error",
+	4: "Hold Timer Expired",
+	5: "Finite State Machine Error",
+	6: "Cease",
+	7: "ROUTE-REFRESH Message Error",
+}
+
+var origins = map[byte]string{
+	0: "IGP",
+	1: "EGP",
+	2: "INCOMPLETE",
+}
+
+var segmentTypes = map[byte]string{
+	1: "AS_SET",
+	2: "AS_SEQUENCE",
+	3: "AS_CONFED_SEQUENCE",
+	4: "AS_CONFED_SET",
+}
+
+var afis = map[uint16]string{
+	1: "IPv4",
+	2: "IPv6",
+}
+
+var safis = map[byte]string{
+	1:   "unicast",
+	2:   "multicast",
+	4:   "labeled unicast",
+	128: "MPLS VPN",
+	133: "flowspec",
+	134: "flowspec VPN",
+}
+
+func name(names map[byte]string, code byte) string {
+	if n, ok := names[code]; ok {
+		return fmt.Sprintf("%s (%d)", n, code)
+	}
+	return fmt.Sprintf("Unknown (%d)", code)
+}
+
+// AttributeName returns the name of a path attribute type code
+func AttributeName(code byte) string {
+	if n, ok := attributeTypes[code]; ok {
+		return n
+	}
+	return fmt.Sprintf("attribute %d", code)
+}
+
+func afiName(afi uint16) string {
+	if n, ok := afis[afi]; ok {
+		return fmt.Sprintf("%s (%d)", n, afi)
+	}
+	return fmt.Sprintf("Unknown (%d)", afi)
+}
+
+// decoder walks a message keeping track of the offset of each field
+type decoder struct {
+	b    []byte
+	base int // Offset of b within the message
+	opts Options
+}
+
+func (d decoder) sub(offset int, length int) decoder {
+	return decoder{b: d.b[offset : offset+length], base: d.base + offset, opts: d.opts}
+}
+
+func (d decoder) field(name string, offset int, length int, value string) common.Field {
+	return common.Field{Name: name, Value: value, Offset: d.base + offset, Length: length}
+}
+
+// truncated is the field for bytes that end before the field they should hold
+func (d decoder) truncated(name string, offset int) common.Field {
+	f := d.field(name, offset, len(d.b)-offset, hex.EncodeToString(d.b[offset:]))
+	f.Error = "truncated"
+	return f
+}
+
+func (d decoder) u8(fieldName string, offset int, names map[byte]string) (common.Field, bool) {
+	if offset+1 > len(d.b) {
+		return d.truncated(fieldName, offset), false
+	}
+	value := strconv.Itoa(int(d.b[offset]))
+	if names != nil {
+		value = name(names, d.b[offset])
+	}
+	return d.field(fieldName, offset, 1, value), true
+}
+
+func (d decoder) u16(name string, offset int) (common.Field, uint16, bool) {
+	if offset+2 > len(d.b) {
+		return d.truncated(name, offset), 0, false
+	}
+	v := binary.BigEndian.Uint16(d.b[offset:])
+	return d.field(name, offset, 2, strconv.Itoa(int(v))), v, true
+}
+
+func (d decoder) u32(name string, offset int) (common.Field, uint32, bool) {
+	if offset+4 > len(d.b) {
+		return d.truncated(name, offset), 0, false
+	}
+	v := binary.BigEndian.Uint32(d.b[offset:])
+	return d.field(name, offset, 4, strconv.FormatUint(uint64(v), 10)), v, true
+}
+
+func (d decoder) ip(name string, offset int, length int) (common.Field, bool) {
+	if offset+length > len(d.b) {
+		return d.truncated(name, offset), false
+	}
+	return d.field(name, offset, length, net.IP(d.b[offset:offset+length]).String()), true
+}
+
+func (d decoder) raw(name string, offset int, length int) common.Field {
+	if offset+length > len(d.b) {
+		return d.truncated(name, offset)
+	}
+	return d.field(name, offset, length, hex.EncodeToString(d.b[offset:offset+length]))
+}
+
+// Decode decodes a whole BGP message including its header. Whatever can't be
+// decoded is shown as hex with an error rather than failing.
+func Decode(msg []byte, opts Options) common.Field {
+	d := decoder{b: msg, opts: opts}
+	tree := common.Field{Name: "BGP Message", Length: len(msg)}
+
+	if len(msg) < headerLen {
+		tree.Children = append(tree.Children, d.truncated("Header", 0))
+		tree.Error = "shorter than the header"
+		return tree
+	}
+	marker := d.raw("Marker", 0, 16)
+	for _, b := range msg[:16] {
+		if b != 0xff {
+			marker.Error = "not all ones"
+			break
+		}
+	}
+	length, declared, _ := d.u16("Length", 16)
+	if int(declared) != len(msg) {
+		length.Error = fmt.Sprintf("message is %d bytes", len(msg))
+	}
+	msgType, _ := d.u8("Type", 18, messageTypes)
+	tree.Value = messageTypes[msg[18]]
+	tree.Children = append(tree.Children, marker, length, msgType)
+
+	body := d.sub(headerLen, len(msg)-headerLen)
+	switch msg[18] {
+	case 1:
+		tree.Children = append(tree.Children, body.open()...)
+	case 2:
+		tree.Children = append(tree.Children, body.update()...)
+	case 3:
+		tree.Children = append(tree.Children, body.notification()...)
+	case 4:
+		if len(body.b) > 0 {
+			f := body.raw("Unexpected data", 0, len(body.b))
+			f.Error = "KEEPALIVE has no body"
+			tree.Children = append(tree.Children, f)
+		}
+	case 5:
+		tree.Children = append(tree.Children, body.routeRefresh()...)
+	default:
+		if len(body.b) > 0 {
+			tree.Children = append(tree.Children, body.raw("Data", 0, len(body.b)))
+		}
+	}
+	return tree
+}
+
+func (d decoder) open() []common.Field {
+	fields := []common.Field{}
+	version, ok := d.u8("Version", 0, nil)
+	fields = append(fields, version)
+	if !ok {
+		return fields
+	}
+	asn, _, ok := d.u16("My Autonomous System", 1)
+	fields = append(fields, asn)
+	if !ok {
+		return fields
+	}
+	holdTime, _, ok := d.u16("Hold Time", 3)
+	fields = append(fields, holdTime)
+	if !ok {
+		return fields
+	}
+	id, ok := d.ip("BGP Identifier", 5, 4)
+	fields = append(fields, id)
+	if !ok {
+		return fields
+	}
+	paramsLen, ok := d.u8("Optional Parameters Length", 9, nil)
+	fields = append(fields, paramsLen)
+	if !ok {
+		return fields
+	}
+	end := 10 + int(d.b[9])
+	if end > len(d.b) {
+		fields = append(fields, d.truncated("Optional Parameters", 10))
+		return fields
+	}
+
+	params := common.Field{Name: "Optional Parameters", Offset: d.base + 10, Length: end - 10}
+	for offset := 10; offset < end; {
+		if offset+2 > end {
+			params.Children = append(params.Children, d.sub(0, end).truncated("Parameter", offset))
+			break
+		}
+		paramType, paramLen := d.b[offset], int(d.b[offset+1])
+		param := d.field("Parameter", offset, 2+paramLen, "")
+		typeField, _ := d.u8("Type", offset, map[byte]string{2: "Capabilities"})
+		lenField, _ := d.u8("Length", offset+1, nil)
+		param.Children = []common.Field{typeField, lenField}
+		if offset+2+paramLen > end {
+			param.Length = end - offset
+			param.Error = "truncated"
+			params.Children = append(params.Children, param)
+			break
+		}
+		value := d.sub(offset+2, paramLen)
+		if paramType == 2 {
+			param.Value = "Capabilities"
+			param.Children = append(param.Children, value.capabilities()...)
+		} else {
+			param.Children = append(param.Children, value.raw("Value", 0, paramLen))
+		}
+		params.Children = append(params.Children, param)
+		offset += 2 + paramLen
+	}
+	fields = append(fields, params)
+	if end < len(d.b) {
+		f := d.raw("Unexpected data", end, len(d.b)-end)
+		f.Error = "after the optional parameters"
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func (d decoder) capabilities() []common.Field {
+	fields := []common.Field{}
+	for offset := 0; offset < len(d.b); {
+		if offset+2 > len(d.b) {
+			fields = append(fields, d.truncated("Capability", offset))
+			break
+		}
+		code, length := d.b[offset], int(d.b[offset+1])
+		capability := d.field("Capability", offset, 2+length, name(capabilities, code))
+		codeField, _ := d.u8("Code", offset, capabilities)
+		lenField, _ := d.u8("Length", offset+1, nil)
+		capability.Children = []common.Field{codeField, lenField}
+		if offset+2+length > len(d.b) {
+			capability.Length = len(d.b) - offset
+			capability.Error = "truncated"
+			fields = append(fields, capability)
+			break
+		}
+		value := d.sub(offset+2, length)
+		switch {
+		case code == 1 && length == 4:
+			afi, v, _ := value.u16("AFI", 0)
+			afi.Value = afiName(v)
+			reserved := value.raw("Reserved", 2, 1)
+			safi, _ := value.u8("SAFI", 3, safis)
+			capability.Children = append(capability.Children, afi, reserved, safi)
+		case code == 65 && length == 4:
+			asn, _, _ := value.u32("AS Number", 0)
+			capability.Children = append(capability.Children, asn)
+		case code == 69 && length%4 == 0:
+			for i := 0; i < length; i += 4 {
+				afi, v, _ := value.u16("AFI", i)
+				afi.Value = afiName(v)
+				safi, _ := value.u8("SAFI", i+2, safis)
+				mode, _ := value.u8("Send/Receive", i+3, map[byte]string{1: "receive", 2: "send", 3: "both"})
+				capability.Children = append(capability.Children, common.Field{
+					Name:     "Address Family",
+					Offset:   value.base + i,
+					Length:   4,
+					Children: []common.Field{afi, safi, mode},
+				})
+			}
+		case code == 9 && length == 1:
+			role, _ := value.u8("Role", 0, map[byte]string{0: "Provider", 1: "Route Server", 2: "Route Server Client", 3: "Customer", 4: "Peer"})
+			capability.Children = append(capability.Children, role)
+		default:
+			if length > 0 {
+				capability.Children = append(capability.Children, value.raw("Value", 0, length))
+			}
+		}
+		fields = append(fields, capability)
+		offset += 2 + length
+	}
+	return fields
+}
+
+func (d decoder) update() []common.Field {
+	fields := []common.Field{}
+	withdrawnLen, wl, ok := d.u16("Withdrawn Routes Length", 0)
+	fields = append(fields, withdrawnLen)
+	if !ok {
+		return fields
+	}
+	offset := 2
+	if offset+int(wl) > len(d.b) {
+		withdrawnLen.Error = "longer than the message"
+		fields[0] = withdrawnLen
+		fields = append(fields, d.truncated("Withdrawn Routes", offset))
+		return fields
+	}
+	withdrawn := d.sub(offset, int(wl)).prefixes("Withdrawn Routes", 1)
+	fields = append(fields, withdrawn)
+	offset += int(wl)
+
+	attrsLen, al, ok := d.u16("Total Path Attribute Length", offset)
+	fields = append(fields, attrsLen)
+	if !ok {
+		return fields
+	}
+	offset += 2
+	if offset+int(al) > len(d.b) {
+		attrsLen.Error = "longer than the message"
+		fields[len(fields)-1] = attrsLen
+		fields = append(fields, d.truncated("Path Attributes", offset))
+		return fields
+	}
+	attrs := common.Field{Name: "Path Attributes", Offset: d.base + offset, Length: int(al)}
+	attrs.Children = d.sub(offset, int(al)).attributes()
+	fields = append(fields, attrs)
+	offset += int(al)
+
+	fields = append(fields, d.sub(offset, len(d.b)-offset).prefixes("NLRI", 1))
+	return fields
+}
+
+// prefixes decodes a list of prefixes, as in the withdrawn routes and NLRI
+func (d decoder) prefixes(fieldName string, afi uint16) common.Field {
+	list := common.Field{Name: fieldName, Offset: d.base, Length: len(d.b)}
+	maxLen := 32
+	if afi == 2 {
+		maxLen = 128
+	}
+	for offset := 0; offset < len(d.b); {
+		start := offset
+		prefix := common.Field{Name: "Prefix", Offset: d.base + offset}
+		if d.opts.AddPath {
+			pathID, id, ok := d.u32("Path Identifier", offset)
+			prefix.Children = append(prefix.Children, pathID)
+			if !ok {
+				prefix.Length = len(d.b) - start
+				prefix.Error = "truncated"
+				list.Children = append(list.Children, prefix)
+				break
+			}
+			prefix.Value = fmt.Sprintf("id %d ", id)
+			offset += 4
+		}
+		if offset >= len(d.b) {
+			prefix.Length = len(d.b) - start
+			prefix.Error = "truncated"
+			list.Children = append(list.Children, prefix)
+			break
+		}
+		bits := int(d.b[offset])
+		lenField, _ := d.u8("Length", offset, nil)
+		prefix.Children = append(prefix.Children, lenField)
+		octets := (bits + 7) / 8
+		if bits > maxLen {
+			prefix.Length = len(d.b) - start
+			prefix.Error = fmt.Sprintf("prefix length %d is longer than %d bits", bits, maxLen)
+			prefix.Children = append(prefix.Children, d.raw("Prefix", offset+1, len(d.b)-offset-1))
+			list.Children = append(list.Children, prefix)
+			break
+		}
+		if offset+1+octets > len(d.b) {
+			prefix.Length = len(d.b) - start
+			prefix.Error = "truncated"
+			prefix.Children = append(prefix.Children, d.truncated("Prefix", offset+1))
+			list.Children = append(list.Children, prefix)
+			break
+		}
+		ip := make(net.IP, maxLen/8)
+		copy(ip, d.b[offset+1:offset+1+octets])
+		cidr := fmt.Sprintf("%s/%d", ip, bits)
+		prefix.Value += cidr
+		prefix.Children = append(prefix.Children, d.field("Prefix", offset+1, octets, cidr))
+		offset += 1 + octets
+		prefix.Length = offset - start
+		list.Children = append(list.Children, prefix)
+	}
+	return list
+}
+
+func (d decoder) attributes() []common.Field {
+	fields := []common.Field{}
+	for offset := 0; offset < len(d.b); {
+		if offset+3 > len(d.b) {
+			fields = append(fields, d.truncated("Path Attribute", offset))
+			break
+		}
+		flags, code := d.b[offset], d.b[offset+1]
+		headerLen := 3
+		var length int
+		if flags&0x10 != 0 {
+			if offset+4 > len(d.b) {
+				fields = append(fields, d.truncated("Path Attribute", offset))
+				break
+			}
+			headerLen = 4
+			length = int(binary.BigEndian.Uint16(d.b[offset+2:]))
+		} else {
+			length = int(d.b[offset+2])
+		}
+
+		attr := d.field("Path Attribute", offset, headerLen+length, name(attributeTypes, code))
+		flagsField := d.field("Flags", offset, 1, fmt.Sprintf("0x%02x", flags))
+		for _, bit := range []struct {
+			mask byte
+			name string
+		}{{0x80, "Optional"}, {0x40, "Transitive"}, {0x20, "Partial"}, {0x10, "Extended Length"}} {
+			flagsField.Children = append(flagsField.Children, d.field(bit.name, offset, 1, strconv.FormatBool(flags&bit.mask != 0)))
+		}
+		typeField, _ := d.u8("Type Code", offset+1, attributeTypes)
+		lenField := d.field("Length", offset+2, headerLen-2, strconv.Itoa(length))
+		attr.Children = []common.Field{flagsField, typeField, lenField}
+		if offset+headerLen+length > len(d.b) {
+			attr.Length = len(d.b) - offset
+			attr.Error = fmt.Sprintf("length %d runs past the path attributes", length)
+			attr.Children = append(attr.Children, d.truncated("Value", offset+headerLen))
+			fields = append(fields, attr)
+			break
+		}
+		attr.Children = append(attr.Children, d.sub(offset+headerLen, length).attribute(code)...)
+		fields = append(fields, attr)
+		offset += headerLen + length
+	}
+	return fields
+}
+
+// attribute decodes the value of a path attribute
+func (d decoder) attribute(code byte) []common.Field {
+	n := len(d.b)
+	wrongLength := func(expected string) []common.Field {
+		f := d.raw("Value", 0, n)
+		f.Error = "length should be " + expected
+		return []common.Field{f}
+	}
+	asLen := 2
+	if d.opts.AS4 {
+		asLen = 4
+	}
+
+	switch code {
+	case 1:
+		if n != 1 {
+			return wrongLength("1")
+		}
+		f, _ := d.u8("Origin", 0, origins)
+		return []common.Field{f}
+	case 2, 17:
+		if code == 17 {
+			asLen = 4
+		}
+		return d.asPath(asLen)
+	case 3:
+		if n != 4 {
+			return wrongLength("4")
+		}
+		f, _ := d.ip("Next Hop", 0, 4)
+		return []common.Field{f}
+	case 4:
+		if n != 4 {
+			return wrongLength("4")
+		}
+		f, _, _ := d.u32("MED", 0)
+		return []common.Field{f}
+	case 5:
+		if n != 4 {
+			return wrongLength("4")
+		}
+		f, _, _ := d.u32("Local Preference", 0)
+		return []common.Field{f}
+	case 6:
+		if n != 0 {
+			return wrongLength("0")
+		}
+		return nil
+	case 7, 18:
+		if code == 18 {
+			asLen = 4
+		}
+		if n != asLen+4 {
+			return wrongLength(strconv.Itoa(asLen + 4))
+		}
+		var asn common.Field
+		if asLen == 4 {
+			asn, _, _ = d.u32("AS", 0)
+		} else {
+			asn, _, _ = d.u16("AS", 0)
+		}
+		addr, _ := d.ip("Address", asLen, 4)
+		return []common.Field{asn, addr}
+	case 8:
+		if n%4 != 0 {
+			return wrongLength("a multiple of 4")
+		}
+		fields := []common.Field{}
+		for i := 0; i < n; i += 4 {
+			fields = append(fields, d.field("Community", i, 4, fmt.Sprintf("%d:%d", binary.BigEndian.Uint16(d.b[i:]), binary.BigEndian.Uint16(d.b[i+2:]))))
+		}
+		return fields
+	case 9:
+		if n != 4 {
+			return wrongLength("4")
+		}
+		f, _ := d.ip("Originator ID", 0, 4)
+		return []common.Field{f}
+	case 10:
+		if n%4 != 0 {
+			return wrongLength("a multiple of 4")
+		}
+		fields := []common.Field{}
+		for i := 0; i < n; i += 4 {
+			f, _ := d.ip("Cluster ID", i, 4)
+			fields = append(fields, f)
+		}
+		return fields
+	case 14:
+		return d.mpReach()
+	case 15:
+		return d.mpUnreach()
+	case 16:
+		if n%8 != 0 {
+			return wrongLength("a multiple of 8")
+		}
+		fields := []common.Field{}
+		for i := 0; i < n; i += 8 {
+			fields = append(fields, d.raw("Extended Community", i, 8))
+		}
+		return fields
+	case 25:
+		if n%20 != 0 {
+			return wrongLength("a multiple of 20")
+		}
+		fields := []common.Field{}
+		for i := 0; i < n; i += 20 {
+			fields = append(fields, d.raw("IPv6 Extended Community", i, 20))
+		}
+		return fields
+	case 32:
+		if n%12 != 0 {
+			return wrongLength("a multiple of 12")
+		}
+		fields := []common.Field{}
+		for i := 0; i < n; i += 12 {
+			fields = append(fields, d.field("Large Community", i, 12, fmt.Sprintf("%d:%d:%d", binary.BigEndian.Uint32(d.b[i:]), binary.BigEndian.Uint32(d.b[i+4:]), binary.BigEndian.Uint32(d.b[i+8:]))))
+		}
+		return fields
+	case 35:
+		if n != 4 {
+			return wrongLength("4")
+		}
+		f, _, _ := d.u32("AS", 0)
+		return []common.Field{f}
+	}
+	if n == 0 {
+		return nil
+	}
+	return []common.Field{d.raw("Value", 0, n)}
+}
+
+func (d decoder) asPath(asLen int) []common.Field {
+	fields := []common.Field{}
+	for offset := 0; offset < len(d.b); {
+		if offset+2 > len(d.b) {
+			fields = append(fields, d.truncated("Segment", offset))
+			break
+		}
+		segType, count := d.b[offset], int(d.b[offset+1])
+		segment := d.field("Segment", offset, 2+count*asLen, name(segmentTypes, segType))
+		typeField, _ := d.u8("Type", offset, segmentTypes)
+		countField, _ := d.u8("Count", offset+1, nil)
+		segment.Children = []common.Field{typeField, countField}
+		if offset+2+count*asLen > len(d.b) {
+			segment.Length = len(d.b) - offset
+			segment.Error = fmt.Sprintf("%d ASNs of %d octets run past the attribute", count, asLen)
+			segment.Children = append(segment.Children, d.truncated("ASNs", offset+2))
+			fields = append(fields, segment)
+			break
+		}
+		asns := []string{}
+		for i := 0; i < count; i++ {
+			at := offset + 2 + i*asLen
+			var asn common.Field
+			if asLen == 4 {
+				asn, _, _ = d.u32("AS", at)
+			} else {
+				asn, _, _ = d.u16("AS", at)
+			}
+			asns = append(asns, asn.Value)
+			segment.Children = append(segment.Children, asn)
+		}
+		segment.Value += " " + strings.Join(asns, " ")
+		fields = append(fields, segment)
+		offset += 2 + count*asLen
+	}
+	return fields
+}
+
+// afiSafi decodes the AFI and SAFI starting MP_REACH_NLRI and MP_UNREACH_NLRI
+func (d decoder) afiSafi() ([]common.Field, uint16, byte, bool) {
+	afiField, afi, ok := d.u16("AFI", 0)
+	if !ok {
+		return []common.Field{afiField}, 0, 0, false
+	}
+	afiField.Value = afiName(afi)
+	safiField, ok := d.u8("SAFI", 2, safis)
+	if !ok {
+		return []common.Field{afiField, safiField}, 0, 0, false
+	}
+	return []common.Field{afiField, safiField}, afi, d.b[2], true
+}
+
+// nlri decodes the NLRI of an address family, or shows them as hex if they
+// aren't plain prefixes
+func (d decoder) nlri(fieldName string, afi uint16, safi byte) common.Field {
+	if (afi == 1 || afi == 2) && (safi == 1 || safi == 2) {
+		return d.prefixes(fieldName, afi)
+	}
+	if (afi == 1 || afi == 2) && safi == common.SafiFlowSpec {
+		return d.flowSpec(fieldName, afi)
+	}
+	return d.raw(fieldName, 0, len(d.b))
+}
+
+// flowSpec decodes FlowSpec NLRI, showing each rule in its readable form
+func (d decoder) flowSpec(fieldName string, afi uint16) common.Field {
+	list := common.Field{Name: fieldName, Offset: d.base, Length: len(d.b)}
+	for offset := 0; offset < len(d.b); {
+		header, length := 1, int(d.b[offset])
+		if d.b[offset]&0xf0 == 0xf0 {
+			if offset+2 > len(d.b) {
+				list.Children = append(list.Children, d.truncated("Rule", offset))
+				break
+			}
+			header, length = 2, int(binary.BigEndian.Uint16(d.b[offset:])&0x0fff)
+		}
+		end := offset + header + length
+		if end > len(d.b) {
+			list.Children = append(list.Children, d.truncated("Rule", offset))
+			break
+		}
+		rule := d.field("Rule", offset, end-offset, "")
+		if rules, err := common.DecodeFlowSpec(d.b[offset:end], afi == 2); err != nil {
+			rule.Error = err.Error()
+		} else {
+			rule.Value = rules[0].String()
+		}
+		rule.Children = []common.Field{
+			d.field("Length", offset, header, strconv.Itoa(length)),
+			d.raw("Components", offset+header, length),
+		}
+		list.Children = append(list.Children, rule)
+		offset = end
+	}
+	return list
+}
+
+func (d decoder) mpReach() []common.Field {
+	fields, afi, safi, ok := d.afiSafi()
+	if !ok {
+		return fields
+	}
+	nhLen, ok := d.u8("Next Hop Length", 3, nil)
+	fields = append(fields, nhLen)
+	if !ok {
+		return fields
+	}
+	length := int(d.b[3])
+	if 4+length > len(d.b) {
+		fields = append(fields, d.truncated("Next Hop", 4))
+		return fields
+	}
+	switch length {
+	case 4, 16:
+		f, _ := d.ip("Next Hop", 4, length)
+		fields = append(fields, f)
+	case 32:
+		global, _ := d.ip("Next Hop", 4, 16)
+		linkLocal, _ := d.ip("Link-Local Next Hop", 20, 16)
+		fields = append(fields, global, linkLocal)
+	default:
+		fields = append(fields, d.raw("Next Hop", 4, length))
+	}
+	offset := 4 + length
+	reserved, ok := d.u8("Reserved", offset, nil)
+	fields = append(fields, reserved)
+	if !ok {
+		return fields
+	}
+	offset++
+	return append(fields, d.sub(offset, len(d.b)-offset).nlri("NLRI", afi, safi))
+}
+
+func (d decoder) mpUnreach() []common.Field {
+	fields, afi, safi, ok := d.afiSafi()
+	if !ok {
+		return fields
+	}
+	return append(fields, d.sub(3, len(d.b)-3).nlri("Withdrawn Routes", afi, safi))
+}
+
+func (d decoder) notification() []common.Field {
+	code, ok := d.u8("Error Code", 0, notificationCodes)
+	if !ok {
+		return []common.Field{code}
+	}
+	subcode, ok := d.u8("Error Subcode", 1, nil)
+	if !ok {
+		return []common.Field{code, subcode}
+	}
+	fields := []common.Field{code, subcode}
+	if len(d.b) > 2 {
+		fields = append(fields, d.raw("Data", 2, len(d.b)-2))
+	}
+	return fields
+}
+
+func (d decoder) routeRefresh() []common.Field {
+	afiField, afi, ok := d.u16("AFI", 0)
+	if !ok {
+		return []common.Field{afiField}
+	}
+	afiField.Value = afiName(afi)
+	// The octet between AFI and SAFI is reserved, or the subtype with
+	// enhanced route refresh
+	reserved := d.raw("Reserved", 2, 1)
+	if reserved.Error != "" {
+		return []common.Field{afiField, reserved}
+	}
+	safiField, _ := d.u8("SAFI", 3, safis)
+	return []common.Field{afiField, reserved, safiField}
+}
@@ -0,0 +1,208 @@
+package inspect
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/hamptonmoore/bgp.exposed/backend/common"
+)
+
+// message builds a BGP message from its type and hex encoded body
+func message(msgType byte, body string) []byte {
+	b, err := hex.DecodeString(body)
+	if err != nil {
+		panic(err)
+	}
+	msg := append(bytes.Repeat([]byte{0xff}, 16), byte((headerLen+len(b))>>8), byte(headerLen+len(b)), msgType)
+	return append(msg, b...)
+}
+
+var (
+	testOpen = message(1, "04fde8005a7f000001"+"10"+"020e"+"41040000fde8"+"010400010001"+"0200")
+	// ORIGIN, NEXT_HOP and AS_PATH with 192.0.2.0/24
+	testUpdate = message(2, "0000"+"0014"+"40010100"+"400304c0000201"+"40020602010000fde8"+"18c00002")
+	// 2001:db8::/32 and 2001:db8:1::/48 in an MP_REACH_NLRI
+	testMPUpdate     = message(2, "0000"+"0031"+"40010100"+"40020602010000fde9"+"800e21"+"0002011020010db8000000000000000000000001"+"00"+"2020010db8"+"3020010db80001")
+	testNotification = message(3, "060100020100000001")
+	testKeepalive    = message(4, "")
+	testRouteRefresh = message(5, "00010001")
+)
+
+// find follows a path of fields, each matched by name or value
+func find(f common.Field, path ...string) (common.Field, bool) {
+	for _, step := range path {
+		found := false
+		for _, child := range f.Children {
+			if child.Name == step || child.Value == step {
+				f, found = child, true
+				break
+			}
+		}
+		if !found {
+			return common.Field{}, false
+		}
+	}
+	return f, true
+}
+
+// errors returns the errors of a field and its children
+func errors(f common.Field) []string {
+	var errs []string
+	if f.Error != "" {
+		errs = append(errs, f.Name+": "+f.Error)
+	}
+	for _, child := range f.Children {
+		errs = append(errs, errors(child)...)
+	}
+	return errs
+}
+
+// checkBounds makes sure every field lies within the message
+func checkBounds(t *testing.T, f common.Field, size int) {
+	t.Helper()
+	if f.Offset < 0 || f.Length < 0 || f.Offset+f.Length > size {
+		t.Errorf("field %s at offset %d of length %d is outside the %d byte message", f.Name, f.Offset, f.Length, size)
+	}
+	for _, child := range f.Children {
+		checkBounds(t, child, size)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		msg    []byte
+		opts   Options
+		fields map[string][]string // Value expected at each path
+		errors bool
+	}{
+		{
+			name: "OPEN",
+			msg:  testOpen,
+			fields: map[string][]string{
+				"OPEN":              {},
+				"4":                 {"Version"},
+				"65000":             {"My Autonomous System"},
+				"90":                {"Hold Time"},
+				"127.0.0.1":         {"BGP Identifier"},
+				"IPv4 (1)":          {"Optional Parameters", "Capabilities", "Multiprotocol Extensions (1)", "AFI"},
+				"Route Refresh (2)": {"Optional Parameters", "Capabilities", "Route Refresh (2)", "Code"},
+			},
+		},
+		{
+			name: "UPDATE",
+			msg:  testUpdate,
+			opts: Options{AS4: true},
+			fields: map[string][]string{
+				"UPDATE":                {},
+				"IGP (0)":               {"Path Attributes", "ORIGIN (1)", "Origin"},
+				"192.0.2.1":             {"Path Attributes", "NEXT_HOP (3)", "Next Hop"},
+				"AS_SEQUENCE (2) 65000": {"Path Attributes", "AS_PATH (2)", "Segment"},
+				"192.0.2.0/24":          {"NLRI", "Prefix"},
+			},
+		},
+		{
+			name: "UPDATE with two-octet ASNs",
+			msg:  message(2, "0000"+"0007"+"400204020100fd"+"18c00002"),
+			fields: map[string][]string{
+				"AS_SEQUENCE (2) 253": {"Path Attributes", "AS_PATH (2)", "Segment"},
+			},
+		},
+		{
+			name: "UPDATE with ADD-PATH",
+			msg:  message(2, "0000"+"0000"+"0000000718c00002"),
+			opts: Options{AddPath: true},
+			fields: map[string][]string{
+				"id 7 192.0.2.0/24": {"NLRI", "Prefix"},
+				"7":                 {"NLRI", "Prefix", "Path Identifier"},
+			},
+		},
+		{
+			name: "UPDATE with MP_REACH_NLRI",
+			msg:  testMPUpdate,
+			opts: Options{AS4: true},
+			fields: map[string][]string{
+				"IPv6 (2)":        {"Path Attributes", "MP_REACH_NLRI (14)", "AFI"},
+				"2001:db8::1":     {"Path Attributes", "MP_REACH_NLRI (14)", "Next Hop"},
+				"2001:db8::/32":   {"Path Attributes", "MP_REACH_NLRI (14)", "NLRI", "Prefix"},
+				"2001:db8:1::/48": {"Path Attributes", "MP_REACH_NLRI (14)", "NLRI", "2001:db8:1::/48", "Prefix"},
+			},
+		},
+		{
+			name: "NOTIFICATION",
+			msg:  testNotification,
+			fields: map[string][]string{
+				"Cease (6)":      {"Error Code"},
+				"1":              {"Error Subcode"},
+				"00020100000001": {"Data"},
+			},
+		},
+		{
+			name:   "KEEPALIVE",
+			msg:    testKeepalive,
+			fields: map[string][]string{"KEEPALIVE": {}},
+		},
+		{
+			name: "ROUTE-REFRESH",
+			msg:  testRouteRefresh,
+			fields: map[string][]string{
+				"IPv4 (1)":    {"AFI"},
+				"00":          {"Reserved"},
+				"unicast (1)": {"SAFI"},
+			},
+		},
+		{
+			name:   "unknown type",
+			msg:    message(9, "0102"),
+			fields: map[string][]string{"0102": {"Data"}},
+		},
+
+		{name: "shorter than the header", msg: testKeepalive[:10], errors: true},
+		{name: "marker", msg: append([]byte{0}, testKeepalive[1:]...), errors: true},
+		{name: "length", msg: append(append([]byte{}, testKeepalive...), 0), errors: true},
+		{name: "KEEPALIVE with data", msg: message(4, "00"), errors: true},
+		{name: "attribute overrun", msg: message(2, "0000"+"0004"+"40010500"), errors: true},
+		{name: "prefix too long", msg: message(2, "0000"+"0000"+"21c0000201"), errors: true},
+		{name: "AS_PATH segment overrun", msg: message(2, "0000"+"0009"+"40020602020000fde8"), opts: Options{AS4: true}, errors: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tree := Decode(test.msg, test.opts)
+			checkBounds(t, tree, len(test.msg))
+			for value, path := range test.fields {
+				f, ok := find(tree, path...)
+				if !ok {
+					t.Errorf("no field at %v", path)
+				} else if f.Value != value {
+					t.Errorf("field at %v is %q, want %q", path, f.Value, value)
+				}
+			}
+			if errs := errors(tree); len(errs) > 0 != test.errors {
+				t.Errorf("errors %v, want errors: %t", errs, test.errors)
+			}
+		})
+	}
+}
+
+// TestDecodeTruncated checks every truncation of valid messages decodes to a
+// tree reporting an error
+func TestDecodeTruncated(t *testing.T) {
+	for _, msg := range [][]byte{testOpen, testUpdate, testMPUpdate, testNotification, testRouteRefresh} {
+		for i := 0; i < len(msg); i++ {
+			tree := Decode(msg[:i], Options{AS4: true})
+			checkBounds(t, tree, i)
+			if len(errors(tree)) == 0 {
+				t.Errorf("%x truncated to %d bytes decoded without errors", msg, i)
+			}
+		}
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, msg := range [][]byte{testOpen, testUpdate, testMPUpdate, testNotification, testKeepalive, testRouteRefresh} {
+		f.Add(msg, true, false)
+	}
+	f.Fuzz(func(t *testing.T, msg []byte, as4 bool, addPath bool) {
+		checkBounds(t, Decode(msg, Options{AS4: as4, AddPath: addPath}), len(msg))
+	})
+}
@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "bgpexposed"
+
+var (
+	Sessions = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "sessions",
+		Help:      "Number of sessions by BGP FSM state.",
+	}, []string{"state"})
+
+	WebsocketClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "websocket_clients",
+		Help:      "Number of connected websocket clients.",
+	})
+
+	UpdatesReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "updates_received_total",
+		Help:      "UPDATE messages received from peers.",
+	})
+
+	UpdatesSent = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "updates_sent_total",
+		Help:      "UPDATE messages sent to peers.",
+	})
+
+	PrefixesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "prefixes_received_total",
+		Help:      "Prefixes received from peers, by announce or withdraw.",
+	}, []string{"action"})
+
+	PrefixesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "prefixes_sent_total",
+		Help:      "Prefixes sent to peers, by announce or withdraw.",
+	}, []string{"action"})
+
+	Notifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "notifications_total",
+		Help:      "NOTIFICATION messages by direction, error code and subcode.",
+	}, []string{"direction", "code", "subcode"})
+
+	SessionDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "session_duration_seconds",
+		Help:      "How long sessions stayed Established.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 10),
+	})
+)
+
+// RegisterQueueDepth exposes the current depth of one of the per-session queues
+func RegisterQueueDepth(queue string, depth func() float64) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "queue_depth",
+		Help:        "Messages waiting in per-session queues, summed over all sessions.",
+		ConstLabels: prometheus.Labels{"queue": queue},
+	}, depth)
+}
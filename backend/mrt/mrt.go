@@ -0,0 +1,106 @@
+package mrt
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	fgmrt "github.com/bgptools/fgbgp/mrt"
+)
+
+const headerLen = 12
+
+// Record is a single decoded MRT record along with its timestamp
+type Record struct {
+	Timestamp time.Time
+	Data      fgmrt.Mrt
+}
+
+// Reader reads MRT records from a (possibly compressed) dump file
+type Reader struct {
+	file   *os.File
+	reader io.Reader
+}
+
+// Open opens an MRT file, transparently decompressing .gz and .bz2 files
+func Open(path string) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var r io.Reader = bufio.NewReader(f)
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		r, err = gzip.NewReader(r)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	case strings.HasSuffix(path, ".bz2"):
+		r = bzip2.NewReader(r)
+	}
+
+	return &Reader{file: f, reader: r}, nil
+}
+
+func (r *Reader) Close() error {
+	return r.file.Close()
+}
+
+// Next reads the next record. It returns io.EOF once the file is exhausted.
+// Records of types we can't decode are returned with a nil Data field, and
+// records that fail to decode are returned alongside the decoding error so the
+// caller can decide whether to skip them.
+func (r *Reader) Next() (*Record, error) {
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r.reader, header); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("truncated MRT header: %w", err)
+		}
+		return nil, err
+	}
+
+	timestamp := time.Unix(int64(binary.BigEndian.Uint32(header[0:4])), 0)
+	mrtType := binary.BigEndian.Uint16(header[4:6])
+	subtype := binary.BigEndian.Uint16(header[6:8])
+	length := binary.BigEndian.Uint32(header[8:12])
+
+	content := make([]byte, length)
+	if _, err := io.ReadFull(r.reader, content); err != nil {
+		return nil, fmt.Errorf("truncated MRT record: %w", err)
+	}
+
+	record := &Record{Timestamp: timestamp}
+	var err error
+	switch mrtType {
+	case fgmrt.TYPE_TABLE_DUMP:
+		record.Data, err = fgmrt.DecodeBGP4TD1(bytes.NewBuffer(content), timestamp, subtype, length)
+	case fgmrt.TYPE_TABLE_DUMPV2:
+		record.Data, err = fgmrt.DecodeBGP4TD2(bytes.NewBuffer(content), timestamp, subtype, length)
+	case fgmrt.TYPE_BGP4MP, fgmrt.TYPE_BGP4MP_ET:
+		if mrtType == fgmrt.TYPE_BGP4MP_ET {
+			if length < 4 {
+				return record, errors.New("BGP4MP_ET record too short")
+			}
+			micro := binary.BigEndian.Uint32(content[0:4])
+			timestamp = timestamp.Add(time.Duration(micro) * time.Microsecond)
+			record.Timestamp = timestamp
+			content = content[4:]
+			length -= 4
+		}
+		if subtype == fgmrt.SUBT_BGP4MP_MESSAGE_AS4 || subtype == fgmrt.SUBT_BGP4MP_STATE_CHANGE_AS4 {
+			record.Data, err = fgmrt.DecodeBGP4MP(bytes.NewBuffer(content), timestamp, subtype, length)
+		}
+	}
+
+	return record, err
+}
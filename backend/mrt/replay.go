@@ -0,0 +1,310 @@
+package mrt
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bgptools/fgbgp/messages"
+	fgmrt "github.com/bgptools/fgbgp/mrt"
+	"github.com/hamptonmoore/bgp.exposed/backend/bgp"
+	"github.com/hamptonmoore/bgp.exposed/backend/common"
+)
+
+// retryWait is how long a replay holds back when the session's queue is full
+// or it is sending faster than the rate limit allows
+const retryWait = 100 * time.Millisecond
+
+// Replay plays back the UPDATE messages of a BGP4MP capture, keeping the
+// original spacing between messages scaled by a speed multiplier
+type Replay struct {
+	Path    string
+	Name    string
+	PeerIP  net.IP
+	PeerASN uint32
+	NextHop string
+
+	speed   float64
+	control chan common.ReplayControl
+	done    chan struct{}
+
+	lock   sync.Mutex
+	status common.ReplayStatus // Last status reported
+}
+
+func NewReplay(path string, request *common.ReplayRequest) (*Replay, error) {
+	r := &Replay{
+		Path:    path,
+		Name:    request.File,
+		PeerASN: request.PeerASN,
+		NextHop: request.NextHop,
+		speed:   request.Speed,
+		control: make(chan common.ReplayControl, 16),
+		done:    make(chan struct{}),
+	}
+	if r.speed == 0 {
+		r.speed = 1
+	}
+	if r.speed < 0 {
+		return nil, errors.New("replay speed must be positive")
+	}
+	r.status = common.ReplayStatus{State: "scanning", File: r.Name, Speed: r.speed}
+	if request.PeerIP != "" {
+		r.PeerIP = net.ParseIP(request.PeerIP)
+		if r.PeerIP == nil {
+			return nil, errors.New("invalid replay peer IP")
+		}
+	}
+	return r, nil
+}
+
+// Control passes a pause, resume, stop or speed action to the running replay
+func (r *Replay) Control(c common.ReplayControl) error {
+	switch c.Action {
+	case "pause", "resume", "stop":
+	case "speed":
+		if c.Speed <= 0 {
+			return errors.New("replay speed must be positive")
+		}
+	default:
+		return errors.New("unknown replay action")
+	}
+
+	// Checked first as the buffered control channel is usually ready too
+	select {
+	case <-r.done:
+		return errors.New("replay is not running")
+	default:
+	}
+	select {
+	case <-r.done:
+		return errors.New("replay is not running")
+	case r.control <- c:
+		return nil
+	}
+}
+
+// Done is closed once the replay has finished or been stopped
+func (r *Replay) Done() <-chan struct{} {
+	return r.done
+}
+
+// Status returns the last status the replay reported
+func (r *Replay) Status() common.ReplayStatus {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.status
+}
+
+// next returns the next UPDATE in the capture sent by the selected peer
+func (r *Replay) next(reader *Reader) (time.Time, *messages.BGPMessageUpdate, error) {
+	for {
+		record, err := reader.Next()
+		if record == nil {
+			return time.Time{}, nil, err
+		}
+		if err != nil {
+			continue
+		}
+		msg, ok := record.Data.(*fgmrt.MrtBGP4MP_Msg_AS4)
+		if !ok {
+			continue
+		}
+		if r.PeerIP != nil && !r.PeerIP.Equal(msg.PeerIP) {
+			continue
+		}
+		if r.PeerASN != 0 && r.PeerASN != msg.PeerAS {
+			continue
+		}
+		update, ok := msg.Message.(*messages.BGPMessageUpdate)
+		if !ok {
+			continue
+		}
+		return record.Timestamp, update, nil
+	}
+}
+
+// ipv4Only returns the IPv4 prefixes of a list
+func ipv4Only(nlri []common.NLRI) []common.NLRI {
+	var out []common.NLRI
+	for _, n := range nlri {
+		if ip, _, err := net.ParseCIDR(n.Prefix); err == nil && ip.To4() != nil {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// scan reads through the capture once to find its time range and size so
+// progress can be reported
+func (r *Replay) scan(status *common.ReplayStatus) error {
+	reader, err := Open(r.Path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	for {
+		ts, _, err := r.next(reader)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if status.Total == 0 {
+			status.Start = uint64(ts.UnixNano())
+		}
+		status.End = uint64(ts.UnixNano())
+		status.Total++
+	}
+	if status.Total == 0 {
+		return errors.New("no matching UPDATE messages in capture")
+	}
+	return nil
+}
+
+// Run replays the capture through queue, reporting progress as ReplayStatus
+// packets on events, until the capture ends, the replay is stopped or ctx is
+// cancelled. Routes refused because the queue is full or rate limited are
+// retried, anything else queue refuses is reported and skipped.
+func (r *Replay) Run(ctx context.Context, queue func(*common.RouteData) *common.Error, events chan<- *common.Packet) {
+	defer close(r.done)
+
+	status := r.Status()
+	report := func() {
+		r.lock.Lock()
+		r.status = status
+		r.lock.Unlock()
+		events <- &common.Packet{Type: "ReplayStatus", Data: status}
+	}
+	fail := func(err error) {
+		events <- &common.Packet{Type: "Error", Data: common.Error{Message: "Replay failed: " + err.Error()}}
+		status.State = "failed"
+		report()
+	}
+	report()
+
+	if err := r.scan(&status); err != nil {
+		fail(err)
+		return
+	}
+	reader, err := Open(r.Path)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer reader.Close()
+
+	// The position in the recording advances with wall clock time scaled by
+	// speed, measured from an anchor that is moved on pause and speed changes
+	anchorReal := time.Now()
+	anchorRec := time.Unix(0, int64(status.Start))
+	paused := false
+	var pausedAt time.Time
+	position := func() time.Time {
+		if paused {
+			return pausedAt
+		}
+		return anchorRec.Add(time.Duration(float64(time.Since(anchorReal)) * r.speed))
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	status.State = "running"
+	report()
+	for {
+		ts, update, err := r.next(reader)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		for {
+			var timer <-chan time.Time
+			if !paused {
+				wait := time.Duration(float64(ts.Sub(position())) / r.speed)
+				if wait <= 0 {
+					break
+				}
+				timer = time.After(wait)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer:
+			case <-ticker.C:
+				if !paused {
+					status.Position = uint64(position().UnixNano())
+					report()
+				}
+			case c := <-r.control:
+				switch c.Action {
+				case "pause":
+					if !paused {
+						pausedAt = position()
+						paused = true
+						status.State = "paused"
+					}
+				case "resume":
+					if paused {
+						anchorRec, anchorReal = pausedAt, time.Now()
+						paused = false
+						status.State = "running"
+					}
+				case "speed":
+					if !paused {
+						anchorRec, anchorReal = position(), time.Now()
+					}
+					r.speed = c.Speed
+					status.Speed = c.Speed
+				case "stop":
+					status.State = "stopped"
+					report()
+					return
+				}
+				status.Position = uint64(position().UnixNano())
+				report()
+			}
+		}
+
+		data := bgp.RouteDataFromUpdate(update)
+		// Sessions only announce IPv4 unicast prefixes
+		data.Prefixes, data.Withdraws = ipv4Only(data.Prefixes), ipv4Only(data.Withdraws)
+		if r.NextHop != "" {
+			data.NextHop = r.NextHop
+		}
+		// Messages with nothing we can announce, like End-of-RIB markers, still
+		// count towards progress
+		if len(data.Prefixes) > 0 || len(data.Withdraws) > 0 {
+			for {
+				err := queue(&data)
+				if err == nil {
+					break
+				}
+				if err.Code != common.ErrQueueFull && err.Code != common.ErrRateLimit {
+					events <- &common.Packet{Type: "Error", Data: common.Error{Code: err.Code, Message: "Replay skipped an UPDATE: " + err.Message}}
+					break
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(retryWait):
+				}
+			}
+		}
+		status.Sent++
+		status.Position = uint64(ts.UnixNano())
+	}
+
+	status.State = "finished"
+	report()
+}
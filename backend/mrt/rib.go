@@ -0,0 +1,196 @@
+package mrt
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/bgptools/fgbgp/messages"
+	fgmrt "github.com/bgptools/fgbgp/mrt"
+	"github.com/hamptonmoore/bgp.exposed/backend/common"
+	"github.com/sirupsen/logrus"
+)
+
+// RIBSource describes a TABLE_DUMP or TABLE_DUMP_V2 RIB file to expose as a routeset and
+// which of its routes to keep
+type RIBSource struct {
+	File       string   `json:"file"`
+	OriginASNs []uint32 `json:"originASNs"`
+	Prefixes   []string `json:"prefixes"` // Only keep prefixes covered by one of these ranges
+	Sample     int      `json:"sample"`   // Randomly keep at most this many prefixes, 0 keeps all
+}
+
+type ribRoute struct {
+	prefix string
+	route  common.RoutesetRoute
+}
+
+// matches reports whether a prefix falls within one of the configured ranges
+func matches(prefix *net.IPNet, ranges []*net.IPNet) bool {
+	if len(ranges) == 0 {
+		return true
+	}
+	ones, _ := prefix.Mask.Size()
+	for _, r := range ranges {
+		rOnes, _ := r.Mask.Size()
+		if r.Contains(prefix.IP) && ones >= rOnes {
+			return true
+		}
+	}
+	return false
+}
+
+// entryToRoute copies the attributes we announce from a RIB entry. LOCAL_PREF
+// is left out as routesets are mostly announced to external peers.
+func entryToRoute(attributes []messages.BGPAttributeIf) common.RoutesetRoute {
+	route := common.RoutesetRoute{}
+	for _, v := range attributes {
+		switch val := v.(type) {
+		case messages.BGPAttribute_ORIGIN:
+			route.Origin = int(val.Origin)
+		case messages.BGPAttribute_ASPATH:
+			route.AsPath = common.AsPathFromAttribute(val)
+		case messages.BGPAttribute_COMMUNITIES:
+			for _, c := range val.Communities {
+				route.Communities = append(route.Communities, []uint16{
+					uint16(c / 65536), uint16(c % 65536),
+				})
+			}
+		case messages.BGPAttribute_LARGECOMMUNITIES:
+			route.LargeCommunities = append(route.LargeCommunities, val.Communities...)
+		case messages.BGPAttribute_MED:
+			med := val.Med
+			route.Med = &med
+		case messages.BGPAttribute_ATOMIC_AGGREGATE:
+			route.AtomicAggregate = true
+		case messages.BGPAttribute_AGGREGATOR:
+			if len(val.Identifier) == 4 {
+				route.Aggregator = &common.Aggregator{ASN: val.ASN, Address: net.IP(val.Identifier).String()}
+			}
+		case messages.BGPAttribute:
+			route.ExtendedCommunities = append(route.ExtendedCommunities, common.ExtendedCommunitiesFromAttribute(val)...)
+		}
+	}
+	return route
+}
+
+// groupKey identifies the attributes of a route, for grouping prefixes that
+// share them
+func groupKey(route common.RoutesetRoute) string {
+	key := fmt.Sprint(route.AsPath, route.Communities, route.LargeCommunities, route.ExtendedCommunities, route.Origin, route.AtomicAggregate)
+	if route.Med != nil {
+		key += fmt.Sprint(" med ", *route.Med)
+	}
+	if route.Aggregator != nil {
+		key += fmt.Sprint(" aggregator ", *route.Aggregator)
+	}
+	return key
+}
+
+// LoadRIB reads a TABLE_DUMP or TABLE_DUMP_V2 file and returns the routes
+// matching the source's filters, grouped by identical attributes. For every
+// prefix only the first RIB entry passing the filters is kept.
+func LoadRIB(src RIBSource, log *logrus.Logger) ([]common.RoutesetRoute, error) {
+	ranges := []*net.IPNet{}
+	for _, p := range src.Prefixes {
+		_, r, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix filter %q: %w", p, err)
+		}
+		ranges = append(ranges, r)
+	}
+	origins := map[uint32]bool{}
+	for _, asn := range src.OriginASNs {
+		origins[asn] = true
+	}
+
+	reader, err := Open(src.File)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	selected := []ribRoute{}
+	seen := 0
+	// TABLE_DUMP has a record per prefix and peer rather than per prefix
+	done := map[string]bool{}
+	for {
+		record, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if record == nil {
+			return nil, err
+		}
+		if err != nil {
+			log.Debugf("[LoadRIB %s] skipping undecodable record: %s", src.File, err)
+			continue
+		}
+
+		var prefix net.IPNet
+		var entries [][]messages.BGPAttributeIf
+		switch rib := record.Data.(type) {
+		case *fgmrt.MrtTableDumpV2_Rib:
+			nlri, ok := rib.NLRI.(messages.NLRI_IPPrefix)
+			if !ok {
+				continue
+			}
+			prefix = nlri.Prefix
+			for _, entry := range rib.RibEntries {
+				if entry != nil {
+					entries = append(entries, entry.Attributes)
+				}
+			}
+		case fgmrt.MrtTableDumpV1_Rib:
+			prefix = rib.Prefix
+			entries = append(entries, rib.Attributes)
+		default:
+			continue
+		}
+		if done[prefix.String()] || !matches(&prefix, ranges) {
+			continue
+		}
+
+		for _, attributes := range entries {
+			route := entryToRoute(attributes)
+			if len(origins) > 0 {
+				origin, ok := route.AsPath.Origin()
+				if !ok || !origins[origin] {
+					continue
+				}
+			}
+
+			// Reservoir sampling keeps a uniform sample without knowing the table size upfront
+			candidate := ribRoute{prefix: prefix.String(), route: route}
+			done[candidate.prefix] = true
+			seen++
+			if src.Sample <= 0 || len(selected) < src.Sample {
+				selected = append(selected, candidate)
+			} else if i := rng.Intn(seen); i < src.Sample {
+				selected[i] = candidate
+			}
+			break
+		}
+	}
+
+	// Group prefixes sharing the same attributes so they're announced together
+	groups := map[string]int{}
+	routes := []common.RoutesetRoute{}
+	for _, r := range selected {
+		key := groupKey(r.route)
+		i, ok := groups[key]
+		if !ok {
+			i = len(routes)
+			groups[key] = i
+			routes = append(routes, r.route)
+		}
+		routes[i].Prefixes = append(routes[i].Prefixes, r.prefix)
+	}
+
+	log.Infof("[LoadRIB %s] loaded %d prefixes in %d routes", src.File, len(selected), len(routes))
+	return routes, nil
+}
@@ -0,0 +1,106 @@
+package mrt
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ribFixture is the TABLE_DUMP file from fgbgp's tests, a single peer's IPv6
+// table with one record per prefix
+const ribFixture = "testdata/rib.20030503.1429.bz2"
+
+func loadRIB(t *testing.T, src RIBSource) map[string][]uint32 {
+	t.Helper()
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+	src.File = ribFixture
+	routes, err := LoadRIB(src, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefixes := map[string][]uint32{}
+	for _, route := range routes {
+		var path []uint32
+		for _, segment := range route.AsPath {
+			path = append(path, segment.ASNs...)
+		}
+		for _, prefix := range route.Prefixes {
+			if _, ok := prefixes[prefix]; ok {
+				t.Errorf("prefix %s loaded twice", prefix)
+			}
+			prefixes[prefix] = path
+		}
+	}
+	return prefixes
+}
+
+func TestLoadRIB(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		src  RIBSource
+		want map[string][]uint32
+	}{
+		{
+			name: "prefix filter",
+			src:  RIBSource{Prefixes: []string{"2001:200::/29"}},
+			want: map[string][]uint32{
+				"2001:200::/32":        {2914, 3549, 2500},
+				"2001:200::/35":        {2914, 2500},
+				"2001:200:0:1800::/64": {2914},
+			},
+		},
+		{
+			name: "origin filter",
+			src:  RIBSource{OriginASNs: []uint32{2500}},
+			want: map[string][]uint32{
+				"2001:200::/32": {2914, 3549, 2500},
+				"2001:200::/35": {2914, 2500},
+				"3ffe:500::/24": {2914, 2500},
+			},
+		},
+		{
+			name: "both filters",
+			src:  RIBSource{Prefixes: []string{"2001:200::/29"}, OriginASNs: []uint32{2914}},
+			want: map[string][]uint32{
+				"2001:200:0:1800::/64": {2914},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got := loadRIB(t, test.src)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("loaded %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	t.Run("no filters", func(t *testing.T) {
+		if got := loadRIB(t, RIBSource{}); len(got) != 375 {
+			t.Errorf("loaded %d prefixes, want all 375", len(got))
+		}
+	})
+
+	t.Run("sample", func(t *testing.T) {
+		all := loadRIB(t, RIBSource{OriginASNs: []uint32{2914}})
+		got := loadRIB(t, RIBSource{OriginASNs: []uint32{2914}, Sample: 3})
+		if len(got) != 3 {
+			t.Errorf("sampled %d prefixes, want 3", len(got))
+		}
+		for prefix := range got {
+			if _, ok := all[prefix]; !ok {
+				t.Errorf("sampled %s, which doesn't pass the origin filter", prefix)
+			}
+		}
+	})
+
+	t.Run("invalid prefix filter", func(t *testing.T) {
+		log := logrus.New()
+		log.SetOutput(ioutil.Discard)
+		if _, err := LoadRIB(RIBSource{File: ribFixture, Prefixes: []string{"2001:200::"}}, log); err == nil {
+			t.Error("invalid prefix filter accepted")
+		}
+	})
+}
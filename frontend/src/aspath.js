@@ -0,0 +1,44 @@
+// AS paths are lists of segments, shown with AS_SETs in braces,
+// AS_CONFED_SEQUENCEs in parentheses and AS_CONFED_SETs in brackets
+const brackets = {
+    "set": ["{", "}"],
+    "confed-sequence": ["(", ")"],
+    "confed-set": ["[", "]"],
+};
+
+export function formatAsPath(path) {
+    // Routesets may still give a plain list of ASNs, a single AS_SEQUENCE
+    if (path && path.length > 0 && typeof path[0] == "number") {
+        path = [{type: "sequence", asns: path}];
+    }
+    return (path || []).map((segment) => {
+        let asns = segment.asns.join(" ");
+        if (brackets[segment.type] != undefined) {
+            return brackets[segment.type][0] + asns + brackets[segment.type][1];
+        }
+        return asns;
+    }).join(" ");
+}
+
+// parseAsPath reads the format above back into segments, so
+// "65510 {65530 65531}" is an AS_SEQUENCE followed by an AS_SET
+export function parseAsPath(text) {
+    let path = [];
+    let current = null;
+    for (const token of text.match(/[{}()\[\]]|\d+/g) || []) {
+        let type = Object.keys(brackets).find((t) => brackets[t][0] == token);
+        if (type != undefined) {
+            current = {type: type, asns: []};
+            path.push(current);
+        } else if (Object.values(brackets).some((b) => b[1] == token)) {
+            current = null;
+        } else {
+            if (current == null) {
+                current = {type: "sequence", asns: []};
+                path.push(current);
+            }
+            current.asns.push(parseInt(token));
+        }
+    }
+    return path.filter((segment) => segment.asns.length > 0);
+}
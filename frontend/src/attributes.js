@@ -0,0 +1,20 @@
+// Raw path attributes are written as "flags:type:value", with the flags and
+// value in hex and the type code in decimal, e.g. "c0:250:deadbeef"
+export function formatRawAttribute(attribute) {
+    return attribute.flags.toString(16).padStart(2, "0") + ":" + attribute.typeCode + ":" + attribute.value;
+}
+
+// parseRawAttributes reads a comma separated list of the format above
+export function parseRawAttributes(text) {
+    return text.split(",")
+        .map((element) => element.trim())
+        .filter((element) => element != "")
+        .map((element) => {
+            let split = element.split(":");
+            return {
+                flags: parseInt(split[0], 16),
+                typeCode: Number(split[1]),
+                value: (split[2] || "").replace(/^0x/, ""),
+            };
+        });
+}
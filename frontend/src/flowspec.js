@@ -0,0 +1,69 @@
+// FlowSpec rules are written on one line as keywords followed by their
+// values, the same way the backend logs them, e.g.
+// "destination 192.0.2.0/24 protocol 6 destination-port 80 443". Values are
+// described with the FlowSpec type in backend/common/flowspec.go.
+const components = [
+    ["protocol", "protocol"],
+    ["port", "port"],
+    ["destination-port", "destinationPort"],
+    ["source-port", "sourcePort"],
+    ["icmp-type", "icmpType"],
+    ["icmp-code", "icmpCode"],
+    ["tcp-flags", "tcpFlags"],
+    ["packet-length", "packetLength"],
+    ["dscp", "dscp"],
+    ["fragment", "fragment"],
+];
+
+const keywords = new Map([
+    ["destination", "destination"],
+    ["source", "source"],
+    ["offset", "offset"],
+    ...components,
+]);
+
+export function formatFlowSpec(rule) {
+    let parts = [rule.family || (/:/.test((rule.destination || "") + (rule.source || "")) ? "ipv6" : "ipv4")];
+    for (const [name, offset] of [["destination", "destinationOffset"], ["source", "sourceOffset"]]) {
+        if (rule[name]) {
+            parts.push(name + " " + rule[name]);
+            if (rule[offset]) {
+                parts.push("offset " + rule[offset]);
+            }
+        }
+    }
+    for (const [name, field] of components) {
+        if (rule[field]) {
+            parts.push(name + " " + rule[field]);
+        }
+    }
+    return parts.join(" ");
+}
+
+// parseFlowSpec reads the format above, an offset applying to the prefix
+// before it
+export function parseFlowSpec(text) {
+    let rule = {};
+    let field = null;
+    let prefix = null;
+    for (const word of text.trim().split(/\s+/)) {
+        if (word == "ipv4" || word == "ipv6") {
+            rule.family = word;
+            field = null;
+        } else if (keywords.has(word)) {
+            field = keywords.get(word);
+            if (field == "offset") {
+                field = prefix == null ? null : prefix + "Offset";
+            } else if (field == "destination" || field == "source") {
+                prefix = field;
+            }
+        } else if (field != null) {
+            if (field.endsWith("Offset")) {
+                rule[field] = Number(word);
+            } else {
+                rule[field] = rule[field] ? rule[field] + " " + word : word;
+            }
+        }
+    }
+    return rule;
+}